@@ -35,8 +35,11 @@ type EvaluationContextBuilder struct {
 	Registry             Registry                // Registry stores functions
 	SampleMethod         timeseries.SampleMethod // SampleMethod to use when up/downsampling to match the requested resolution
 	FetchLimit           FetchCounter            // A limit on the number of fetches which may be performed
+	PointLimit           PointCounter            // A limit on the number of points which may be fetched and materialized
 	Profiler             *inspect.Profiler       // A profiler pointer
 	EvaluationNotes      *EvaluationNotes        // Debug + numerical notes that can be added during evaluation
+	PartialResults       PartialResults          // What to do with series which fail to be fetched
+	Tenant               string                  // The tenant to fetch data for (optional)
 	Ctx                  context.Context
 
 	// These may be changed in sub-contexts while evaluating the query.
@@ -82,6 +85,11 @@ func (context EvaluationContext) SampleMethod() timeseries.SampleMethod {
 	return context.private.SampleMethod
 }
 
+// Tenant returns the tenant that data is fetched for.
+func (context EvaluationContext) Tenant() string {
+	return context.private.Tenant
+}
+
 // Predicate returns the underlying predicate.Predicate.
 func (context EvaluationContext) Predicate() predicate.Predicate {
 	return context.private.Predicate
@@ -93,6 +101,41 @@ func (context EvaluationContext) FetchLimitConsume(n int) error {
 	return context.private.FetchLimit.Consume(n)
 }
 
+// PointLimitConsumeFetched tries to consume the number of fetched points from
+// the point limit, returning a non-nil error if this would exceed it.
+func (context EvaluationContext) PointLimitConsumeFetched(n int) error {
+	return context.private.PointLimit.ConsumeFetched(n)
+}
+
+// PointLimitConsumeMaterialized tries to consume the number of points computed
+// during evaluation from the point limit, returning a non-nil error if this
+// would exceed it.
+func (context EvaluationContext) PointLimitConsumeMaterialized(n int) error {
+	return context.private.PointLimit.ConsumeMaterialized(n)
+}
+
+// PointLimit returns the underlying PointCounter.
+func (context EvaluationContext) PointLimit() PointCounter {
+	return context.private.PointLimit
+}
+
+// PartialResults returns how series which fail to be fetched are handled.
+func (context EvaluationContext) PartialResults() PartialResults {
+	return context.private.PartialResults
+}
+
+// AddFailedSeries records that a series could not be fetched and was left out
+// of (or NaN-filled in) the result, adding the error as a note.
+func (context EvaluationContext) AddFailedSeries(err error) {
+	context.private.EvaluationNotes.markPartial()
+	context.AddNote(err.Error())
+}
+
+// Partial returns whether any series have been left out of the result.
+func (context EvaluationContext) Partial() bool {
+	return context.private.EvaluationNotes.Partial()
+}
+
 // Ctx returns the underlying Context instance for the evaluation.
 func (context EvaluationContext) Ctx() context.Context {
 	return context.private.Ctx
@@ -121,8 +164,9 @@ func (context EvaluationContext) Notes() []string {
 
 // EvaluationNotes holds notes that were recorded during evaluation.
 type EvaluationNotes struct {
-	mutex sync.Mutex
-	notes []string
+	mutex   sync.Mutex
+	notes   []string
+	partial bool // set when a series has been left out of the result
 }
 
 // AddNote adds a new note to the collection in a threadsafe manner.
@@ -145,6 +189,47 @@ func (notes *EvaluationNotes) Notes() []string {
 	return notes.notes
 }
 
+func (notes *EvaluationNotes) markPartial() {
+	if notes == nil {
+		return
+	}
+	notes.mutex.Lock()
+	defer notes.mutex.Unlock()
+	notes.partial = true
+}
+
+// Partial returns whether the result is missing any series, in a threadsafe manner.
+func (notes *EvaluationNotes) Partial() bool {
+	if notes == nil {
+		return false
+	}
+	notes.mutex.Lock()
+	defer notes.mutex.Unlock()
+	return notes.partial
+}
+
+// PartialResults describes what happens to series which fail to be fetched.
+type PartialResults int
+
+const (
+	PartialResultsNone PartialResults = iota // PartialResultsNone fails the whole query (the default).
+	PartialResultsNaN                        // PartialResultsNaN replaces failed series with NaN-filled ones.
+	PartialResultsOmit                       // PartialResultsOmit leaves failed series out of the result.
+)
+
+// ParsePartialResults parses "none", "nan" or "omit" (or "", meaning "none").
+func ParsePartialResults(mode string) (PartialResults, error) {
+	switch mode {
+	case "", "none":
+		return PartialResultsNone, nil
+	case "nan":
+		return PartialResultsNaN, nil
+	case "omit":
+		return PartialResultsOmit, nil
+	}
+	return PartialResultsNone, fmt.Errorf("unknown partial results mode %q; expected one of none, nan or omit", mode)
+}
+
 // WithTimerange duplicates the EvaluationContext but with a new timerange.
 func (context EvaluationContext) WithTimerange(t api.Timerange) EvaluationContext {
 	if context.private.Timerange == t {
@@ -205,6 +290,73 @@ func (c FetchCounter) Consume(n int) error {
 	return nil
 }
 
+// PointCounter is used to count the points which are fetched and materialized
+// during evaluation in a thread-safe manner. Both kinds share a single limit.
+// The zero value is unlimited and counts nothing.
+type PointCounter struct {
+	fetched      *int64
+	materialized *int64
+	limit        int
+}
+
+// NewPointCounter creates a PointCounter with n as the limit (0 is unlimited).
+func NewPointCounter(n int) PointCounter {
+	return PointCounter{
+		fetched:      new(int64),
+		materialized: new(int64),
+		limit:        n,
+	}
+}
+
+// Limit returns the max # of points allowed by this counter (0 is unlimited).
+func (c PointCounter) Limit() int {
+	return c.limit
+}
+
+// Fetched returns the number of points fetched so far.
+func (c PointCounter) Fetched() int {
+	if c.fetched == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(c.fetched))
+}
+
+// Materialized returns the number of points materialized so far.
+func (c PointCounter) Materialized() int {
+	if c.materialized == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(c.materialized))
+}
+
+// ConsumeFetched counts n more fetched points, returning an error if the total
+// exceeds the limit.
+func (c PointCounter) ConsumeFetched(n int) error {
+	if c.fetched == nil {
+		return nil
+	}
+	atomic.AddInt64(c.fetched, int64(n))
+	return c.check(fmt.Sprintf("fetching %d additional points", n))
+}
+
+// ConsumeMaterialized counts n more materialized points, returning an error if
+// the total exceeds the limit.
+func (c PointCounter) ConsumeMaterialized(n int) error {
+	if c.materialized == nil {
+		return nil
+	}
+	atomic.AddInt64(c.materialized, int64(n))
+	return c.check(fmt.Sprintf("computing %d additional points", n))
+}
+
+func (c PointCounter) check(action string) error {
+	total := c.Fetched() + c.Materialized()
+	if c.limit > 0 && total > c.limit {
+		return NewLimitError(fmt.Sprintf("%s brings the total number of points fetched and computed above the configured limit", action), total, c.limit)
+	}
+	return nil
+}
+
 type contextIdentity struct {
 	Timerange      api.Timerange
 	PredicateQuery string
@@ -199,8 +199,16 @@ func NewFilterThreshold(name string, summary func([]float64) float64, below bool
 func NewAggregate(name string, aggregator func([]float64) float64) function.MetricFunction {
 	return function.MakeFunction(
 		name,
-		func(seriesList api.SeriesList, groups function.Groups) api.SeriesList {
-			return aggregate.By(seriesList, aggregator, groups.List, groups.Collapses)
+		func(seriesList api.SeriesList, groups function.Groups, context function.EvaluationContext) (api.SeriesList, error) {
+			result := aggregate.By(seriesList, aggregator, groups.List, groups.Collapses)
+			points := 0
+			for _, series := range result.Series {
+				points += len(series.Values)
+			}
+			if err := context.PointLimitConsumeMaterialized(points); err != nil {
+				return api.SeriesList{}, err
+			}
+			return result, nil
 		},
 	)
 }
@@ -210,8 +218,16 @@ func NewAggregate(name string, aggregator func([]float64) float64) function.Metr
 func NewOperator(op string, operator func(float64, float64) float64) function.Function {
 	return function.MakeFunction(
 		op,
-		func(leftList api.SeriesList, rightList api.SeriesList, timerange api.Timerange) (api.SeriesList, error) {
+		func(leftList api.SeriesList, rightList api.SeriesList, context function.EvaluationContext) (api.SeriesList, error) {
 			joined := join.Join([]api.SeriesList{leftList, rightList})
+			// Check the budget before computing the values of every joined row.
+			points := 0
+			for _, row := range joined.Rows {
+				points += len(row.Row[0].Values)
+			}
+			if err := context.PointLimitConsumeMaterialized(points); err != nil {
+				return api.SeriesList{}, err
+			}
 
 			result := make([]api.Timeseries, len(joined.Rows))
 
@@ -0,0 +1,65 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command carbon listens for metrics sent with the Graphite plaintext protocol
+// (over TCP and UDP; the pickle protocol is not supported), indexing their
+// tagged names in Cassandra and optionally forwarding their datapoints to
+// Blueflood.
+package main
+
+import (
+	"github.com/square/metrics/log"
+	"github.com/square/metrics/main/carbon/listener"
+	"github.com/square/metrics/main/common"
+	"github.com/square/metrics/metric_metadata/cassandra"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/timeseries/blueflood"
+	"github.com/square/metrics/util"
+)
+
+func main() {
+	config := struct {
+		ConversionRulesPath string           `yaml:"conversion_rules_path"`
+		Cassandra           cassandra.Config `yaml:"cassandra"`
+		Carbon              listener.Config  `yaml:"carbon"`
+
+		// Blueflood is optional; without it, points are dropped once their metrics are indexed.
+		Blueflood *blueflood.Config `yaml:"blueflood"`
+	}{}
+
+	common.LoadConfig(&config)
+
+	metadataAPI, err := cassandra.NewMetricMetadataAPI(config.Cassandra)
+	if err != nil {
+		common.ExitWithErrorMessage("Error loading Cassandra API: %s", err.Error())
+		return
+	}
+
+	ruleset, err := util.LoadRules(config.ConversionRulesPath)
+	if err != nil {
+		common.ExitWithErrorMessage("Error loading conversion rules: %s", err.Error())
+		return
+	}
+
+	var storageAPI timeseries.StorageUpdateAPI
+	if config.Blueflood != nil {
+		config.Blueflood.GraphiteMetricConverter = &util.RuleBasedGraphiteConverter{Ruleset: ruleset}
+		storageAPI = blueflood.NewBlueflood(*config.Blueflood).(timeseries.StorageUpdateAPI)
+	}
+
+	err = listener.NewListener(config.Carbon, ruleset, metadataAPI, storageAPI).ListenAndServe()
+	if err != nil {
+		log.Errorf("Error serving carbon listener: %s", err.Error())
+	}
+}
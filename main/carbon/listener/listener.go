@@ -0,0 +1,318 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package listener receives metrics sent with the Graphite plaintext protocol,
+// indexing their tagged names and optionally forwarding their datapoints.
+//
+// Only the plaintext protocol is supported, over TCP and UDP. Senders using
+// Carbon's pickle protocol (usually on port 2004), such as carbon-relay, must
+// be configured to send plaintext instead.
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/log"
+	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/util"
+)
+
+// maxDatagramSize is the largest UDP packet which will be read.
+const maxDatagramSize = 65536
+
+// Config stores the data needed to instantiate a Listener.
+type Config struct {
+	TCPAddress        string        `yaml:"tcp_address"`         // TCPAddress to listen on, such as ":2003" (optional).
+	UDPAddress        string        `yaml:"udp_address"`         // UDPAddress to listen on, such as ":2003" (optional).
+	BatchSize         int           `yaml:"batch_size"`          // BatchSize is the number of pending metrics or points which triggers a flush (default 1000).
+	FlushInterval     time.Duration `yaml:"flush_interval"`      // FlushInterval is the longest that metrics or points wait before being flushed (default 10s).
+	MaxIndexedMetrics int           `yaml:"max_indexed_metrics"` // MaxIndexedMetrics bounds how many indexed metrics are remembered, to avoid adding them again (default 1000000).
+	ReindexInterval   time.Duration `yaml:"reindex_interval"`    // ReindexInterval is how often metrics still being received are added again, refreshing their last-seen times (default 1h).
+
+	Clock util.Clock `yaml:"-"`
+}
+
+// Stats counts what a Listener has received.
+type Stats struct {
+	Lines     int // Lines is the number of lines received.
+	Malformed int // Malformed is the number of lines which could not be parsed.
+	Unmatched int // Unmatched is the number of names which no rule converts.
+	Indexed   int // Indexed is the number of metrics added (or added again) to the metadata API.
+	Forwarded int // Forwarded is the number of points written to the storage API.
+}
+
+// Listener converts Graphite names to tagged metrics, batching new metrics
+// into the MetricUpdateAPI and points into the StorageUpdateAPI.
+type Listener struct {
+	config      Config
+	ruleset     util.RuleSet
+	metadataAPI metadata.MetricUpdateAPI
+	storageAPI  timeseries.StorageUpdateAPI // storageAPI is nil if points aren't forwarded
+
+	mutex          sync.Mutex
+	indexed        map[string]time.Time        // metrics already added to the metadata API, and when
+	pendingMetrics map[string]api.TaggedMetric // metrics waiting to be added
+	pendingPoints  []timeseries.Datapoint      // points waiting to be written
+	flushes        chan struct{}               // signals that a batch is full
+	stats          Stats
+}
+
+// NewListener creates a Listener. The storageAPI may be nil, in which case
+// only the metric names are indexed.
+func NewListener(config Config, ruleset util.RuleSet, metadataAPI metadata.MetricUpdateAPI, storageAPI timeseries.StorageUpdateAPI) *Listener {
+	if config.BatchSize == 0 {
+		config.BatchSize = 1000
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = 10 * time.Second
+	}
+	if config.MaxIndexedMetrics == 0 {
+		config.MaxIndexedMetrics = 1000000
+	}
+	if config.ReindexInterval == 0 {
+		config.ReindexInterval = time.Hour
+	}
+	if config.Clock == nil {
+		config.Clock = util.RealClock{}
+	}
+	return &Listener{
+		config:         config,
+		ruleset:        ruleset,
+		metadataAPI:    metadataAPI,
+		storageAPI:     storageAPI,
+		indexed:        map[string]time.Time{},
+		pendingMetrics: map[string]api.TaggedMetric{},
+		flushes:        make(chan struct{}, 1),
+	}
+}
+
+// Stats returns the counts of what the Listener has received so far.
+func (l *Listener) Stats() Stats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.stats
+}
+
+func indexKey(metric api.TaggedMetric) string {
+	return fmt.Sprintf("%s\x00%s", metric.MetricKey, metric.TagSet.Serialize())
+}
+
+// parseLine parses a line of the form "name value timestamp", where the
+// timestamp is in seconds since the epoch.
+func parseLine(line string) (util.GraphiteMetric, float64, time.Time, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return "", 0, time.Time{}, fmt.Errorf("expected `name value timestamp` but got %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return "", 0, time.Time{}, fmt.Errorf("invalid value in %q: %s", line, err.Error())
+	}
+	seconds, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return "", 0, time.Time{}, fmt.Errorf("invalid timestamp in %q", line)
+	}
+	return util.GraphiteMetric(fields[0]), value, time.Unix(0, int64(seconds*1e9)), nil
+}
+
+// HandleLine queues the metric and point of a single plaintext line.
+// Names which no rule converts are counted and dropped.
+func (l *Listener) HandleLine(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	name, value, timestamp, err := parseLine(line)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.stats.Lines++
+	if err != nil {
+		l.stats.Malformed++
+		return err
+	}
+	metric, ok := l.ruleset.MatchRule(string(name))
+	if !ok {
+		l.stats.Unmatched++
+		return nil
+	}
+	key := indexKey(metric)
+	if indexedAt, ok := l.indexed[key]; !ok || l.config.Clock.Now().Sub(indexedAt) >= l.config.ReindexInterval {
+		l.pendingMetrics[key] = metric
+	}
+	if l.storageAPI != nil {
+		l.pendingPoints = append(l.pendingPoints, timeseries.Datapoint{
+			Metric:    metric,
+			Timestamp: timestamp,
+			Value:     value,
+		})
+	}
+	if len(l.pendingMetrics) >= l.config.BatchSize || len(l.pendingPoints) >= l.config.BatchSize {
+		select {
+		case l.flushes <- struct{}{}:
+		default: // a flush is already requested
+		}
+	}
+	return nil
+}
+
+// Flush adds the pending metrics to the metadata API and writes the pending
+// points to the storage API. Metrics which fail to be added are retried the
+// next time they are received; their points are written regardless.
+func (l *Listener) Flush() error {
+	l.mutex.Lock()
+	metrics := make([]api.TaggedMetric, 0, len(l.pendingMetrics))
+	for _, metric := range l.pendingMetrics {
+		metrics = append(metrics, metric)
+	}
+	points := l.pendingPoints
+	l.pendingMetrics = map[string]api.TaggedMetric{}
+	l.pendingPoints = nil
+	l.mutex.Unlock()
+
+	errors := []string{}
+	if len(metrics) != 0 {
+		if err := l.metadataAPI.AddMetrics(metrics, metadata.Context{}); err != nil {
+			errors = append(errors, fmt.Sprintf("error indexing %d metrics: %s", len(metrics), err.Error()))
+		} else {
+			l.markIndexed(metrics)
+		}
+	}
+	if len(points) != 0 {
+		if err := l.storageAPI.WritePoints(timeseries.WriteRequest{Datapoints: points, Ctx: context.Background()}); err != nil {
+			errors = append(errors, fmt.Sprintf("error forwarding %d points: %s", len(points), err.Error()))
+		} else {
+			l.mutex.Lock()
+			l.stats.Forwarded += len(points)
+			l.mutex.Unlock()
+		}
+	}
+	if len(errors) != 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// markIndexed records that the metrics have been added to the metadata API.
+func (l *Listener) markIndexed(metrics []api.TaggedMetric) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.indexed)+len(metrics) > l.config.MaxIndexedMetrics {
+		// Forgetting everything only costs re-adding the metrics which are still active.
+		l.indexed = map[string]time.Time{}
+	}
+	now := l.config.Clock.Now()
+	for _, metric := range metrics {
+		l.indexed[indexKey(metric)] = now
+	}
+	l.stats.Indexed += len(metrics)
+}
+
+// ServeTCP reads newline-separated lines from each connection accepted by
+// the net.Listener, until it is closed.
+func (l *Listener) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				if err := l.HandleLine(scanner.Text()); err != nil {
+					log.Debugf("Dropping line from %s: %s", conn.RemoteAddr().String(), err.Error())
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				log.Warningf("Error reading from %s: %s", conn.RemoteAddr().String(), err.Error())
+			}
+		}()
+	}
+}
+
+// ServeUDP reads newline-separated lines from each packet received by the
+// connection, until it is closed.
+func (l *Listener) ServeUDP(conn net.PacketConn) error {
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, address, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		for _, line := range bytes.Split(buffer[:n], []byte("\n")) {
+			if err := l.HandleLine(string(line)); err != nil {
+				log.Debugf("Dropping line from %s: %s", address.String(), err.Error())
+			}
+		}
+	}
+}
+
+// flushPeriodically flushes every FlushInterval, or sooner when a batch fills up.
+func (l *Listener) flushPeriodically() {
+	ticker := time.NewTicker(l.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.flushes:
+		}
+		if err := l.Flush(); err != nil {
+			log.Errorf("Error flushing carbon listener: %s", err.Error())
+		}
+	}
+}
+
+// ListenAndServe listens on the configured addresses and serves them until
+// one of them fails.
+func (l *Listener) ListenAndServe() error {
+	if l.config.TCPAddress == "" && l.config.UDPAddress == "" {
+		return fmt.Errorf("neither a TCP nor a UDP address is configured")
+	}
+	errors := make(chan error, 2)
+	if l.config.TCPAddress != "" {
+		tcpListener, err := net.Listen("tcp", l.config.TCPAddress)
+		if err != nil {
+			return err
+		}
+		defer tcpListener.Close()
+		log.Infof("Listening for carbon plaintext on TCP %s", l.config.TCPAddress)
+		go func() {
+			errors <- l.ServeTCP(tcpListener)
+		}()
+	}
+	if l.config.UDPAddress != "" {
+		udpConn, err := net.ListenPacket("udp", l.config.UDPAddress)
+		if err != nil {
+			return err
+		}
+		defer udpConn.Close()
+		log.Infof("Listening for carbon plaintext on UDP %s", l.config.UDPAddress)
+		go func() {
+			errors <- l.ServeUDP(udpConn)
+		}()
+	}
+	go l.flushPeriodically()
+	return <-errors
+}
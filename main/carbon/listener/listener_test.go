@@ -0,0 +1,204 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/timeseries/memory"
+	"github.com/square/metrics/util"
+)
+
+// recordingUpdateAPI records the metrics added to it.
+type recordingUpdateAPI struct {
+	mutex sync.Mutex
+	added []api.TaggedMetric
+	err   error
+}
+
+func (r *recordingUpdateAPI) AddMetric(metric api.TaggedMetric, context metadata.Context) error {
+	return r.AddMetrics([]api.TaggedMetric{metric}, context)
+}
+
+func (r *recordingUpdateAPI) AddMetrics(metrics []api.TaggedMetric, context metadata.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.added = append(r.added, metrics...)
+	return nil
+}
+
+func (r *recordingUpdateAPI) CheckHealthy() error {
+	return nil
+}
+
+func (r *recordingUpdateAPI) names() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := make([]string, len(r.added))
+	for i := range r.added {
+		names[i] = fmt.Sprintf("%s[%s]", r.added[i].MetricKey, r.added[i].TagSet.Serialize())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func testRuleSet(t *testing.T) util.RuleSet {
+	ruleset, err := util.LoadYAML([]byte(`
+rules:
+  -
+    pattern: servers.%host%.cpu
+    metric_key: cpu
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error loading rules: %s", err.Error())
+	}
+	return ruleset
+}
+
+func TestParseLine(t *testing.T) {
+	a := assert.New(t)
+	name, value, timestamp, err := parseLine("servers.a.cpu 0.5 1455000000")
+	a.CheckError(err)
+	a.EqString(string(name), "servers.a.cpu")
+	a.EqFloat(value, 0.5, 1e-9)
+	a.Eq(timestamp, time.Unix(1455000000, 0))
+
+	for _, line := range []string{"servers.a.cpu 0.5", "servers.a.cpu x 1455000000", "servers.a.cpu 1 yesterday", "a b c d"} {
+		if _, _, _, err := parseLine(line); err == nil {
+			t.Errorf("expected an error parsing %q", line)
+		}
+	}
+}
+
+func TestHandleLineAndFlush(t *testing.T) {
+	a := assert.New(t)
+	updateAPI := &recordingUpdateAPI{}
+	storage := memory.NewStorage(memory.Config{Resolutions: []time.Duration{30 * time.Second}})
+	listener := NewListener(Config{}, testRuleSet(t), updateAPI, storage)
+
+	a.CheckError(listener.HandleLine("servers.a.cpu 1 0"))
+	a.CheckError(listener.HandleLine("servers.a.cpu 2 30"))
+	a.CheckError(listener.HandleLine("servers.b.cpu 3 0"))
+	a.CheckError(listener.HandleLine("servers.a.memory 3 0")) // no rule matches
+	if err := listener.HandleLine("servers.a.cpu"); err == nil {
+		t.Errorf("expected an error for a malformed line")
+	}
+	a.CheckError(listener.Flush())
+	a.Eq(updateAPI.names(), []string{"cpu[host=a]", "cpu[host=b]"})
+
+	// Metrics are only indexed once.
+	a.CheckError(listener.HandleLine("servers.a.cpu 4 60"))
+	a.CheckError(listener.Flush())
+	a.EqInt(len(updateAPI.names()), 2)
+
+	a.Eq(listener.Stats(), Stats{Lines: 6, Malformed: 1, Unmatched: 1, Indexed: 2, Forwarded: 4})
+
+	timerange, err := api.NewTimerange(0, 60000, 30000)
+	a.CheckError(err)
+	series, err := storage.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	a.CheckError(err)
+	a.EqFloatArray(series.Values, []float64{1, 2, 4}, 1e-9)
+}
+
+func TestFailedMetricsAreRetried(t *testing.T) {
+	a := assert.New(t)
+	updateAPI := &recordingUpdateAPI{err: fmt.Errorf("unavailable")}
+	storage := memory.NewStorage(memory.Config{Resolutions: []time.Duration{30 * time.Second}})
+	listener := NewListener(Config{}, testRuleSet(t), updateAPI, storage)
+
+	a.CheckError(listener.HandleLine("servers.a.cpu 1 0"))
+	if err := listener.Flush(); err == nil {
+		t.Errorf("expected an error flushing to an unavailable metadata API")
+	}
+	updateAPI.err = nil
+	a.CheckError(listener.HandleLine("servers.a.cpu 1 30"))
+	a.CheckError(listener.Flush())
+	a.Eq(updateAPI.names(), []string{"cpu[host=a]"})
+
+	// The points are forwarded even while their metric fails to be indexed.
+	a.Eq(listener.Stats().Forwarded, 2)
+}
+
+func TestMetricsAreReindexed(t *testing.T) {
+	a := assert.New(t)
+	updateAPI := &recordingUpdateAPI{}
+	clock := mocks.NewTestClock(time.Unix(0, 0))
+	listener := NewListener(Config{ReindexInterval: time.Hour, Clock: clock}, testRuleSet(t), updateAPI, nil)
+
+	a.CheckError(listener.HandleLine("servers.a.cpu 1 0"))
+	a.CheckError(listener.Flush())
+	clock.Move(59 * time.Minute)
+	a.CheckError(listener.HandleLine("servers.a.cpu 1 30"))
+	a.CheckError(listener.Flush())
+	a.EqInt(len(updateAPI.names()), 1)
+
+	// Once the interval has passed, the metric is added again to refresh it.
+	clock.Move(time.Minute)
+	a.CheckError(listener.HandleLine("servers.a.cpu 1 60"))
+	a.CheckError(listener.Flush())
+	a.Eq(updateAPI.names(), []string{"cpu[host=a]", "cpu[host=a]"})
+}
+
+func TestServe(t *testing.T) {
+	a := assert.New(t)
+	updateAPI := &recordingUpdateAPI{}
+	listener := NewListener(Config{}, testRuleSet(t), updateAPI, nil)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	a.CheckError(err)
+	defer tcpListener.Close()
+	go listener.ServeTCP(tcpListener)
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	a.CheckError(err)
+	defer udpConn.Close()
+	go listener.ServeUDP(udpConn)
+
+	tcpClient, err := net.Dial("tcp", tcpListener.Addr().String())
+	a.CheckError(err)
+	fmt.Fprintf(tcpClient, "servers.a.cpu 1 0\nservers.b.cpu 2 0\n")
+	tcpClient.Close()
+	udpClient, err := net.Dial("udp", udpConn.LocalAddr().String())
+	a.CheckError(err)
+	fmt.Fprintf(udpClient, "servers.c.cpu 3 0\n")
+	udpClient.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for listener.Stats().Lines < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.CheckError(listener.Flush())
+	a.Eq(updateAPI.names(), []string{"cpu[host=a]", "cpu[host=b]", "cpu[host=c]"})
+}
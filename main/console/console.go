@@ -26,10 +26,14 @@ import (
 
 	"github.com/square/metrics/function/registry"
 	"github.com/square/metrics/main/common"
+	"github.com/square/metrics/metric_metadata"
 	"github.com/square/metrics/metric_metadata/cassandra"
+	"github.com/square/metrics/metric_metadata/memory"
 	"github.com/square/metrics/query/command"
 	"github.com/square/metrics/query/parser"
+	"github.com/square/metrics/timeseries"
 	"github.com/square/metrics/timeseries/blueflood"
+	memorystorage "github.com/square/metrics/timeseries/memory"
 	"github.com/square/metrics/util"
 )
 
@@ -48,14 +52,31 @@ func main() {
 		ConversionRulesPath string           `yaml:"conversion_rules_path"`
 		Cassandra           cassandra.Config `yaml:"cassandra"`
 		Blueflood           blueflood.Config `yaml:"blueflood"`
+
+		// Optional in-memory metadata store (loaded from its snapshot), used instead of Cassandra.
+		MemoryMetadata *memory.Config `yaml:"memory_metadata"`
+
+		// Optional in-memory timeseries store, used instead of Blueflood.
+		MemoryStorage *memorystorage.Config `yaml:"memory_storage"`
 	}{}
 
 	common.LoadConfig(&config)
 
-	cassandraAPI, err := cassandra.NewMetricMetadataAPI(config.Cassandra)
-	if err != nil {
-		common.ExitWithErrorMessage("Error loading Cassandra API: %s", err.Error())
-		return
+	var metadataAPI metadata.MetricAPI
+	if config.MemoryMetadata != nil {
+		memoryAPI, err := memory.NewMetricMetadataAPI(*config.MemoryMetadata)
+		if err != nil {
+			common.ExitWithErrorMessage("Error loading in-memory metadata API: %s", err.Error())
+			return
+		}
+		metadataAPI = memoryAPI
+	} else {
+		cassandraAPI, err := cassandra.NewMetricMetadataAPI(config.Cassandra)
+		if err != nil {
+			common.ExitWithErrorMessage("Error loading Cassandra API: %s", err.Error())
+			return
+		}
+		metadataAPI = cassandraAPI
 	}
 
 	ruleset, err := util.LoadRules(config.ConversionRulesPath)
@@ -66,13 +87,19 @@ func main() {
 
 	config.Blueflood.GraphiteMetricConverter = &util.RuleBasedGraphiteConverter{Ruleset: ruleset}
 
-	blueflood := blueflood.NewBlueflood(config.Blueflood)
+	var storageAPI timeseries.StorageAPI
+	if config.MemoryStorage != nil {
+		storageAPI = memorystorage.NewStorage(*config.MemoryStorage)
+	} else {
+		storageAPI = blueflood.NewBlueflood(config.Blueflood)
+	}
 
 	executionContext := command.ExecutionContext{
-		MetricMetadataAPI:    cassandraAPI,
-		TimeseriesStorageAPI: blueflood,
+		MetricMetadataAPI:    metadataAPI,
+		TimeseriesStorageAPI: storageAPI,
 		FetchLimit:           1500,
 		SlotLimit:            5000,
+		PointLimit:           10000000,
 		Registry:             registry.Default(),
 		Ctx:                  context.Background(),
 	}
@@ -0,0 +1,54 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// program which moves the metric names held in the wrong rows of the
+// Cassandra metric_name_set table (the legacy shard 0 row, or rows filled
+// under a smaller shard count) into the shards given by the configured
+// metric_name_shards. It is safe to run while MQE is serving and ingesting.
+// metric_name_shards can only be raised: rows beyond a lowered count are not
+// migrated.
+package main
+
+import (
+	"fmt"
+
+	"github.com/square/metrics/main/common"
+	"github.com/square/metrics/metric_metadata/cassandra"
+)
+
+func main() {
+	config := struct {
+		Cassandra cassandra.Config `yaml:"cassandra"`
+	}{}
+
+	common.LoadConfig(&config)
+
+	if config.Cassandra.MetricNameShards <= 1 {
+		common.ExitWithErrorMessage("metric_name_shards must be greater than 1 to migrate the metric names")
+		return
+	}
+
+	cassandraAPI, err := cassandra.NewMetricMetadataAPI(config.Cassandra)
+	if err != nil {
+		common.ExitWithErrorMessage("Error loading Cassandra API: %s", err.Error())
+		return
+	}
+
+	moved, err := cassandraAPI.MigrateMetricNameShards()
+	if err != nil {
+		common.ExitWithErrorMessage("Error migrating metric names after moving %d: %s", moved, err.Error())
+		return
+	}
+	fmt.Printf("Moved %d metric names into %d shards\n", moved, config.Cassandra.MetricNameShards)
+}
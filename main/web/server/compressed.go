@@ -0,0 +1,97 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/query/command"
+	"github.com/square/metrics/util/compress"
+)
+
+// CompressedMediaType is the media type a client lists in its Accept header
+// to receive series values compressed with util/compress instead of as JSON
+// arrays. The rest of the response is unchanged.
+const CompressedMediaType = "application/vnd.metrics.compressed+json"
+
+// CompressedTimeseries is the wire form of an api.Timeseries whose values are
+// compressed. Values is encoded in base64 by encoding/json.
+type CompressedTimeseries struct {
+	TagSet api.TagSet `json:"tagset"`
+	Length int        `json:"length"` // Length is the number of compressed values.
+	Values []byte     `json:"values"`
+}
+
+// compressedQueryResult replaces the series of a QueryResult with their compressed form.
+type compressedQueryResult struct {
+	command.QueryResult
+	Series []CompressedTimeseries `json:"series"`
+}
+
+// NewCompressedTimeseries compresses the values of the timeseries.
+func NewCompressedTimeseries(series api.Timeseries) CompressedTimeseries {
+	return CompressedTimeseries{
+		TagSet: series.TagSet,
+		Length: len(series.Values),
+		Values: compress.CompressFloats(series.Values),
+	}
+}
+
+// Timeseries decompresses the values of the timeseries.
+func (c CompressedTimeseries) Timeseries() api.Timeseries {
+	return api.Timeseries{
+		TagSet: c.TagSet,
+		Values: compress.DecompressFloats(c.Values, c.Length),
+	}
+}
+
+// acceptsCompressed returns whether the request's Accept header lists CompressedMediaType.
+func acceptsCompressed(request *http.Request) bool {
+	for _, accepted := range strings.Split(request.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == CompressedMediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// compressBody compresses the series of each "series" result in the body.
+// Other bodies are returned as they are.
+func compressBody(body interface{}) interface{} {
+	results, ok := body.([]command.QueryResult)
+	if !ok {
+		return body
+	}
+	compressed := make([]interface{}, len(results))
+	for i, result := range results {
+		if result.Type != "series" {
+			compressed[i] = result
+			continue
+		}
+		series := make([]CompressedTimeseries, len(result.Series))
+		for j := range result.Series {
+			series[j] = NewCompressedTimeseries(result.Series[j])
+		}
+		compressed[i] = compressedQueryResult{
+			QueryResult: result,
+			Series:      series,
+		}
+	}
+	return compressed
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/query/command"
+	"github.com/square/metrics/testing_support/assert"
+)
+
+func TestAcceptsCompressed(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{CompressedMediaType, true},
+		{"application/json, " + CompressedMediaType + "; q=0.9", true},
+	}
+	for _, test := range tests {
+		request, err := http.NewRequest("GET", "/query", nil)
+		if err != nil {
+			t.Fatalf("Unexpected error creating request: %s", err.Error())
+		}
+		request.Header.Set("Accept", test.accept)
+		if actual := acceptsCompressed(request); actual != test.expected {
+			t.Errorf("Accept %q: expected %t but got %t", test.accept, test.expected, actual)
+		}
+	}
+}
+
+func TestCompressBody(t *testing.T) {
+	a := assert.New(t)
+	series := []api.Timeseries{
+		{Values: []float64{1, 2, math.NaN(), -4}, TagSet: api.TagSet{"host": "a"}},
+		{Values: []float64{}, TagSet: api.TagSet{"host": "b"}},
+	}
+	body := compressBody([]command.QueryResult{
+		{Query: "cpu", Name: "cpu", Type: "series", Series: series},
+		{Query: "1", Name: "1", Type: "scalars"},
+	})
+
+	encoded, err := json.Marshal(body)
+	a.CheckError(err)
+	decoded := []struct {
+		Type   string                 `json:"type"`
+		Query  string                 `json:"query"`
+		Series []CompressedTimeseries `json:"series"`
+	}{}
+	a.CheckError(json.Unmarshal(encoded, &decoded))
+	a.MustEqInt(len(decoded), 2)
+	a.EqString(decoded[0].Query, "cpu")
+	a.MustEqInt(len(decoded[0].Series), 2)
+	for i := range series {
+		actual := decoded[0].Series[i].Timeseries()
+		a.EqFloatArray(actual.Values, series[i].Values, 1e-9)
+		a.Eq(actual.TagSet, series[i].TagSet)
+	}
+	a.EqInt(len(decoded[1].Series), 0)
+
+	// Other bodies are left alone.
+	a.Eq(compressBody("a string"), "a string")
+}
@@ -17,11 +17,13 @@ package server
 import "github.com/square/metrics/inspect"
 
 type Config struct {
-	Port          int    `yaml:"port"`
-	Timeout       int    `yaml:"timeout"`
-	StaticDir     string `yaml:"static_dir"`
-	JSONIngestion bool   `yaml:"json_ingestion"`
-	HTTPIngestion bool   `yaml:"enable_http_ingestion"`
+	Port          int      `yaml:"port"`
+	Timeout       int      `yaml:"timeout"`
+	StaticDir     string   `yaml:"static_dir"`
+	JSONIngestion bool     `yaml:"json_ingestion"`
+	HTTPIngestion bool     `yaml:"enable_http_ingestion"`
+	TenantHeader  string   `yaml:"tenant_header"` // if set, the tenant of each query is taken from this request header
+	DeleteTokens  []string `yaml:"delete_tokens"` // if set, /delete accepts requests bearing any of these tokens
 }
 
 type Hook struct {
@@ -0,0 +1,104 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/metric_metadata"
+)
+
+// deleteHandler removes metrics (or single tagsets of them) from the index.
+// Requests must carry one of the configured tokens as a bearer token.
+type deleteHandler struct {
+	metricMetadataAPI metadata.MetricDeleteAPI
+	tokens            []string
+}
+
+// DeleteRequest names a metric to remove. When Tags is omitted, the metric and
+// all of its tagsets are removed; otherwise only the given tagset is.
+type DeleteRequest struct {
+	Name string            `json:"name"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// authorized checks the request's bearer token against the configured tokens.
+func (h deleteHandler) authorized(request *http.Request) bool {
+	header := request.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(header, "Bearer "))
+	for _, accepted := range h.tokens {
+		if accepted != "" && subtle.ConstantTimeCompare(token, []byte(accepted)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (h deleteHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	if !h.authorized(request) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.Write(encodeError(fmt.Errorf("delete endpoint requires a valid bearer token")))
+		return
+	}
+	if request.Method != "POST" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		writer.Write(encodeError(fmt.Errorf("delete endpoint expects a POST request")))
+		return
+	}
+	if request.Header.Get("Content-Type") != "application/json" {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write(encodeError(fmt.Errorf("delete endpoint expects Content-Type: application/json")))
+		return
+	}
+	metrics := []DeleteRequest{}
+	if err := json.NewDecoder(request.Body).Decode(&metrics); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write(encodeError(err))
+		return
+	}
+	for _, metric := range metrics {
+		if metric.Name == "" {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write(encodeError(fmt.Errorf("every metric to delete needs a name")))
+			return
+		}
+	}
+	for _, metric := range metrics {
+		var err error
+		if metric.Tags == nil {
+			err = h.metricMetadataAPI.RemoveMetricKey(api.MetricKey(metric.Name), metadata.Context{})
+		} else {
+			err = h.metricMetadataAPI.RemoveMetric(api.TaggedMetric{
+				MetricKey: api.MetricKey(metric.Name),
+				TagSet:    metric.Tags,
+			}, metadata.Context{})
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			writer.Write(encodeError(err))
+			return
+		}
+	}
+	writer.Write([]byte(`{"success": true}`))
+}
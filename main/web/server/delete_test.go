@@ -0,0 +1,89 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/testing_support/assert"
+)
+
+// recordingDeleteAPI records the metrics removed from it.
+type recordingDeleteAPI struct {
+	removed    []api.TaggedMetric
+	removedKey []api.MetricKey
+}
+
+func (r *recordingDeleteAPI) RemoveMetric(metric api.TaggedMetric, context metadata.Context) error {
+	r.removed = append(r.removed, metric)
+	return nil
+}
+
+func (r *recordingDeleteAPI) RemoveMetricKey(metricKey api.MetricKey, context metadata.Context) error {
+	r.removedKey = append(r.removedKey, metricKey)
+	return nil
+}
+
+func (r *recordingDeleteAPI) CheckHealthy() error {
+	return nil
+}
+
+func postDelete(handler deleteHandler, token string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", "/delete", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestDelete(t *testing.T) {
+	a := assert.New(t)
+	deleteAPI := &recordingDeleteAPI{}
+	handler := deleteHandler{metricMetadataAPI: deleteAPI, tokens: []string{"secret"}}
+
+	recorder := postDelete(handler, "secret", `[
+		{"name": "cpu", "tags": {"host": "a"}},
+		{"name": "memory"},
+		{"name": "disk", "tags": {}}
+	]`)
+	a.EqInt(recorder.Code, http.StatusOK)
+	a.Eq(deleteAPI.removed, []api.TaggedMetric{
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+		{MetricKey: "disk", TagSet: api.TagSet{}},
+	})
+	a.Eq(deleteAPI.removedKey, []api.MetricKey{"memory"})
+}
+
+func TestDeleteRequiresToken(t *testing.T) {
+	a := assert.New(t)
+	deleteAPI := &recordingDeleteAPI{}
+	handler := deleteHandler{metricMetadataAPI: deleteAPI, tokens: []string{"secret"}}
+
+	for _, token := range []string{"", "wrong", "secretsecret"} {
+		recorder := postDelete(handler, token, `[{"name": "cpu"}]`)
+		a.Contextf("token %q", token).EqInt(recorder.Code, http.StatusUnauthorized)
+	}
+	recorder := postDelete(handler, "secret", `[{"tags": {"host": "a"}}]`)
+	a.EqInt(recorder.Code, http.StatusBadRequest)
+	a.EqInt(len(deleteAPI.removed)+len(deleteAPI.removedKey), 0)
+}
@@ -18,19 +18,28 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/square/metrics/api"
 	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/timeseries"
 )
 
-// tokenHandler exposes all the tokens available in the system for the autocomplete.
+// ingestHandler records metrics (and optionally their datapoints) sent by producers.
 type ingestHandler struct {
 	metricMetadataAPI metadata.MetricUpdateAPI
+	storageUpdateAPI  timeseries.StorageUpdateAPI // storageUpdateAPI may be nil, in which case points are rejected.
 }
 
 type IngestRequest struct {
-	Name string            `json:"name"`
-	Tags map[string]string `json:"tags"`
+	Name   string            `json:"name"`
+	Tags   map[string]string `json:"tags"`
+	Points []IngestPoint     `json:"points,omitempty"` // Points are written to timeseries storage.
+}
+
+type IngestPoint struct {
+	Timestamp int64   `json:"timestamp"` // milliseconds since the epoch
+	Value     float64 `json:"value"`
 }
 
 func (h ingestHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -46,18 +55,48 @@ func (h ingestHandler) ServeHTTP(writer http.ResponseWriter, request *http.Reque
 		writer.Write(encodeError(err))
 		return
 	}
-	taggedMetrics := []api.TaggedMetric{}
+	taggedMetrics := make([]api.TaggedMetric, len(metrics))
+	datapoints := []timeseries.Datapoint{}
 	for i := range metrics {
 		taggedMetrics[i] = api.TaggedMetric{
 			MetricKey: api.MetricKey(metrics[i].Name),
 			TagSet:    metrics[i].Tags,
 		}
+		for _, point := range metrics[i].Points {
+			datapoints = append(datapoints, timeseries.Datapoint{
+				Metric:    taggedMetrics[i],
+				Timestamp: time.Unix(0, point.Timestamp*1e6),
+				Value:     point.Value,
+			})
+		}
+	}
+	if len(datapoints) != 0 && h.storageUpdateAPI == nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write(encodeError(fmt.Errorf("the timeseries storage API does not accept points")))
+		return
 	}
+	// Metrics are registered before their points are written, so that every
+	// written point can be found by a query.
 	err := h.metricMetadataAPI.AddMetrics(taggedMetrics, metadata.Context{})
 	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
 		writer.Write(encodeError(err))
 		return
 	}
+	if len(datapoints) != 0 {
+		err := h.storageUpdateAPI.WritePoints(timeseries.WriteRequest{
+			Datapoints: datapoints,
+			Ctx:        request.Context(),
+		})
+		if err != nil {
+			if errHTTP, ok := err.(HTTPError); ok {
+				writer.WriteHeader(errHTTP.ErrorCode())
+			} else {
+				writer.WriteHeader(http.StatusBadRequest)
+			}
+			writer.Write(encodeError(err))
+			return
+		}
+	}
 	writer.Write([]byte(`{"success": true}`))
 }
@@ -0,0 +1,103 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/timeseries/memory"
+)
+
+// recordingUpdateAPI records the metrics added to it.
+type recordingUpdateAPI struct {
+	added []api.TaggedMetric
+}
+
+func (r *recordingUpdateAPI) AddMetric(metric api.TaggedMetric, context metadata.Context) error {
+	return r.AddMetrics([]api.TaggedMetric{metric}, context)
+}
+
+func (r *recordingUpdateAPI) AddMetrics(metrics []api.TaggedMetric, context metadata.Context) error {
+	r.added = append(r.added, metrics...)
+	return nil
+}
+
+func (r *recordingUpdateAPI) CheckHealthy() error {
+	return nil
+}
+
+func postIngest(handler ingestHandler, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", "/ingest", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestIngest(t *testing.T) {
+	a := assert.New(t)
+	updateAPI := &recordingUpdateAPI{}
+	storage := memory.NewStorage(memory.Config{Resolutions: []time.Duration{30 * time.Second}})
+	handler := ingestHandler{
+		metricMetadataAPI: updateAPI,
+		storageUpdateAPI:  storage,
+	}
+	recorder := postIngest(handler, `[
+		{"name": "cpu", "tags": {"host": "a"}, "points": [{"timestamp": 0, "value": 1}, {"timestamp": 30000, "value": 2}]},
+		{"name": "memory", "tags": {"host": "a"}}
+	]`)
+	a.EqInt(recorder.Code, http.StatusOK)
+	a.Eq(updateAPI.added, []api.TaggedMetric{
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+		{MetricKey: "memory", TagSet: api.TagSet{"host": "a"}},
+	})
+
+	timerange, err := api.NewTimerange(0, 30000, 30000)
+	a.CheckError(err)
+	series, err := storage.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	a.CheckError(err)
+	a.EqFloatArray(series.Values, []float64{1, 2}, 1e-9)
+}
+
+func TestIngestPointsWithoutStorage(t *testing.T) {
+	a := assert.New(t)
+	updateAPI := &recordingUpdateAPI{}
+	handler := ingestHandler{metricMetadataAPI: updateAPI}
+
+	recorder := postIngest(handler, `[{"name": "cpu", "tags": {}, "points": [{"timestamp": 0, "value": 1}]}]`)
+	a.EqInt(recorder.Code, http.StatusBadRequest)
+	a.EqInt(len(updateAPI.added), 0)
+
+	// Metrics without points are still accepted.
+	recorder = postIngest(handler, `[{"name": "cpu", "tags": {}}]`)
+	a.EqInt(recorder.Code, http.StatusOK)
+	a.EqInt(len(updateAPI.added), 1)
+}
@@ -21,6 +21,7 @@ import (
 	"regexp"
 	"strconv"
 
+	"github.com/square/metrics/function"
 	"github.com/square/metrics/inspect"
 	"github.com/square/metrics/log"
 	"github.com/square/metrics/query/command"
@@ -42,8 +43,9 @@ type QueryResponse struct {
 }
 
 type queryHandler struct {
-	hook    Hook
-	context command.ExecutionContext
+	hook         Hook
+	context      command.ExecutionContext
+	tenantHeader string // the request header holding the tenant to query (optional)
 }
 
 type KeyIs struct {
@@ -173,7 +175,9 @@ func predicateFromConstraint(c Constraint) (predicate.Predicate, error) {
 type QueryForm struct {
 	Input       string      `query:"query" json:"query"`     // query to execute.
 	Profile     bool        `query:"profile" json:"profile"` // if true, then profile information will be exposed to the user.
+	Partial     string      `query:"partial" json:"partial"` // "nan" or "omit" to return partial results when some series fail to be fetched.
 	Constraints *Constraint `query:"-" json:"where"`
+	Tenant      string      `query:"-" json:"-"` // the tenant to query, taken from the request's headers.
 }
 
 func (q queryHandler) process(profiler *inspect.Profiler, parsedForm QueryForm) (QueryResponse, error) {
@@ -197,6 +201,18 @@ func (q queryHandler) process(profiler *inspect.Profiler, parsedForm QueryForm)
 		context.AdditionalConstraints = predicate // Attach the predicate to the context.
 	}
 
+	if parsedForm.Partial != "" {
+		partial, err := function.ParsePartialResults(parsedForm.Partial)
+		if err != nil {
+			return QueryResponse{}, err
+		}
+		context.PartialResults = partial
+	}
+
+	if parsedForm.Tenant != "" {
+		context.Tenant = parsedForm.Tenant
+	}
+
 	profiledCommand := command.NewProfilingCommandWithProfiler(rawCommand, profiler)
 
 	result := command.Result{}
@@ -223,6 +239,7 @@ type HTTPError interface {
 
 func (q queryHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Vary", "Accept")
 	profiler := inspect.New()
 
 	queryForm := QueryForm{}
@@ -242,6 +259,10 @@ func (q queryHandler) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 		parseStruct(request.Form, &queryForm)
 	}
 
+	if q.tenantHeader != "" {
+		queryForm.Tenant = request.Header.Get(q.tenantHeader)
+	}
+
 	// "process" does the hard work for the handler, but doesn't touch the HTTP details.
 	responseMessage, err := q.process(profiler, queryForm)
 	if err != nil {
@@ -257,6 +278,12 @@ func (q queryHandler) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 		return
 	}
 
+	if acceptsCompressed(request) {
+		// The client understands compressed series values.
+		writer.Header().Set("Content-Type", CompressedMediaType)
+		responseMessage.Body = compressBody(responseMessage.Body)
+	}
+
 	responseJSON := Response{
 		Success:       true,
 		QueryResponse: responseMessage,
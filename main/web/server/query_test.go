@@ -15,11 +15,20 @@
 package server
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"regexp"
+	"sync"
 	"testing"
 
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/query/command"
 	"github.com/square/metrics/query/predicate"
 	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+	"github.com/square/metrics/timeseries"
 )
 
 func TestPredicateFromConstraint(t *testing.T) {
@@ -202,3 +211,49 @@ func TestPredicateFromConstraint(t *testing.T) {
 		a.Contextf("test %d", i).Eq(result, test.result)
 	}
 }
+
+// tenantStorage records the tenants that series are fetched for.
+type tenantStorage struct {
+	mocks.FakeComboAPI
+
+	mutex   sync.Mutex
+	tenants []string
+}
+
+func (s *tenantStorage) FetchMultipleTimeseries(request timeseries.FetchMultipleRequest) (api.SeriesList, error) {
+	s.mutex.Lock()
+	s.tenants = append(s.tenants, request.Tenant)
+	s.mutex.Unlock()
+	return s.FakeComboAPI.FetchMultipleTimeseries(request)
+}
+
+func TestQueryTenantHeader(t *testing.T) {
+	a := assert.New(t)
+	timerange, err := api.NewTimerange(0, 120, 30)
+	a.CheckError(err)
+	comboAPI := mocks.NewComboAPI(timerange,
+		api.Timeseries{Values: []float64{1, 2, 3, 4, 5}, TagSet: api.TagSet{"metric": "cpu", "host": "a"}},
+	)
+	storage := &tenantStorage{FakeComboAPI: comboAPI}
+	handler := queryHandler{
+		context: command.ExecutionContext{
+			TimeseriesStorageAPI: storage,
+			MetricMetadataAPI:    comboAPI,
+			FetchLimit:           10,
+			Ctx:                  context.Background(),
+		},
+		tenantHeader: "X-Tenant",
+	}
+	query := "/query?query=" + url.QueryEscape("select cpu from 0 to 120 resolution 30ms")
+
+	for _, tenant := range []string{"payments", ""} {
+		request := httptest.NewRequest("GET", query, nil)
+		if tenant != "" {
+			request.Header.Set("X-Tenant", tenant)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		a.Contextf("tenant %q: %s", tenant, recorder.Body.String()).EqInt(recorder.Code, http.StatusOK)
+	}
+	a.Eq(storage.tenants, []string{"payments", ""})
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/square/metrics/metric_metadata"
 	"github.com/square/metrics/query/command"
+	"github.com/square/metrics/timeseries"
 )
 
 func NewMux(config Config, context command.ExecutionContext, hook Hook) (*http.ServeMux, error) {
@@ -31,21 +32,35 @@ func NewMux(config Config, context command.ExecutionContext, hook Hook) (*http.S
 	httpMux.Handle("/ui", singleStaticHandler{config.StaticDir, "index.html"})
 	httpMux.Handle("/embed", singleStaticHandler{config.StaticDir, "embed.html"})
 	httpMux.Handle("/query", queryHandler{
-		context: context,
-		hook:    hook,
+		context:      context,
+		hook:         hook,
+		tenantHeader: config.TenantHeader,
 	})
 	httpMux.Handle("/token", tokenHandler{
 		context: context,
 	})
 	if config.HTTPIngestion {
 		if updateAPI, ok := context.MetricMetadataAPI.(metadata.MetricUpdateAPI); ok {
+			// Points are only accepted when the storage API can write them.
+			storageUpdateAPI, _ := context.TimeseriesStorageAPI.(timeseries.StorageUpdateAPI)
 			httpMux.Handle("/ingest", ingestHandler{
 				metricMetadataAPI: updateAPI,
+				storageUpdateAPI:  storageUpdateAPI,
 			})
 		} else {
 			return nil, fmt.Errorf("HTTP Ingestion is on, but the metadata API does not implement updates")
 		}
 	}
+	if len(config.DeleteTokens) != 0 {
+		if deleteAPI, ok := context.MetricMetadataAPI.(metadata.MetricDeleteAPI); ok {
+			httpMux.Handle("/delete", deleteHandler{
+				metricMetadataAPI: deleteAPI,
+				tokens:            config.DeleteTokens,
+			})
+		} else {
+			return nil, fmt.Errorf("Delete tokens are configured, but the metadata API does not implement deletion")
+		}
+	}
 	httpMux.Handle(
 		"/static/",
 		http.StripPrefix(
@@ -31,8 +31,16 @@ import (
 	"github.com/square/metrics/metric_metadata"
 	"github.com/square/metrics/metric_metadata/cached"
 	"github.com/square/metrics/metric_metadata/cassandra"
+	"github.com/square/metrics/metric_metadata/disk"
+	"github.com/square/metrics/metric_metadata/memory"
 	"github.com/square/metrics/query/command"
+	"github.com/square/metrics/timeseries"
 	"github.com/square/metrics/timeseries/blueflood"
+	"github.com/square/metrics/timeseries/cache"
+	"github.com/square/metrics/timeseries/federated"
+	"github.com/square/metrics/timeseries/graphite"
+	memorystorage "github.com/square/metrics/timeseries/memory"
+	"github.com/square/metrics/timeseries/prometheus"
 	"github.com/square/metrics/util"
 )
 
@@ -69,14 +77,60 @@ func main() {
 		Cassandra           cassandra.Config `yaml:"cassandra"`
 		Blueflood           blueflood.Config `yaml:"blueflood"`
 		Web                 server.Config    `yaml:"web"`
+
+		// Optional in-memory or file-backed metadata stores, used instead of Cassandra.
+		MemoryMetadata *memory.Config `yaml:"memory_metadata"`
+		DiskMetadata   *disk.Config   `yaml:"disk_metadata"`
+
+		// Optional in-memory timeseries store, used instead of Blueflood. Federation
+		// rules then refer to it as the "memory" backend.
+		MemoryStorage *memorystorage.Config `yaml:"memory_storage"`
+
+		// Optional additional storage backends, routed between by the federation rules.
+		Graphite   *graphite.Config   `yaml:"graphite"`
+		Prometheus *prometheus.Config `yaml:"prometheus"`
+		Federation *federated.Config  `yaml:"federation"`
+
+		// Optional read-through cache in front of the storage backends.
+		FetchCache *cache.Config `yaml:"fetch_cache"`
+
+		// Optional settings for the cache in front of the metadata API.
+		MetadataCache *cached.Config `yaml:"metadata_cache"`
 	}{}
 
 	common.LoadConfig(&config)
 
-	metadataAPI, err := cassandra.NewMetricMetadataAPI(config.Cassandra)
-	if err != nil {
-		common.ExitWithErrorMessage("Error loading Cassandra API: %s", err.Error())
-		return
+	var metadataAPI metadata.MetricAPI
+	if config.MemoryMetadata != nil {
+		memoryAPI, err := memory.NewMetricMetadataAPI(*config.MemoryMetadata)
+		if err != nil {
+			common.ExitWithErrorMessage("Error loading in-memory metadata API: %s", err.Error())
+			return
+		}
+		if config.MemoryMetadata.SnapshotPath != "" {
+			go memoryAPI.SnapshotPeriodically()
+		}
+		if config.MemoryMetadata.TagSetTTL != 0 {
+			go memoryAPI.SweepPeriodically()
+		}
+		metadataAPI = memoryAPI
+	} else if config.DiskMetadata != nil {
+		diskAPI, err := disk.NewMetricMetadataAPI(*config.DiskMetadata)
+		if err != nil {
+			common.ExitWithErrorMessage("Error loading file-backed metadata API: %s", err.Error())
+			return
+		}
+		if config.DiskMetadata.TagSetTTL != 0 {
+			go diskAPI.SweepPeriodically()
+		}
+		metadataAPI = diskAPI
+	} else {
+		cassandraAPI, err := cassandra.NewMetricMetadataAPI(config.Cassandra)
+		if err != nil {
+			common.ExitWithErrorMessage("Error loading Cassandra API: %s", err.Error())
+			return
+		}
+		metadataAPI = cassandraAPI
 	}
 
 	ruleset, err := util.LoadRules(config.ConversionRulesPath)
@@ -87,12 +141,57 @@ func main() {
 
 	config.Blueflood.GraphiteMetricConverter = &util.RuleBasedGraphiteConverter{Ruleset: ruleset}
 
-	blueflood := blueflood.NewBlueflood(config.Blueflood)
+	var storageAPI timeseries.StorageAPI
+	primaryBackend := "blueflood"
+	if config.MemoryStorage != nil {
+		storageAPI = memorystorage.NewStorage(*config.MemoryStorage)
+		primaryBackend = "memory"
+	} else {
+		storageAPI = blueflood.NewBlueflood(config.Blueflood)
+	}
 
-	optimizedMetadataAPI := cached.NewMetricMetadataAPI(metadataAPI, cached.Config{
-		TimeToLive:   time.Minute * 5, // Cache items invalidated after 5 minutes.
-		RequestLimit: 500,
-	})
+	if config.Federation != nil {
+		backends := map[string]timeseries.StorageAPI{primaryBackend: storageAPI}
+		if config.Graphite != nil {
+			config.Graphite.GraphiteMetricConverter = config.Blueflood.GraphiteMetricConverter
+			backends["graphite"] = graphite.NewGraphite(*config.Graphite)
+		}
+		if config.Prometheus != nil {
+			backends["prometheus"] = prometheus.NewPrometheus(*config.Prometheus)
+		}
+		storageAPI, err = federated.NewFederated(backends, *config.Federation)
+		if err != nil {
+			common.ExitWithErrorMessage("Error loading storage federation: %s", err.Error())
+			return
+		}
+	}
+
+	if config.FetchCache != nil {
+		// Blueflood's rollups are missing until FirstAvailable, so slots newer
+		// than that mustn't be cached.
+		config.FetchCache.ResolutionWindows = map[time.Duration]time.Duration{}
+		if config.MemoryStorage == nil {
+			for _, resolution := range config.Blueflood.Resolutions {
+				config.FetchCache.ResolutionWindows[resolution.Resolution] = resolution.FirstAvailable
+			}
+		}
+		storageAPI = cache.NewCache(storageAPI, *config.FetchCache)
+	}
+
+	metadataCacheConfig := cached.Config{}
+	if config.MetadataCache != nil {
+		metadataCacheConfig = *config.MetadataCache
+	}
+	if metadataCacheConfig.TimeToLive == 0 {
+		metadataCacheConfig.TimeToLive = time.Minute * 5 // Cache items invalidated after 5 minutes.
+	}
+	if metadataCacheConfig.RequestLimit == 0 {
+		metadataCacheConfig.RequestLimit = 500
+	}
+	optimizedMetadataAPI := cached.NewMetricMetadataAPI(metadataAPI, metadataCacheConfig)
+	if metadataCacheConfig.SnapshotPath != "" {
+		go optimizedMetadataAPI.SnapshotPeriodically()
+	}
 	for i := 0; i < 10; i++ {
 		// Start goroutines to update the metadata cache in the background.
 		go func() {
@@ -104,12 +203,21 @@ func main() {
 			}
 		}()
 	}
+	go func() {
+		// Periodically report how well the metadata cache is serving requests.
+		for range time.Tick(time.Minute * 5) {
+			for method, stats := range optimizedMetadataAPI.Stats() {
+				log.Infof("Metadata cache %s: %d hits, %d misses, %d errors", method, stats.Hits, stats.Misses, stats.Errors)
+			}
+		}
+	}()
 
 	err = startServer(config.Web, command.ExecutionContext{
 		MetricMetadataAPI:    optimizedMetadataAPI,
-		TimeseriesStorageAPI: blueflood,
+		TimeseriesStorageAPI: storageAPI,
 		FetchLimit:           1500,
 		SlotLimit:            5000,
+		PointLimit:           10000000,
 		Registry:             registry.Default(),
 		Ctx:                  context.Background(),
 	})
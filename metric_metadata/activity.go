@@ -0,0 +1,55 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"time"
+
+	"github.com/square/metrics/api"
+)
+
+// MetricActivityAPI is an optional extension of MetricAPI for backends which
+// record when each tagset was last added. Adding a metric again refreshes it.
+type MetricActivityAPI interface {
+	MetricAPI
+	// FilterActive returns those of the given tagsets of the metric which may
+	// have been active since the given time. Tagsets whose activity is unknown
+	// are kept.
+	FilterActive(metricKey api.MetricKey, tagSets []api.TagSet, since time.Time, context Context) ([]api.TagSet, error)
+}
+
+// MetricActiveUntilAPI is an optional extension of MetricActivityAPI for
+// backends which read the activity of every tagset of a metric at once, so
+// that callers such as the cache can hold on to it.
+type MetricActiveUntilAPI interface {
+	MetricActivityAPI
+	// GetActiveUntil returns the time until which each tagset of the metric
+	// is considered active, by serialized tagset. Tagsets whose activity is
+	// unknown are left out.
+	GetActiveUntil(metricKey api.MetricKey, context Context) (map[string]time.Time, error)
+}
+
+// FilterActiveUntil returns the tagsets which are active at the given time
+// according to the result of GetActiveUntil. Unknown tagsets are kept.
+func FilterActiveUntil(tagSets []api.TagSet, activeUntil map[string]time.Time, since time.Time) []api.TagSet {
+	result := []api.TagSet{}
+	for _, tagSet := range tagSets {
+		if until, ok := activeUntil[tagSet.Serialize()]; ok && until.Before(since) {
+			continue
+		}
+		result = append(result, tagSet)
+	}
+	return result
+}
@@ -16,12 +16,14 @@ package cached
 
 import (
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/square/metrics/api"
 	"github.com/square/metrics/log"
 	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/query/predicate"
 	"github.com/square/metrics/util"
 )
 
@@ -34,6 +36,12 @@ type BackgroundAPI interface {
 	CurrentLiveRequests() int
 	// MaximumLiveRequests returns the maximum number of requests that can be in the queue
 	MaximumLiveRequests() int
+	// Stats returns the hit and miss counts of each cached method.
+	Stats() map[string]Stats
+	// Snapshot saves the contents of the cache to the configured snapshot file.
+	Snapshot() error
+	// SnapshotPeriodically calls Snapshot every SnapshotInterval; it never returns.
+	SnapshotPeriodically()
 }
 
 // metricMetadataAPI caches some of the metadata associated with the API to reduce latency.
@@ -47,40 +55,265 @@ type metricMetadataAPI struct {
 	getAllTagsCache      map[api.MetricKey]*TagSetList // The cache of metric -> tags
 	getAllTagsCacheMutex sync.RWMutex                  // Mutex for getAllTagsCache
 
+	getActiveUntilCache      map[api.MetricKey]*ActivityList // The cache of metric -> activity of its tagsets
+	getActiveUntilCacheMutex sync.RWMutex                    // Mutex for getActiveUntilCache
+
+	getAllMetricsCache *MetricList // The cache of all metric keys, replaced on invalidation
+
+	getMetricsForTagCache      map[tagPair]*MetricList // The cache of tag pair -> metrics
+	getMetricsForTagCacheMutex sync.RWMutex            // Mutex for getAllMetricsCache and getMetricsForTagCache
+
+	stats      map[string]*Stats // Hit and miss counts for each method
+	statsMutex sync.Mutex        // Mutex for stats
+
 	// Cache Config
 	freshness  time.Duration // How long until cache entries become stale
 	timeToLive time.Duration // How long until cache entries become expired
 
+	// Snapshots
+	snapshotPath     string        // Where the cache is saved, if anywhere
+	snapshotInterval time.Duration // How often SnapshotPeriodically saves the cache
+
 	// Queue
 	backgroundQueue chan func(metadata.Context) error // A channel that holds background requests.
 	queueMutex      sync.Mutex                        // Synchronizing mutex for the queue
 }
 
+// metricMetadataAPI implements MetricMatchingAPI and MetricActivityAPI
+var _ metadata.MetricMatchingAPI = (*metricMetadataAPI)(nil)
+var _ metadata.MetricActivityAPI = (*metricMetadataAPI)(nil)
+
 // metricUpdateAPI is a wrapper for when the underlying metadata.MetricAPI is also a metadata.MetricUpdateAPI.
 type metricUpdateAPI struct {
-	metricMetadataAPI
+	*metricMetadataAPI
+}
+
+// metricDeleteAPI is a wrapper for when the underlying metadata.MetricAPI is also a metadata.MetricDeleteAPI.
+type metricDeleteAPI struct {
+	*metricMetadataAPI
+}
+
+// metricUpdateDeleteAPI is a wrapper for when the underlying metadata.MetricAPI is both a
+// metadata.MetricUpdateAPI and a metadata.MetricDeleteAPI.
+type metricUpdateDeleteAPI struct {
+	*metricMetadataAPI
+}
+
+// The wrappers implement MetricUpdateAPI and MetricDeleteAPI exactly when the underlying API does.
+var _ metadata.MetricUpdateAPI = (*metricUpdateAPI)(nil)
+var _ metadata.MetricDeleteAPI = (*metricDeleteAPI)(nil)
+var _ metadata.MetricUpdateAPI = (*metricUpdateDeleteAPI)(nil)
+var _ metadata.MetricDeleteAPI = (*metricUpdateDeleteAPI)(nil)
+
+// AddMetric adds the metric through the underlying API.
+func (c *metricUpdateAPI) AddMetric(metric api.TaggedMetric, context metadata.Context) error {
+	return c.addMetric(metric, context)
+}
+
+// AddMetrics adds the metrics through the underlying API.
+func (c *metricUpdateAPI) AddMetrics(metrics []api.TaggedMetric, context metadata.Context) error {
+	return c.addMetrics(metrics, context)
+}
+
+// RemoveMetric removes the tagset through the underlying API.
+func (c *metricDeleteAPI) RemoveMetric(metric api.TaggedMetric, context metadata.Context) error {
+	return c.removeMetric(metric, context)
+}
+
+// RemoveMetricKey removes the metric through the underlying API.
+func (c *metricDeleteAPI) RemoveMetricKey(metricKey api.MetricKey, context metadata.Context) error {
+	return c.removeMetricKey(metricKey, context)
+}
+
+// AddMetric adds the metric through the underlying API.
+func (c *metricUpdateDeleteAPI) AddMetric(metric api.TaggedMetric, context metadata.Context) error {
+	return c.addMetric(metric, context)
+}
+
+// AddMetrics adds the metrics through the underlying API.
+func (c *metricUpdateDeleteAPI) AddMetrics(metrics []api.TaggedMetric, context metadata.Context) error {
+	return c.addMetrics(metrics, context)
+}
+
+// RemoveMetric removes the tagset through the underlying API.
+func (c *metricUpdateDeleteAPI) RemoveMetric(metric api.TaggedMetric, context metadata.Context) error {
+	return c.removeMetric(metric, context)
+}
+
+// RemoveMetricKey removes the metric through the underlying API.
+func (c *metricUpdateDeleteAPI) RemoveMetricKey(metricKey api.MetricKey, context metadata.Context) error {
+	return c.removeMetricKey(metricKey, context)
 }
 
-func (c *metricMetadataAPI) AddMetric(metric api.TaggedMetric, context metadata.Context) error {
+// addMetric adds the metric through the underlying MetricUpdateAPI and
+// invalidates the cached entries which don't already include it.
+func (c *metricMetadataAPI) addMetric(metric api.TaggedMetric, context metadata.Context) error {
+	defer c.invalidateMissing([]api.TaggedMetric{metric})
 	return c.metricMetadataAPI.(metadata.MetricUpdateAPI).AddMetric(metric, context)
 }
 
-func (c *metricMetadataAPI) AddMetrics(metrics []api.TaggedMetric, context metadata.Context) error {
+// addMetrics adds the metrics through the underlying MetricUpdateAPI and
+// invalidates the cached entries which don't already include them.
+func (c *metricMetadataAPI) addMetrics(metrics []api.TaggedMetric, context metadata.Context) error {
+	defer c.invalidateMissing(metrics)
 	return c.metricMetadataAPI.(metadata.MetricUpdateAPI).AddMetrics(metrics, context)
 }
 
+// removeMetric removes the tagset through the underlying MetricDeleteAPI and
+// invalidates the cached entries which could mention it.
+func (c *metricMetadataAPI) removeMetric(metric api.TaggedMetric, context metadata.Context) error {
+	defer c.invalidateMetrics([]api.TaggedMetric{metric})
+	return c.metricMetadataAPI.(metadata.MetricDeleteAPI).RemoveMetric(metric, context)
+}
+
+// removeMetricKey removes the metric through the underlying MetricDeleteAPI
+// and invalidates the cached entries which could mention it.
+func (c *metricMetadataAPI) removeMetricKey(metricKey api.MetricKey, context metadata.Context) error {
+	defer c.invalidateMetricKey(metricKey)
+	return c.metricMetadataAPI.(metadata.MetricDeleteAPI).RemoveMetricKey(metricKey, context)
+}
+
+// invalidateMissing drops the cache entries which don't include the added
+// metrics. Producers add the same metrics again on a fixed interval, so
+// entries which already hold them are kept. Entries with a fetch in flight are
+// dropped, since the fetch may have started before the metrics were added.
+// Activity entries are kept while the added tagsets stay active in them until
+// they expire.
+func (c *metricMetadataAPI) invalidateMissing(metrics []api.TaggedMetric) {
+	type keyPair struct {
+		metricKey api.MetricKey
+		pair      tagPair
+	}
+	checkedKeys := map[api.MetricKey]bool{}
+	checkedPairs := map[keyPair]bool{}
+	for _, metric := range metrics {
+		c.getAllTagsCacheMutex.RLock()
+		tagSetList, ok := c.getAllTagsCache[metric.MetricKey]
+		c.getAllTagsCacheMutex.RUnlock()
+		if ok && !tagSetList.includes(metric.TagSet) {
+			c.getAllTagsCacheMutex.Lock()
+			if c.getAllTagsCache[metric.MetricKey] == tagSetList {
+				delete(c.getAllTagsCache, metric.MetricKey)
+			}
+			c.getAllTagsCacheMutex.Unlock()
+		}
+
+		c.getActiveUntilCacheMutex.RLock()
+		activityList, ok := c.getActiveUntilCache[metric.MetricKey]
+		c.getActiveUntilCacheMutex.RUnlock()
+		if ok && !activityList.keeps(metric.TagSet) {
+			c.getActiveUntilCacheMutex.Lock()
+			if c.getActiveUntilCache[metric.MetricKey] == activityList {
+				delete(c.getActiveUntilCache, metric.MetricKey)
+			}
+			c.getActiveUntilCacheMutex.Unlock()
+		}
+
+		if !checkedKeys[metric.MetricKey] {
+			checkedKeys[metric.MetricKey] = true
+			c.getMetricsForTagCacheMutex.RLock()
+			allMetrics := c.getAllMetricsCache
+			c.getMetricsForTagCacheMutex.RUnlock()
+			if allMetrics != nil && !allMetrics.includes(metric.MetricKey) {
+				c.getMetricsForTagCacheMutex.Lock()
+				if c.getAllMetricsCache == allMetrics {
+					c.getAllMetricsCache = nil
+				}
+				c.getMetricsForTagCacheMutex.Unlock()
+			}
+		}
+
+		for key, value := range metric.TagSet {
+			pair := tagPair{key, value}
+			if checkedPairs[keyPair{metric.MetricKey, pair}] {
+				continue
+			}
+			checkedPairs[keyPair{metric.MetricKey, pair}] = true
+			c.getMetricsForTagCacheMutex.RLock()
+			metricList, ok := c.getMetricsForTagCache[pair]
+			c.getMetricsForTagCacheMutex.RUnlock()
+			if ok && !metricList.includes(metric.MetricKey) {
+				c.getMetricsForTagCacheMutex.Lock()
+				if c.getMetricsForTagCache[pair] == metricList {
+					delete(c.getMetricsForTagCache, pair)
+				}
+				c.getMetricsForTagCacheMutex.Unlock()
+			}
+		}
+	}
+}
+
+// invalidateMetrics drops the cache entries which the given metrics could
+// change, so that the next lookup goes to the underlying API. Fetches already
+// in flight update the detached entries, which are no longer visible.
+func (c *metricMetadataAPI) invalidateMetrics(metrics []api.TaggedMetric) {
+	c.getAllTagsCacheMutex.Lock()
+	for _, metric := range metrics {
+		delete(c.getAllTagsCache, metric.MetricKey)
+	}
+	c.getAllTagsCacheMutex.Unlock()
+
+	c.getActiveUntilCacheMutex.Lock()
+	for _, metric := range metrics {
+		delete(c.getActiveUntilCache, metric.MetricKey)
+	}
+	c.getActiveUntilCacheMutex.Unlock()
+
+	c.getMetricsForTagCacheMutex.Lock()
+	defer c.getMetricsForTagCacheMutex.Unlock()
+	c.getAllMetricsCache = nil
+	for _, metric := range metrics {
+		for key, value := range metric.TagSet {
+			delete(c.getMetricsForTagCache, tagPair{key, value})
+		}
+	}
+}
+
+// invalidateMetricKey drops the cache entries which could mention the metric.
+// The tags of its removed tagsets are unknown, so every GetMetricsForTag entry
+// is dropped.
+func (c *metricMetadataAPI) invalidateMetricKey(metricKey api.MetricKey) {
+	c.getAllTagsCacheMutex.Lock()
+	delete(c.getAllTagsCache, metricKey)
+	c.getAllTagsCacheMutex.Unlock()
+
+	c.getActiveUntilCacheMutex.Lock()
+	delete(c.getActiveUntilCache, metricKey)
+	c.getActiveUntilCacheMutex.Unlock()
+
+	c.getMetricsForTagCacheMutex.Lock()
+	defer c.getMetricsForTagCacheMutex.Unlock()
+	c.getAllMetricsCache = nil
+	c.getMetricsForTagCache = map[tagPair]*MetricList{}
+}
+
 // Config stores data needed to instantiate a CachedMetricMetadataAPI.
 type Config struct {
-	Freshness    time.Duration
-	RequestLimit int
-	TimeToLive   time.Duration
+	Freshness    time.Duration `yaml:"freshness"`
+	RequestLimit int           `yaml:"request_limit"`
+	TimeToLive   time.Duration `yaml:"time_to_live"`
+
+	// SnapshotPath is the file that the cache is loaded from on startup and
+	// saved to by Snapshot (optional).
+	SnapshotPath string `yaml:"snapshot_path"`
+	// SnapshotInterval is how often SnapshotPeriodically saves the cache (default 1m).
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+
+	Clock util.Clock `yaml:"-"`
 }
 
-// TagSetList is an item in the cache.
-type TagSetList struct {
-	TagSets []api.TagSet // The tagsets for this metric
-	Expiry  time.Time    // The time at which the cache entry expires
-	Stale   time.Time    // The time at which the cache entry becomes stale
+// Stats counts how the calls to one method of the cache were served.
+type Stats struct {
+	Hits   int64 // Calls served from the cache, including stale entries
+	Misses int64 // Calls which waited for the underlying API
+	Errors int64 // Misses for which the underlying API returned an error
+}
+
+// cacheEntry holds the freshness of an item in the cache and the state of
+// its fetches.
+type cacheEntry struct {
+	Expiry time.Time // The time at which the cache entry expires
+	Stale  time.Time // The time at which the cache entry becomes stale
 
 	sync.Mutex // Synchronizing mutex
 
@@ -91,31 +324,175 @@ type TagSetList struct {
 	fetchError error // Fetch error from the last attempt
 }
 
+// cachedCall is a call to the underlying API whose result is held in a cache entry.
+type cachedCall struct {
+	method      string // The name of the MetricAPI method, for profiles and stats
+	description string // The arguments of the call, for logs
+
+	// fetch queries the underlying API without holding the lock for the entry.
+	// The returned function stores the result, and requires the lock.
+	fetch func(metadata.Context) (func(), error)
+}
+
+// TagSetList is an item in the cache.
+type TagSetList struct {
+	TagSets []api.TagSet // The tagsets for this metric
+	cacheEntry
+
+	postings   map[tagPair][]int   // Indices into TagSets for each tag pair, built on demand
+	serialized map[string]struct{} // The serialized TagSets, built on demand
+}
+
+// includes returns whether the list holds a fetched result which contains the
+// tagset, and no fetch is in flight.
+func (item *TagSetList) includes(tagSet api.TagSet) bool {
+	item.Lock()
+	defer item.Unlock()
+	if item.Expiry.IsZero() || item.inflight {
+		return false
+	}
+	if item.serialized == nil {
+		item.serialized = make(map[string]struct{}, len(item.TagSets))
+		for _, cached := range item.TagSets {
+			item.serialized[cached.Serialize()] = struct{}{}
+		}
+	}
+	_, ok := item.serialized[tagSet.Serialize()]
+	return ok
+}
+
+// ActivityList is an item in the cache for FilterActive.
+type ActivityList struct {
+	ActiveUntil map[string]time.Time // The result of GetActiveUntil for this metric
+	cacheEntry
+}
+
+// keeps returns whether the list holds a fetched result in which the tagset
+// stays active until the entry expires, and no fetch is in flight. Adding
+// the tagset again can't change what such a list filters.
+func (item *ActivityList) keeps(tagSet api.TagSet) bool {
+	item.Lock()
+	defer item.Unlock()
+	if item.Expiry.IsZero() || item.inflight {
+		return false
+	}
+	until, ok := item.ActiveUntil[tagSet.Serialize()]
+	return !ok || !until.Before(item.Expiry)
+}
+
+// MetricList is an item in the cache for GetAllMetrics or GetMetricsForTag.
+type MetricList struct {
+	Metrics []api.MetricKey // The metric keys returned by the call
+	cacheEntry
+
+	members map[api.MetricKey]struct{} // The Metrics, built on demand
+}
+
+// includes returns whether the list holds a fetched result which contains the
+// metric key, and no fetch is in flight.
+func (item *MetricList) includes(metricKey api.MetricKey) bool {
+	item.Lock()
+	defer item.Unlock()
+	if item.Expiry.IsZero() || item.inflight {
+		return false
+	}
+	if item.members == nil {
+		item.members = make(map[api.MetricKey]struct{}, len(item.Metrics))
+		for _, cached := range item.Metrics {
+			item.members[cached] = struct{}{}
+		}
+	}
+	_, ok := item.members[metricKey]
+	return ok
+}
+
+// tagPair is a single tag key and value.
+type tagPair struct {
+	key   string
+	value string
+}
+
+// buildPostings indexes the positions of each tag pair in the list's tagsets.
+// Requires the caller hold the lock for the item.
+func (item *TagSetList) buildPostings() {
+	item.postings = map[tagPair][]int{}
+	for i, tagSet := range item.TagSets {
+		for key, value := range tagSet {
+			pair := tagPair{key, value}
+			item.postings[pair] = append(item.postings[pair], i)
+		}
+	}
+}
+
+// candidates returns the ascending indices of the tagsets satisfying the
+// matcher. Requires the caller hold the lock for the item.
+func (item *TagSetList) candidates(matcher predicate.ListMatcher) []int {
+	if len(matcher.Values) == 1 {
+		return item.postings[tagPair{matcher.Tag, matcher.Values[0]}]
+	}
+	result := []int{}
+	seen := map[string]bool{}
+	for _, value := range matcher.Values {
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		result = append(result, item.postings[tagPair{matcher.Tag, value}]...)
+	}
+	sort.Ints(result)
+	return result
+}
+
 // NewMetricMetadataAPI creates a cached API given configuration and an underlying API object.
 func NewMetricMetadataAPI(apiInstance metadata.MetricAPI, config Config) BackgroundAPI {
 	requests := make(chan func(metadata.Context) error, config.RequestLimit)
 	if config.Freshness == 0 {
 		config.Freshness = config.TimeToLive
 	}
-	result := metricMetadataAPI{
-		metricMetadataAPI: apiInstance,
-		clock:             util.RealClock{},
-		getAllTagsCache:   map[api.MetricKey]*TagSetList{},
-		freshness:         config.Freshness,
-		timeToLive:        config.TimeToLive,
-		backgroundQueue:   requests,
+	if config.SnapshotInterval == 0 {
+		config.SnapshotInterval = time.Minute
 	}
-	if _, ok := apiInstance.(metadata.MetricUpdateAPI); ok {
+	if config.Clock == nil {
+		config.Clock = util.RealClock{}
+	}
+	result := &metricMetadataAPI{
+		metricMetadataAPI:     apiInstance,
+		clock:                 config.Clock,
+		getAllTagsCache:       map[api.MetricKey]*TagSetList{},
+		getActiveUntilCache:   map[api.MetricKey]*ActivityList{},
+		getMetricsForTagCache: map[tagPair]*MetricList{},
+		stats:                 map[string]*Stats{},
+		freshness:             config.Freshness,
+		timeToLive:            config.TimeToLive,
+		snapshotPath:          config.SnapshotPath,
+		snapshotInterval:      config.SnapshotInterval,
+		backgroundQueue:       requests,
+	}
+	if config.SnapshotPath != "" {
+		// The cache is only an optimization, so a snapshot which cannot be
+		// loaded leaves it empty rather than failing.
+		if err := result.loadSnapshot(); err != nil {
+			log.Warningf("Unable to load the metadata cache snapshot %s: %s", config.SnapshotPath, err.Error())
+		}
+	}
+	_, updatable := apiInstance.(metadata.MetricUpdateAPI)
+	_, deletable := apiInstance.(metadata.MetricDeleteAPI)
+	switch {
+	case updatable && deletable:
+		return &metricUpdateDeleteAPI{result}
+	case updatable:
 		return &metricUpdateAPI{result}
+	case deletable:
+		return &metricDeleteAPI{result}
 	}
-	return &result
+	return result
 }
 
-// addBackgroundGetAllTagsRequest adds a job to update the lag list for the given
-// metric. Requires the caller hold the lock for the item in the cache.
-func (c *metricMetadataAPI) addBackgroundGetAllTagsRequest(item *TagSetList, metricKey api.MetricKey) {
-	if item == nil {
-		log.Errorf("Asked to perform a background GetAllTags lookup for %s but missing entry", metricKey)
+// addBackgroundRequest adds a job to refresh the entry with the given call.
+// Requires the caller hold the lock for the entry.
+func (c *metricMetadataAPI) addBackgroundRequest(entry *cacheEntry, call cachedCall) {
+	if entry == nil {
+		log.Errorf("Asked to perform a background %s lookup for %s but missing entry", call.method, call.description)
 		return
 	}
 
@@ -123,35 +500,34 @@ func (c *metricMetadataAPI) addBackgroundGetAllTagsRequest(item *TagSetList, met
 	defer c.queueMutex.Unlock()
 
 	if cap(c.backgroundQueue) <= len(c.backgroundQueue) {
-		log.Warningf("Unable to enqueue a background GetAllTags lookup for %s due to a full queue", metricKey)
+		log.Warningf("Unable to enqueue a background %s lookup for %s due to a full queue", call.method, call.description)
 		return
 	}
 
-	if item.enqueued {
-		log.Infof("Unable to perform a background GetAllTags lookup for %s as one is already enqueued", metricKey)
+	if entry.enqueued {
+		log.Infof("Unable to perform a background %s lookup for %s as one is already enqueued", call.method, call.description)
 		return
 	}
 
-	if item.inflight {
-		log.Infof("Unable to perform a background GetAllTags lookup for %s as one is already in flight", metricKey)
+	if entry.inflight {
+		log.Infof("Unable to perform a background %s lookup for %s as one is already in flight", call.method, call.description)
 		return
 	}
 
-	log.Infof("Enqueuing a background GetAllTags lookup for %s", metricKey)
-	item.enqueued = true
+	log.Infof("Enqueuing a background %s lookup for %s", call.method, call.description)
+	entry.enqueued = true
 
 	c.backgroundQueue <- func(context metadata.Context) error {
-		log.Infof("Executing the background GetAllTags lookup for %s", metricKey)
-		defer log.Infof("Finished the background GetAllTags lookup for %s", metricKey)
+		log.Infof("Executing the background %s lookup for %s", call.method, call.description)
+		defer log.Infof("Finished the background %s lookup for %s", call.method, call.description)
 
-		item.Lock()
-		defer item.Unlock()
-		item.enqueued = false
+		entry.Lock()
+		defer entry.Unlock()
+		entry.enqueued = false
 
-		defer context.Profiler.Record("CachedMetricMetadataAPI_BackgroundAction_GetAllTags")()
+		defer context.Profiler.Record("CachedMetricMetadataAPI_BackgroundAction_" + call.method)()
 
-		_, err := c.fetchAndUpdateCachedTagSet(item, metricKey, context)
-		return err
+		return c.fetchAndUpdate(entry, call, context)
 	}
 }
 
@@ -161,14 +537,123 @@ func (c *metricMetadataAPI) GetBackgroundAction() func(metadata.Context) error {
 	return <-c.backgroundQueue
 }
 
-// GetAllMetrics waits for a slot to be open, then queries the underlying API.
+// GetAllMetrics uses the cache to serve the list of all metrics.
 func (c *metricMetadataAPI) GetAllMetrics(context metadata.Context) ([]api.MetricKey, error) {
-	return c.metricMetadataAPI.GetAllMetrics(context)
+	defer context.Profiler.Record("CachedMetricMetadataAPI_GetAllMetrics")()
+
+	c.getMetricsForTagCacheMutex.Lock()
+	if c.getAllMetricsCache == nil {
+		c.getAllMetricsCache = &MetricList{}
+	}
+	item := c.getAllMetricsCache
+	c.getMetricsForTagCacheMutex.Unlock()
+
+	return c.lookupMetrics(item, cachedCall{
+		method:      "GetAllMetrics",
+		description: "all metrics",
+		fetch: func(context metadata.Context) (func(), error) {
+			metrics, err := c.metricMetadataAPI.GetAllMetrics(context)
+			return func() {
+				item.Metrics = metrics
+				item.members = nil
+			}, err
+		},
+	}, context)
 }
 
-// GetMetricsForTag wwaits for a slot to be open, then queries the underlying API.
+// GetMetricsForTag uses the cache to serve the metrics which have the given tag.
 func (c *metricMetadataAPI) GetMetricsForTag(tagKey, tagValue string, context metadata.Context) ([]api.MetricKey, error) {
-	return c.metricMetadataAPI.GetMetricsForTag(tagKey, tagValue, context)
+	defer context.Profiler.Record("CachedMetricMetadataAPI_GetMetricsForTag")()
+
+	pair := tagPair{tagKey, tagValue}
+	c.getMetricsForTagCacheMutex.RLock()
+	item, ok := c.getMetricsForTagCache[pair]
+	c.getMetricsForTagCacheMutex.RUnlock()
+
+	if !ok {
+		c.getMetricsForTagCacheMutex.Lock()
+
+		// Make sure another goroutine hasn't already added the entry.
+		item, ok = c.getMetricsForTagCache[pair]
+		if !ok {
+			item = &MetricList{}
+			c.getMetricsForTagCache[pair] = item
+		}
+
+		c.getMetricsForTagCacheMutex.Unlock()
+	}
+
+	return c.lookupMetrics(item, cachedCall{
+		method:      "GetMetricsForTag",
+		description: tagKey + "=" + tagValue,
+		fetch: func(context metadata.Context) (func(), error) {
+			metrics, err := c.metricMetadataAPI.GetMetricsForTag(tagKey, tagValue, context)
+			return func() {
+				item.Metrics = metrics
+				item.members = nil
+			}, err
+		},
+	}, context)
+}
+
+// lookupMetrics serves the metric keys held by the item.
+func (c *metricMetadataAPI) lookupMetrics(item *MetricList, call cachedCall, context metadata.Context) ([]api.MetricKey, error) {
+	item.Lock()
+	defer item.Unlock()
+	if err := c.lookup(&item.cacheEntry, call, context); err != nil {
+		return nil, err
+	}
+	return item.Metrics, nil
+}
+
+// FilterActive uses the cache to filter the tagsets when the underlying API
+// provides GetActiveUntil, defers to the underlying API when it only records
+// activity, and otherwise keeps every tagset.
+func (c *metricMetadataAPI) FilterActive(metricKey api.MetricKey, tagSets []api.TagSet, since time.Time, context metadata.Context) ([]api.TagSet, error) {
+	defer context.Profiler.Record("CachedMetricMetadataAPI_FilterActive")()
+
+	activeUntilAPI, ok := c.metricMetadataAPI.(metadata.MetricActiveUntilAPI)
+	if !ok {
+		activityAPI, ok := c.metricMetadataAPI.(metadata.MetricActivityAPI)
+		if !ok {
+			return tagSets, nil
+		}
+		return activityAPI.FilterActive(metricKey, tagSets, since, context)
+	}
+
+	c.getActiveUntilCacheMutex.RLock()
+	item, ok := c.getActiveUntilCache[metricKey]
+	c.getActiveUntilCacheMutex.RUnlock()
+
+	if !ok {
+		c.getActiveUntilCacheMutex.Lock()
+
+		// Make sure another goroutine hasn't already added the entry.
+		item, ok = c.getActiveUntilCache[metricKey]
+		if !ok {
+			item = &ActivityList{}
+			c.getActiveUntilCache[metricKey] = item
+		}
+
+		c.getActiveUntilCacheMutex.Unlock()
+	}
+
+	item.Lock()
+	defer item.Unlock()
+	err := c.lookup(&item.cacheEntry, cachedCall{
+		method:      "FilterActive",
+		description: string(metricKey),
+		fetch: func(context metadata.Context) (func(), error) {
+			activeUntil, err := activeUntilAPI.GetActiveUntil(metricKey, context)
+			return func() {
+				item.ActiveUntil = activeUntil
+			}, err
+		},
+	}, context)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.FilterActiveUntil(tagSets, item.ActiveUntil, since), nil
 }
 
 // CheckHealthy checks if the underlying MetricAPI is healthy
@@ -176,48 +661,104 @@ func (c *metricMetadataAPI) CheckHealthy() error {
 	return c.metricMetadataAPI.CheckHealthy()
 }
 
-// fetchAndUpdateCachedTagSet updates the in-memory cache (asusming the update
+// fetchAndUpdate performs the call and updates the entry (asusming the update
 // is newer than what is in the cache). Requires the caller hold the lock for the
-// item in the cache.
-func (c *metricMetadataAPI) fetchAndUpdateCachedTagSet(item *TagSetList, metricKey api.MetricKey, context metadata.Context) ([]api.TagSet, error) {
-	if item == nil {
-		return nil, errors.New("missing cache list entry")
+// entry in the cache.
+func (c *metricMetadataAPI) fetchAndUpdate(entry *cacheEntry, call cachedCall, context metadata.Context) error {
+	if entry == nil {
+		return errors.New("missing cache list entry")
 	}
 
-	item.wg.Add(1)
-	item.fetchError = nil
-	item.inflight = true
-	item.Unlock()
+	entry.wg.Add(1)
+	entry.fetchError = nil
+	entry.inflight = true
+	entry.Unlock()
 
 	startTime := c.clock.Now()
-	tagsets, err := c.metricMetadataAPI.GetAllTags(metricKey, context)
+	store, err := call.fetch(context)
 
-	item.Lock()
+	entry.Lock()
 
 	if err != nil {
-		item.fetchError = err
-		item.wg.Done()
-		item.inflight = false
+		entry.fetchError = err
+		entry.wg.Done()
+		entry.inflight = false
 
-		return nil, err
+		return err
 	}
 
 	// Only update the cache if the update expires later than the current
 	// entry in the cache
 	newExpiry := startTime.Add(c.timeToLive)
-	if item.Expiry.Before(newExpiry) {
-		item.TagSets = tagsets
-		item.Expiry = newExpiry
-		item.Stale = startTime.Add(c.freshness)
+	if entry.Expiry.Before(newExpiry) {
+		store()
+		entry.Expiry = newExpiry
+		entry.Stale = startTime.Add(c.freshness)
 	} else {
-		log.Warningf("Asked to update the tag set for %s but new expiry is earlier than current (%s vs %s)",
-			metricKey, newExpiry.String(), item.Expiry.String())
+		log.Warningf("Asked to update the %s entry for %s but new expiry is earlier than current (%s vs %s)",
+			call.method, call.description, newExpiry.String(), entry.Expiry.String())
+	}
+
+	entry.wg.Done()
+	entry.inflight = false
+
+	return nil
+}
+
+// lookup makes sure the entry holds a usable result for the call.
+// If the entry is missing or out of date, it performs the call (or waits for
+// the one in flight). Even if the entry is up-to-date, this method may enqueue
+// a background request to the underlying API to keep the cache fresh.
+// Requires the caller hold the lock for the entry; the result is read from the
+// item afterwards.
+func (c *metricMetadataAPI) lookup(entry *cacheEntry, call cachedCall, context metadata.Context) error {
+	if entry.Expiry.IsZero() || entry.Expiry.Before(c.clock.Now()) {
+		if entry.inflight {
+			entry.Unlock()
+			entry.wg.Wait()
+
+			// Make sure we have the lock to re-read
+			entry.Lock()
+
+			// If the request we were waiting on errored, we also errored
+			c.record(call.method, func(stats *Stats) {
+				stats.Misses++
+				if entry.fetchError != nil {
+					stats.Errors++
+				}
+			})
+			return entry.fetchError
+		}
+
+		// We're going to execute this fetch now
+		defer context.Profiler.Record("CachedMetricMetadataAPI_" + call.method + "_Expired")()
+
+		err := c.fetchAndUpdate(entry, call, context)
+		c.record(call.method, func(stats *Stats) {
+			stats.Misses++
+			if err != nil {
+				stats.Errors++
+			}
+		})
+		if err != nil {
+			defer context.Profiler.Record("CachedMetricMetadataAPI_" + call.method + "_Errored")()
+			return err
+		}
+
+		return nil
 	}
 
-	item.wg.Done()
-	item.inflight = false
+	defer context.Profiler.Record("CachedMetricMetadataAPI_" + call.method + "_Hit")()
+	c.record(call.method, func(stats *Stats) { stats.Hits++ })
 
-	return tagsets, nil
+	// Otherwise, we could be stale
+	if entry.Stale.Before(c.clock.Now()) {
+		// Enqueue a background request
+		c.addBackgroundRequest(entry, call)
+	}
+
+	// but use the cached result immediately.
+	return nil
 }
 
 // GetAllTags uses the cache to serve tag data for the given metric.
@@ -228,6 +769,17 @@ func (c *metricMetadataAPI) fetchAndUpdateCachedTagSet(item *TagSetList, metricK
 func (c *metricMetadataAPI) GetAllTags(metricKey api.MetricKey, context metadata.Context) ([]api.TagSet, error) {
 	defer context.Profiler.Record("CachedMetricMetadataAPI_GetAllTags")()
 
+	item, err := c.getAllTagsItem(metricKey, context)
+	if err != nil {
+		return nil, err
+	}
+	defer item.Unlock()
+	return item.TagSets, nil
+}
+
+// getAllTagsItem returns the cache entry for the metric once it holds a
+// usable result. On success, the caller must unlock the returned item.
+func (c *metricMetadataAPI) getAllTagsItem(metricKey api.MetricKey, context metadata.Context) (*TagSetList, error) {
 	// Get the cached result for this metric.
 	c.getAllTagsCacheMutex.RLock()
 	item, ok := c.getAllTagsCache[metricKey]
@@ -249,44 +801,71 @@ func (c *metricMetadataAPI) GetAllTags(metricKey api.MetricKey, context metadata
 
 	item.Lock()
 
-	if item.Expiry.IsZero() || item.Expiry.Before(c.clock.Now()) {
-		if item.inflight {
-			item.Unlock()
-			item.wg.Wait()
-
-			// Make sure we have the lock to re-read
-			item.Lock()
-			defer item.Unlock()
-
-			// If the request we were waiting on errored, we also errored
-			return item.TagSets, item.fetchError
-		}
-
-		defer item.Unlock()
-
-		// We're going to execute this fetch now
-		defer context.Profiler.Record("CachedMetricMetadataAPI_GetAllTags_Expired")()
+	err := c.lookup(&item.cacheEntry, cachedCall{
+		method:      "GetAllTags",
+		description: string(metricKey),
+		fetch: func(context metadata.Context) (func(), error) {
+			tagsets, err := c.metricMetadataAPI.GetAllTags(metricKey, context)
+			return func() {
+				item.TagSets = tagsets
+				item.postings = nil
+				item.serialized = nil
+			}, err
+		},
+	}, context)
+	if err != nil {
+		item.Unlock()
+		return nil, err
+	}
+	return item, nil
+}
 
-		tagsets, err := c.fetchAndUpdateCachedTagSet(item, metricKey, context)
-		if err != nil {
-			defer context.Profiler.Record("CachedMetricMetadataAPI_GetAllTags_Errored")()
-			return nil, err
-		}
+// GetTagsMatching serves the tagsets satisfying the predicate from the cache.
+// The equality and "in" clauses it requires are answered from per-tag posting
+// lists, so the full predicate is only applied to the smallest candidate list.
+func (c *metricMetadataAPI) GetTagsMatching(metricKey api.MetricKey, p predicate.Predicate, context metadata.Context) ([]api.TagSet, error) {
+	defer context.Profiler.Record("CachedMetricMetadataAPI_GetTagsMatching")()
 
-		return tagsets, nil
+	// The postings are built from the same item which serves the tagsets, so
+	// a concurrent invalidation can't swap it out in between.
+	item, err := c.getAllTagsItem(metricKey, context)
+	if err != nil {
+		return nil, err
 	}
-
-	defer context.Profiler.Record("CachedMetricMetadataAPI_Hit")()
 	defer item.Unlock()
 
-	// Otherwise, we could be stale
-	if item.Stale.Before(c.clock.Now()) {
-		// Enqueue a background request
-		c.addBackgroundGetAllTagsRequest(item, metricKey)
+	matchers := predicate.RequiredMatchers(p)
+	if len(matchers) == 0 {
+		return applyPredicate(item.TagSets, p), nil
+	}
+	if item.postings == nil {
+		item.buildPostings()
+	}
+	var smallest []int
+	for i, matcher := range matchers {
+		candidates := item.candidates(matcher)
+		if i == 0 || len(candidates) < len(smallest) {
+			smallest = candidates
+		}
 	}
+	result := []api.TagSet{}
+	for _, index := range smallest {
+		if p.Apply(item.TagSets[index]) {
+			result = append(result, item.TagSets[index])
+		}
+	}
+	return result, nil
+}
 
-	// but return the cached result immediately.
-	return item.TagSets, nil
+// applyPredicate filters the tagsets which satisfy the predicate.
+func applyPredicate(tagsets []api.TagSet, p predicate.Predicate) []api.TagSet {
+	result := []api.TagSet{}
+	for _, tagset := range tagsets {
+		if p.Apply(tagset) {
+			result = append(result, tagset)
+		}
+	}
+	return result
 }
 
 // CurrentLiveRequests returns the number of requests currently in the queue
@@ -298,3 +877,26 @@ func (c *metricMetadataAPI) CurrentLiveRequests() int {
 func (c *metricMetadataAPI) MaximumLiveRequests() int {
 	return cap(c.backgroundQueue)
 }
+
+// Stats returns a copy of the hit and miss counts of each cached method.
+func (c *metricMetadataAPI) Stats() map[string]Stats {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	result := map[string]Stats{}
+	for method, stats := range c.stats {
+		result[method] = *stats
+	}
+	return result
+}
+
+// record counts a call to the method in its stats.
+func (c *metricMetadataAPI) record(method string, count func(*Stats)) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	stats, ok := c.stats[method]
+	if !ok {
+		stats = &Stats{}
+		c.stats[method] = stats
+	}
+	count(stats)
+}
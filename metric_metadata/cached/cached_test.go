@@ -16,8 +16,11 @@ package cached
 
 import (
 	"errors"
+	"io/ioutil"
 	standard_log "log"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -26,6 +29,7 @@ import (
 	"github.com/square/metrics/log"
 	"github.com/square/metrics/log/standard"
 	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/query/predicate"
 	"github.com/square/metrics/testing_support/assert"
 	"github.com/square/metrics/testing_support/mocks"
 )
@@ -606,3 +610,420 @@ func TestQueueSize(t *testing.T) {
 
 	a.MustEqInt(cached.CurrentLiveRequests(), 0)
 }
+
+func TestGetTagsMatching(t *testing.T) {
+	a := assert.New(t)
+
+	underlying := mocks.NewFakeMetricMetadataAPI()
+	for _, tagSet := range []api.TagSet{
+		{"host": "a", "dc": "east"},
+		{"host": "b", "dc": "east"},
+		{"host": "c", "dc": "west"},
+	} {
+		underlying.AddPairWithoutGraphite(api.TaggedMetric{MetricKey: "cpu", TagSet: tagSet})
+	}
+	cached := NewMetricMetadataAPI(underlying, Config{
+		RequestLimit: 10,
+		TimeToLive:   10 * time.Second,
+	}).(*metricMetadataAPI)
+	clock := mocks.NewTestClock(time.Now())
+	cached.clock = clock
+
+	tests := []struct {
+		predicate predicate.Predicate
+		expected  []api.TagSet
+	}{
+		{predicate.TruePredicate{}, []api.TagSet{{"host": "a", "dc": "east"}, {"host": "b", "dc": "east"}, {"host": "c", "dc": "west"}}},
+		{predicate.ListMatcher{Tag: "dc", Values: []string{"east"}}, []api.TagSet{{"host": "a", "dc": "east"}, {"host": "b", "dc": "east"}}},
+		{predicate.ListMatcher{Tag: "host", Values: []string{"c", "a", "c"}}, []api.TagSet{{"host": "a", "dc": "east"}, {"host": "c", "dc": "west"}}},
+		{predicate.All(
+			predicate.ListMatcher{Tag: "dc", Values: []string{"east"}},
+			predicate.NotPredicate{Predicate: predicate.ListMatcher{Tag: "host", Values: []string{"a"}}},
+		), []api.TagSet{{"host": "b", "dc": "east"}}},
+		{predicate.ListMatcher{Tag: "dc", Values: []string{"north"}}, []api.TagSet{}},
+	}
+	for _, test := range tests {
+		tagSets, err := cached.GetTagsMatching("cpu", test.predicate, metadata.Context{})
+		a.CheckError(err)
+		a.Contextf("%s", test.predicate.Query()).Eq(tagSets, test.expected)
+	}
+
+	if _, err := cached.GetTagsMatching("missing", predicate.TruePredicate{}, metadata.Context{}); err == nil {
+		t.Errorf("expected an error for a missing metric")
+	}
+
+	// Refreshing the entry rebuilds the posting lists.
+	underlying.AddPairWithoutGraphite(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "d", "dc": "north"}})
+	clock.Move(11 * time.Second)
+	tagSets, err := cached.GetTagsMatching("cpu", predicate.ListMatcher{Tag: "dc", Values: []string{"north"}}, metadata.Context{})
+	a.CheckError(err)
+	a.Eq(tagSets, []api.TagSet{{"host": "d", "dc": "north"}})
+}
+
+// deletableAPI is a fake metadata API which supports deletion.
+type deletableAPI struct {
+	*mocks.FakeMetricMetadataAPI
+	tagSets map[api.MetricKey][]api.TagSet
+}
+
+func (d deletableAPI) GetAllTags(metricKey api.MetricKey, context metadata.Context) ([]api.TagSet, error) {
+	if len(d.tagSets[metricKey]) == 0 {
+		return nil, metadata.NewNoSuchMetricError(string(metricKey))
+	}
+	return d.tagSets[metricKey], nil
+}
+
+func (d deletableAPI) RemoveMetric(metric api.TaggedMetric, context metadata.Context) error {
+	remaining := []api.TagSet{}
+	for _, tagSet := range d.tagSets[metric.MetricKey] {
+		if tagSet.Serialize() != metric.TagSet.Serialize() {
+			remaining = append(remaining, tagSet)
+		}
+	}
+	d.tagSets[metric.MetricKey] = remaining
+	return nil
+}
+
+func (d deletableAPI) RemoveMetricKey(metricKey api.MetricKey, context metadata.Context) error {
+	delete(d.tagSets, metricKey)
+	return nil
+}
+
+func TestRemoveInvalidates(t *testing.T) {
+	a := assert.New(t)
+
+	underlying := deletableAPI{
+		FakeMetricMetadataAPI: mocks.NewFakeMetricMetadataAPI(),
+		tagSets: map[api.MetricKey][]api.TagSet{
+			"cpu": {{"host": "a"}, {"host": "b"}},
+		},
+	}
+	cached := NewMetricMetadataAPI(underlying, Config{
+		RequestLimit: 10,
+		TimeToLive:   time.Hour,
+	}).(*metricDeleteAPI)
+
+	tagSets, err := cached.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(len(tagSets), 2)
+
+	a.CheckError(cached.RemoveMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}}, metadata.Context{}))
+	tagSets, err = cached.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(tagSets, []api.TagSet{{"host": "b"}})
+
+	a.CheckError(cached.RemoveMetricKey("cpu", metadata.Context{}))
+	if _, err := cached.GetAllTags("cpu", metadata.Context{}); err == nil {
+		t.Errorf("expected an error for a removed metric")
+	}
+
+	// The cache only supports deletion when the underlying API does.
+	plain := NewMetricMetadataAPI(mocks.NewFakeMetricMetadataAPI(), Config{RequestLimit: 10})
+	if _, ok := plain.(metadata.MetricDeleteAPI); ok {
+		t.Errorf("expected no deletion support without an underlying MetricDeleteAPI")
+	}
+	updatable := NewMetricMetadataAPI(&updatableAPI{FakeMetricMetadataAPI: mocks.NewFakeMetricMetadataAPI()}, Config{RequestLimit: 10})
+	if _, ok := updatable.(metadata.MetricDeleteAPI); ok {
+		t.Errorf("expected no deletion support without an underlying MetricDeleteAPI")
+	}
+	if _, ok := updatable.(metadata.MetricUpdateAPI); !ok {
+		t.Errorf("expected update support with an underlying MetricUpdateAPI")
+	}
+}
+
+// updatableAPI is a fake metadata API which supports updates and counts the
+// lookups which reach it.
+type updatableAPI struct {
+	*mocks.FakeMetricMetadataAPI
+	lookups int
+}
+
+func (u *updatableAPI) GetAllTags(metricKey api.MetricKey, context metadata.Context) ([]api.TagSet, error) {
+	u.lookups++
+	return u.FakeMetricMetadataAPI.GetAllTags(metricKey, context)
+}
+
+func (u *updatableAPI) GetAllMetrics(context metadata.Context) ([]api.MetricKey, error) {
+	u.lookups++
+	return u.FakeMetricMetadataAPI.GetAllMetrics(context)
+}
+
+func (u *updatableAPI) GetMetricsForTag(tagKey, tagValue string, context metadata.Context) ([]api.MetricKey, error) {
+	u.lookups++
+	return u.FakeMetricMetadataAPI.GetMetricsForTag(tagKey, tagValue, context)
+}
+
+// AddMetric adds the metric unless it is already present, which the fake API
+// doesn't check.
+func (u *updatableAPI) AddMetric(metric api.TaggedMetric, context metadata.Context) error {
+	tagSets, _ := u.FakeMetricMetadataAPI.GetAllTags(metric.MetricKey, context)
+	for _, tagSet := range tagSets {
+		if tagSet.Serialize() == metric.TagSet.Serialize() {
+			return nil
+		}
+	}
+	u.AddPairWithoutGraphite(metric)
+	return nil
+}
+
+func (u *updatableAPI) AddMetrics(metrics []api.TaggedMetric, context metadata.Context) error {
+	for _, metric := range metrics {
+		u.AddMetric(metric, context)
+	}
+	return nil
+}
+
+// sortedKeys sorts the metric keys, which the fake API returns in map order.
+func sortedKeys(metrics []api.MetricKey) []string {
+	result := make([]string, len(metrics))
+	for i, metric := range metrics {
+		result[i] = string(metric)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestCachedMetrics(t *testing.T) {
+	a := assert.New(t)
+
+	underlying := &updatableAPI{FakeMetricMetadataAPI: mocks.NewFakeMetricMetadataAPI()}
+	underlying.AddPairWithoutGraphite(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}})
+	cached := NewMetricMetadataAPI(underlying, Config{
+		Freshness:    5 * time.Second,
+		RequestLimit: 10,
+		TimeToLive:   10 * time.Second,
+	})
+	cachedUpdate := cached.(*metricUpdateAPI)
+	clock := mocks.NewTestClock(time.Now())
+	cachedUpdate.clock = clock
+
+	metrics, err := cached.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	a.Eq(sortedKeys(metrics), []string{"cpu"})
+	metrics, err = cached.GetMetricsForTag("host", "a", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(sortedKeys(metrics), []string{"cpu"})
+	a.EqInt(underlying.lookups, 2)
+
+	// Repeated lookups are served from the cache.
+	metrics, err = cached.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	a.Eq(sortedKeys(metrics), []string{"cpu"})
+	metrics, err = cached.GetMetricsForTag("host", "a", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(sortedKeys(metrics), []string{"cpu"})
+	a.EqInt(underlying.lookups, 2)
+
+	// Stale entries are served while a background refresh is enqueued.
+	clock.Move(6 * time.Second)
+	_, err = cached.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(underlying.lookups, 2)
+	a.MustEqInt(cached.CurrentLiveRequests(), 1)
+	a.CheckError(cached.GetBackgroundAction()(metadata.Context{}))
+	a.EqInt(underlying.lookups, 3)
+
+	// Adding a metric invalidates the entries it could change.
+	a.CheckError(cachedUpdate.AddMetric(api.TaggedMetric{MetricKey: "mem", TagSet: api.TagSet{"host": "a"}}, metadata.Context{}))
+	metrics, err = cached.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	a.Eq(sortedKeys(metrics), []string{"cpu", "mem"})
+	metrics, err = cached.GetMetricsForTag("host", "a", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(sortedKeys(metrics), []string{"cpu", "mem"})
+	a.EqInt(underlying.lookups, 5)
+
+	a.CheckError(cachedUpdate.AddMetrics([]api.TaggedMetric{{MetricKey: "disk", TagSet: api.TagSet{"host": "b"}}}, metadata.Context{}))
+	metrics, err = cached.GetMetricsForTag("host", "a", metadata.Context{}) // unaffected
+	a.CheckError(err)
+	a.Eq(sortedKeys(metrics), []string{"cpu", "mem"})
+	metrics, err = cached.GetMetricsForTag("host", "b", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(sortedKeys(metrics), []string{"disk"})
+	a.EqInt(underlying.lookups, 6)
+
+	stats := cached.Stats()
+	a.Eq(stats["GetAllMetrics"], Stats{Hits: 2, Misses: 2})
+	a.Eq(stats["GetMetricsForTag"], Stats{Hits: 2, Misses: 3})
+
+	// Adding metrics which the cached entries already hold keeps them.
+	tagSets, err := cached.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(tagSets, []api.TagSet{{"host": "a"}})
+	_, err = cached.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(underlying.lookups, 8)
+	a.CheckError(cachedUpdate.AddMetrics([]api.TaggedMetric{
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+		{MetricKey: "disk", TagSet: api.TagSet{"host": "b"}},
+	}, metadata.Context{}))
+	_, err = cached.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	_, err = cached.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	_, err = cached.GetMetricsForTag("host", "b", metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(underlying.lookups, 8)
+
+	// A new tagset of a cached metric invalidates its tagsets.
+	a.CheckError(cachedUpdate.AddMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}}, metadata.Context{}))
+	tagSets, err = cached.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(len(tagSets), 2)
+	_, err = cached.GetAllMetrics(metadata.Context{}) // still holds cpu
+	a.CheckError(err)
+	a.EqInt(underlying.lookups, 9)
+}
+
+// activityAPI is a fake metadata API which records activity and counts the
+// lookups of it which reach it.
+type activityAPI struct {
+	*updatableAPI
+	activeUntil map[string]time.Time
+	lookups     int
+}
+
+func (u *activityAPI) FilterActive(metricKey api.MetricKey, tagSets []api.TagSet, since time.Time, context metadata.Context) ([]api.TagSet, error) {
+	activeUntil, err := u.GetActiveUntil(metricKey, context)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.FilterActiveUntil(tagSets, activeUntil, since), nil
+}
+
+func (u *activityAPI) GetActiveUntil(metricKey api.MetricKey, context metadata.Context) (map[string]time.Time, error) {
+	u.lookups++
+	result := map[string]time.Time{}
+	for tagSet, until := range u.activeUntil {
+		result[tagSet] = until
+	}
+	return result, nil
+}
+
+func TestCachedFilterActive(t *testing.T) {
+	a := assert.New(t)
+
+	start := time.Unix(100000, 0)
+	hostA := api.TagSet{"host": "a"}
+	hostB := api.TagSet{"host": "b"}
+	hostC := api.TagSet{"host": "c"}
+	underlying := &activityAPI{
+		updatableAPI: &updatableAPI{FakeMetricMetadataAPI: mocks.NewFakeMetricMetadataAPI()},
+		activeUntil: map[string]time.Time{
+			hostA.Serialize(): start.Add(-time.Hour),
+			hostB.Serialize(): start.Add(time.Hour),
+		},
+	}
+	cached := NewMetricMetadataAPI(underlying, Config{
+		Freshness:    5 * time.Second,
+		RequestLimit: 10,
+		TimeToLive:   10 * time.Second,
+	})
+	cachedUpdate := cached.(*metricUpdateAPI)
+	clock := mocks.NewTestClock(start)
+	cachedUpdate.clock = clock
+	activity := cached.(metadata.MetricActivityAPI)
+
+	// host=a is no longer active, and host=c's activity is unknown.
+	active, err := activity.FilterActive("cpu", []api.TagSet{hostA, hostB, hostC}, start, metadata.Context{})
+	a.CheckError(err)
+	a.Eq(active, []api.TagSet{hostB, hostC})
+	active, err = activity.FilterActive("cpu", []api.TagSet{hostA, hostB}, start.Add(-2*time.Hour), metadata.Context{})
+	a.CheckError(err)
+	a.Eq(active, []api.TagSet{hostA, hostB})
+	a.EqInt(underlying.lookups, 1)
+
+	// Stale entries are served while a background refresh is enqueued.
+	clock.Move(6 * time.Second)
+	_, err = activity.FilterActive("cpu", []api.TagSet{hostA}, start, metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(underlying.lookups, 1)
+	a.MustEqInt(cached.CurrentLiveRequests(), 1)
+	a.CheckError(cached.GetBackgroundAction()(metadata.Context{}))
+	a.EqInt(underlying.lookups, 2)
+
+	// Adding a tagset which stays active keeps the entry, while adding an
+	// inactive one again drops it.
+	a.CheckError(cachedUpdate.AddMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: hostB}, metadata.Context{}))
+	_, err = activity.FilterActive("cpu", []api.TagSet{hostA}, start, metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(underlying.lookups, 2)
+
+	underlying.activeUntil[hostA.Serialize()] = start.Add(time.Hour)
+	a.CheckError(cachedUpdate.AddMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: hostA}, metadata.Context{}))
+	active, err = activity.FilterActive("cpu", []api.TagSet{hostA}, start, metadata.Context{})
+	a.CheckError(err)
+	a.Eq(active, []api.TagSet{hostA})
+	a.EqInt(underlying.lookups, 3)
+
+	a.Eq(cached.Stats()["FilterActive"], Stats{Hits: 3, Misses: 2})
+}
+
+func TestSnapshot(t *testing.T) {
+	a := assert.New(t)
+	directory, err := ioutil.TempDir("", "metadata-cache-snapshot")
+	a.CheckError(err)
+	defer os.RemoveAll(directory)
+	clock := mocks.NewTestClock(time.Unix(100000, 0))
+	config := Config{
+		Freshness:    5 * time.Second,
+		RequestLimit: 10,
+		TimeToLive:   10 * time.Second,
+		SnapshotPath: filepath.Join(directory, "cache.json"),
+		Clock:        clock,
+	}
+
+	original := &updatableAPI{FakeMetricMetadataAPI: mocks.NewFakeMetricMetadataAPI()}
+	original.AddPairWithoutGraphite(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}})
+	cached := NewMetricMetadataAPI(original, config)
+	_, err = cached.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	_, err = cached.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	_, err = cached.GetMetricsForTag("host", "a", metadata.Context{})
+	a.CheckError(err)
+	a.CheckError(cached.Snapshot())
+
+	// After a restart, the saved entries are served even though they have
+	// expired, and refreshed in the background.
+	clock.Move(time.Hour)
+	restarted := &updatableAPI{FakeMetricMetadataAPI: mocks.NewFakeMetricMetadataAPI()}
+	restarted.AddPairWithoutGraphite(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}})
+	warm := NewMetricMetadataAPI(restarted, config)
+	tagSets, err := warm.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(tagSets, []api.TagSet{{"host": "a"}})
+	metrics, err := warm.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"cpu"})
+	metrics, err = warm.GetMetricsForTag("host", "a", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"cpu"})
+	a.EqInt(restarted.lookups, 0)
+	a.Eq(warm.Stats()["GetAllTags"], Stats{Hits: 1})
+
+	a.MustEqInt(warm.CurrentLiveRequests(), 3)
+	for i := 0; i < 3; i++ {
+		a.CheckError(warm.GetBackgroundAction()(metadata.Context{}))
+	}
+	a.EqInt(restarted.lookups, 3)
+	tagSets, err = warm.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(tagSets, []api.TagSet{{"host": "b"}})
+	metrics, err = warm.GetMetricsForTag("host", "a", metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(len(metrics), 0)
+	a.EqInt(warm.CurrentLiveRequests(), 0)
+
+	// A corrupt snapshot leaves the cache empty.
+	a.CheckError(ioutil.WriteFile(config.SnapshotPath, []byte("{not json"), 0644))
+	cold := NewMetricMetadataAPI(restarted, config)
+	_, err = cold.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(restarted.lookups, 4)
+
+	// Snapshots need a path.
+	if err := NewMetricMetadataAPI(restarted, Config{RequestLimit: 10}).Snapshot(); err == nil {
+		t.Errorf("expected an error saving a snapshot without a path")
+	}
+}
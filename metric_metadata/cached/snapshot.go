@@ -0,0 +1,232 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cached
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/log"
+)
+
+// snapshot is the JSON format of a snapshot file. Only entries which have
+// been fetched successfully are saved.
+type snapshot struct {
+	GetAllTags       []tagSetsSnapshot `json:"get_all_tags"`
+	GetAllMetrics    *metricsSnapshot  `json:"get_all_metrics,omitempty"`
+	GetMetricsForTag []metricsSnapshot `json:"get_metrics_for_tag"`
+}
+
+// tagSetsSnapshot is a saved TagSetList.
+type tagSetsSnapshot struct {
+	MetricKey api.MetricKey `json:"metric"`
+	TagSets   []api.TagSet  `json:"tagsets"`
+	Expiry    time.Time     `json:"expiry"`
+	Stale     time.Time     `json:"stale"`
+}
+
+// metricsSnapshot is a saved MetricList. The tag is empty for GetAllMetrics.
+type metricsSnapshot struct {
+	TagKey   string          `json:"tag_key,omitempty"`
+	TagValue string          `json:"tag_value,omitempty"`
+	Metrics  []api.MetricKey `json:"metrics"`
+	Expiry   time.Time       `json:"expiry"`
+	Stale    time.Time       `json:"stale"`
+}
+
+// Snapshot saves the contents of the cache to the configured snapshot file.
+// The file is replaced atomically, so a crash while saving leaves the
+// previous snapshot intact.
+func (c *metricMetadataAPI) Snapshot() error {
+	if c.snapshotPath == "" {
+		return fmt.Errorf("no snapshot path is configured for the cached metadata API")
+	}
+	contents, err := json.Marshal(c.snapshot())
+	if err != nil {
+		return err
+	}
+	temporary, err := ioutil.TempFile(filepath.Dir(c.snapshotPath), filepath.Base(c.snapshotPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := temporary.Write(contents); err != nil {
+		temporary.Close()
+		os.Remove(temporary.Name())
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+	if err := os.Rename(temporary.Name(), c.snapshotPath); err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+	return nil
+}
+
+// SnapshotPeriodically calls Snapshot every SnapshotInterval, logging any
+// errors. It never returns, so it should be run in its own goroutine.
+func (c *metricMetadataAPI) SnapshotPeriodically() {
+	for range time.Tick(c.snapshotInterval) {
+		if err := c.Snapshot(); err != nil {
+			log.Errorf("Error saving metadata cache snapshot: %s", err.Error())
+		}
+	}
+}
+
+// snapshot copies the entries of the cache which hold a fetched result.
+// Each entry is locked in turn, so the result is not a consistent view of the
+// whole cache, which doesn't matter as every entry is refreshed after loading.
+func (c *metricMetadataAPI) snapshot() snapshot {
+	saved := snapshot{
+		GetAllTags:       []tagSetsSnapshot{},
+		GetMetricsForTag: []metricsSnapshot{},
+	}
+
+	c.getAllTagsCacheMutex.RLock()
+	tagSetLists := make(map[api.MetricKey]*TagSetList, len(c.getAllTagsCache))
+	for metricKey, item := range c.getAllTagsCache {
+		tagSetLists[metricKey] = item
+	}
+	c.getAllTagsCacheMutex.RUnlock()
+
+	c.getMetricsForTagCacheMutex.RLock()
+	allMetrics := c.getAllMetricsCache
+	metricLists := make(map[tagPair]*MetricList, len(c.getMetricsForTagCache))
+	for pair, item := range c.getMetricsForTagCache {
+		metricLists[pair] = item
+	}
+	c.getMetricsForTagCacheMutex.RUnlock()
+
+	for metricKey, item := range tagSetLists {
+		item.Lock()
+		if !item.Expiry.IsZero() {
+			saved.GetAllTags = append(saved.GetAllTags, tagSetsSnapshot{
+				MetricKey: metricKey,
+				TagSets:   item.TagSets,
+				Expiry:    item.Expiry,
+				Stale:     item.Stale,
+			})
+		}
+		item.Unlock()
+	}
+	if allMetrics != nil {
+		allMetrics.Lock()
+		if !allMetrics.Expiry.IsZero() {
+			saved.GetAllMetrics = &metricsSnapshot{
+				Metrics: allMetrics.Metrics,
+				Expiry:  allMetrics.Expiry,
+				Stale:   allMetrics.Stale,
+			}
+		}
+		allMetrics.Unlock()
+	}
+	for pair, item := range metricLists {
+		item.Lock()
+		if !item.Expiry.IsZero() {
+			saved.GetMetricsForTag = append(saved.GetMetricsForTag, metricsSnapshot{
+				TagKey:   pair.key,
+				TagValue: pair.value,
+				Metrics:  item.Metrics,
+				Expiry:   item.Expiry,
+				Stale:    item.Stale,
+			})
+		}
+		item.Unlock()
+	}
+
+	// Sort the entries so that the snapshots of identical caches are identical.
+	sort.Sort(tagSetsSnapshots(saved.GetAllTags))
+	sort.Sort(metricsSnapshots(saved.GetMetricsForTag))
+	return saved
+}
+
+// loadSnapshot fills the empty cache from the configured snapshot file, if it
+// exists. Every loaded entry is stale, so its first use enqueues a background
+// refresh; entries which have expired since they were saved are kept usable
+// for another Freshness period, giving that refresh time to complete.
+func (c *metricMetadataAPI) loadSnapshot() error {
+	contents, err := ioutil.ReadFile(c.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var loaded snapshot
+	if err := json.Unmarshal(contents, &loaded); err != nil {
+		return err
+	}
+
+	now := c.clock.Now()
+	warm := func(entry *cacheEntry, expiry time.Time, stale time.Time) {
+		entry.Expiry = expiry
+		if minimum := now.Add(c.freshness); entry.Expiry.Before(minimum) {
+			entry.Expiry = minimum
+		}
+		entry.Stale = stale
+		if now.Before(entry.Stale) {
+			entry.Stale = now
+		}
+	}
+
+	c.getAllTagsCacheMutex.Lock()
+	for _, saved := range loaded.GetAllTags {
+		item := &TagSetList{TagSets: saved.TagSets}
+		warm(&item.cacheEntry, saved.Expiry, saved.Stale)
+		c.getAllTagsCache[saved.MetricKey] = item
+	}
+	c.getAllTagsCacheMutex.Unlock()
+
+	c.getMetricsForTagCacheMutex.Lock()
+	defer c.getMetricsForTagCacheMutex.Unlock()
+	if saved := loaded.GetAllMetrics; saved != nil {
+		item := &MetricList{Metrics: saved.Metrics}
+		warm(&item.cacheEntry, saved.Expiry, saved.Stale)
+		c.getAllMetricsCache = item
+	}
+	for _, saved := range loaded.GetMetricsForTag {
+		item := &MetricList{Metrics: saved.Metrics}
+		warm(&item.cacheEntry, saved.Expiry, saved.Stale)
+		c.getMetricsForTagCache[tagPair{saved.TagKey, saved.TagValue}] = item
+	}
+	return nil
+}
+
+// tagSetsSnapshots sorts saved TagSetLists by metric key.
+type tagSetsSnapshots []tagSetsSnapshot
+
+func (s tagSetsSnapshots) Len() int           { return len(s) }
+func (s tagSetsSnapshots) Less(i, j int) bool { return s[i].MetricKey < s[j].MetricKey }
+func (s tagSetsSnapshots) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// metricsSnapshots sorts saved MetricLists by tag.
+type metricsSnapshots []metricsSnapshot
+
+func (s metricsSnapshots) Len() int { return len(s) }
+func (s metricsSnapshots) Less(i, j int) bool {
+	if s[i].TagKey != s[j].TagKey {
+		return s[i].TagKey < s[j].TagKey
+	}
+	return s[i].TagValue < s[j].TagValue
+}
+func (s metricsSnapshots) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
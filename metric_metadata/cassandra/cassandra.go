@@ -15,47 +15,115 @@
 package cassandra
 
 import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gocql/gocql"
 	"github.com/square/metrics/api"
 	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/tasks"
+	"github.com/square/metrics/util"
 )
 
+// maxShardReads bounds how many metric_name_set shards are read at once.
+const maxShardReads = 16
+
+// migrationChunkSize bounds how many names are moved by a single statement.
+const migrationChunkSize = 1000
+
 type MetricMetadataAPI struct {
-	db cassandraDatabase
+	db     cassandraDatabase
+	config Config
+	recent *recentlyWritten
 }
 
 var _ metadata.MetricAPI = (*MetricMetadataAPI)(nil)
 var _ metadata.MetricUpdateAPI = (*MetricMetadataAPI)(nil)
+var _ metadata.MetricDeleteAPI = (*MetricMetadataAPI)(nil)
+var _ metadata.MetricActiveUntilAPI = (*MetricMetadataAPI)(nil)
 
 type Config struct {
 	Hosts    []string `yaml:"hosts"`
 	Keyspace string   `yaml:"keyspace"`
+	// MetricNameShards is the number of metric_name_set rows that metric names
+	// are spread over by hash (default 1, which keeps every name in shard 0).
+	// After raising it, run main/shardmigrator to move the existing names.
+	// It must never be lowered: names in rows at or beyond the new count
+	// would no longer be read.
+	MetricNameShards int `yaml:"metric_name_shards"`
+	// BatchSize bounds the number of statements in each unlogged batch written
+	// by AddMetrics (default 100).
+	BatchSize int `yaml:"batch_size"`
+	// WriteConcurrency bounds the number of batches written at once (default 8).
+	WriteConcurrency int `yaml:"write_concurrency"`
+	// RecentlyWrittenLimit bounds how many written metrics are remembered, so
+	// that adding them again costs nothing (default 100000).
+	RecentlyWrittenLimit int `yaml:"recently_written_limit"`
+	// RecentlyWrittenTTL is how long a written metric is remembered (default
+	// 30m). Other processes may remove it from Cassandra meanwhile, so it
+	// should be shorter than how often producers add their metrics again.
+	RecentlyWrittenTTL time.Duration `yaml:"recently_written_ttl"`
+	// TagSetTTL is how long a tagset may go without being added again before
+	// Cassandra expires it, along with the tag index and metric name entries
+	// which no other tagset refreshes (optional; by default tagsets never
+	// expire).
+	TagSetTTL time.Duration `yaml:"tagset_ttl"`
+	// TrackActivity records when each tagset was last written, so that
+	// FilterActive can skip the inactive ones (default false, which keeps
+	// every tagset). It requires the last_seen column of metric_names, which
+	// existing clusters must add before enabling it (see schema/schema.cql).
+	TrackActivity bool `yaml:"track_activity"`
+	// ActivitySlack is how long after it was last written a tagset is still
+	// considered active by FilterActive. It should exceed how often producers
+	// add their metrics again plus RecentlyWrittenTTL (default 2h).
+	ActivitySlack time.Duration `yaml:"activity_slack"`
+
+	Clock util.Clock `yaml:"-"`
 }
 
 // NewMetricMetadataAPI creates a new instance of API from the given configuration.
 func NewMetricMetadataAPI(config Config) (*MetricMetadataAPI, error) {
+	if config.BatchSize == 0 {
+		config.BatchSize = 100
+	}
+	if config.WriteConcurrency == 0 {
+		config.WriteConcurrency = 8
+	}
+	if config.RecentlyWrittenLimit == 0 {
+		config.RecentlyWrittenLimit = 100000
+	}
+	if config.RecentlyWrittenTTL == 0 {
+		config.RecentlyWrittenTTL = 30 * time.Minute
+	}
+	if config.ActivitySlack == 0 {
+		config.ActivitySlack = 2 * time.Hour
+	}
+	if config.Clock == nil {
+		config.Clock = util.RealClock{}
+	}
 	clusterConfig := gocql.NewCluster()
 	clusterConfig.Consistency = gocql.One
 	clusterConfig.Hosts = config.Hosts
 	clusterConfig.Keyspace = config.Keyspace
 	clusterConfig.Timeout = time.Second * 30
-	db, err := newCassandraDatabase(clusterConfig)
+	db, err := newCassandraDatabase(clusterConfig, config.MetricNameShards, config.TagSetTTL, config.TrackActivity)
 	if err != nil {
 		return nil, err
 	}
 	return &MetricMetadataAPI{
-		db: db,
+		db:     db,
+		config: config,
+		recent: newRecentlyWritten(config.RecentlyWrittenLimit, config.RecentlyWrittenTTL, config.Clock),
 	}, nil
 }
 
 func (a *MetricMetadataAPI) AddMetric(metric api.TaggedMetric, context metadata.Context) error {
 	defer context.Profiler.Record("Cassandra AddMetric")()
-	if err := a.db.AddMetricName(metric.MetricKey, metric.TagSet); err != nil {
-		return err
-	}
-	return a.AddMetricTagsToTagIndex(metric, context)
+	return a.AddMetrics([]api.TaggedMetric{metric}, context)
 }
 func (a *MetricMetadataAPI) AddMetricTagsToTagIndex(metric api.TaggedMetric, context metadata.Context) error {
 	defer context.Profiler.Record("Cassandra AddMetricTagsToTagIndex")()
@@ -67,16 +135,91 @@ func (a *MetricMetadataAPI) AddMetricTagsToTagIndex(metric api.TaggedMetric, con
 	return nil
 }
 
+// AddMetrics writes the metrics which this API hasn't recently written, using
+// unlogged batches which each touch a single partition. The batches are
+// written concurrently, and the metrics are only remembered once they all
+// succeed.
 func (a *MetricMetadataAPI) AddMetrics(metrics []api.TaggedMetric, context metadata.Context) error {
 	defer context.Profiler.Record("Cassandra AddMetrics")()
-	// Add each of the metrics to the tag index
-	for _, metric := range metrics {
-		err := a.AddMetricTagsToTagIndex(metric, context)
-		if err != nil {
+	pending := a.recent.filter(metrics)
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := a.db.WriteBatches(a.db.PlanBatches(pending, a.config.BatchSize, a.config.Clock.Now()), a.config.WriteConcurrency); err != nil {
+		return err
+	}
+	a.recent.add(pending)
+	return nil
+}
+
+// RemoveMetric removes the tagset from the metric. Tag index entries are only
+// removed once no remaining tagset of the metric uses them, and the metric key
+// itself is forgotten along with its last tagset.
+func (a *MetricMetadataAPI) RemoveMetric(metric api.TaggedMetric, context metadata.Context) error {
+	defer context.Profiler.Record("Cassandra RemoveMetric")()
+	a.recent.forget(metric)
+	if err := a.db.RemoveMetricName(metric.MetricKey, metric.TagSet); err != nil {
+		return err
+	}
+	remaining, err := a.db.GetTagSet(metric.MetricKey)
+	if _, ok := err.(metadata.NoSuchMetricError); ok {
+		remaining, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	for tagKey, tagValue := range metric.TagSet {
+		used := false
+		for _, tagSet := range remaining {
+			if value, ok := tagSet[tagKey]; ok && value == tagValue {
+				used = true
+				break
+			}
+		}
+		if used {
+			continue
+		}
+		if err := a.db.RemoveFromTagIndex(tagKey, tagValue, metric.MetricKey); err != nil {
 			return err
 		}
 	}
-	return a.db.AddMetricNames(metrics)
+	if len(remaining) == 0 {
+		return a.db.RemoveFromMetricNameSet(metric.MetricKey)
+	}
+	return nil
+}
+
+// RemoveMetricKey removes every tagset of the metric, its tag index entries
+// and the metric key itself.
+func (a *MetricMetadataAPI) RemoveMetricKey(metricKey api.MetricKey, context metadata.Context) error {
+	defer context.Profiler.Record("Cassandra RemoveMetricKey")()
+	a.recent.forgetKey(metricKey)
+	tagSets, err := a.db.GetTagSet(metricKey)
+	if _, ok := err.(metadata.NoSuchMetricError); ok {
+		tagSets, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	removed := map[string]map[string]bool{} // tag key => tag values already removed
+	for _, tagSet := range tagSets {
+		for tagKey, tagValue := range tagSet {
+			if removed[tagKey][tagValue] {
+				continue
+			}
+			if err := a.db.RemoveFromTagIndex(tagKey, tagValue, metricKey); err != nil {
+				return err
+			}
+			if removed[tagKey] == nil {
+				removed[tagKey] = map[string]bool{}
+			}
+			removed[tagKey][tagValue] = true
+		}
+	}
+	if err := a.db.RemoveMetricNames(metricKey); err != nil {
+		return err
+	}
+	return a.db.RemoveFromMetricNameSet(metricKey)
 }
 
 func (a *MetricMetadataAPI) GetAllTags(metricKey api.MetricKey, context metadata.Context) ([]api.TagSet, error) {
@@ -84,6 +227,38 @@ func (a *MetricMetadataAPI) GetAllTags(metricKey api.MetricKey, context metadata
 	return a.db.GetTagSet(metricKey)
 }
 
+// FilterActive returns the tagsets which were last written no more than
+// ActivitySlack before the given time. Tagsets written before last-seen times
+// were recorded are kept, as is every tagset unless TrackActivity is set.
+func (a *MetricMetadataAPI) FilterActive(metricKey api.MetricKey, tagSets []api.TagSet, since time.Time, context metadata.Context) ([]api.TagSet, error) {
+	defer context.Profiler.Record("Cassandra FilterActive")()
+	activeUntil, err := a.GetActiveUntil(metricKey, context)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.FilterActiveUntil(tagSets, activeUntil, since), nil
+}
+
+// GetActiveUntil returns ActivitySlack after the time each tagset of the
+// metric was last written, by serialized tagset. It is empty unless
+// TrackActivity is set.
+func (a *MetricMetadataAPI) GetActiveUntil(metricKey api.MetricKey, context metadata.Context) (map[string]time.Time, error) {
+	defer context.Profiler.Record("Cassandra GetActiveUntil")()
+	if !a.config.TrackActivity {
+		// The last_seen column may not exist.
+		return map[string]time.Time{}, nil
+	}
+	lastSeen, err := a.db.GetLastSeen(metricKey)
+	if err != nil {
+		return nil, err
+	}
+	activeUntil := make(map[string]time.Time, len(lastSeen))
+	for tagSet, seen := range lastSeen {
+		activeUntil[tagSet] = seen.Add(a.config.ActivitySlack)
+	}
+	return activeUntil, nil
+}
+
 func (a *MetricMetadataAPI) GetMetricsForTag(tagKey, tagValue string, context metadata.Context) ([]api.MetricKey, error) {
 	defer context.Profiler.Record("Cassandra GetMetricsForTag")()
 	return a.db.GetMetricKeys(tagKey, tagValue)
@@ -94,32 +269,156 @@ func (a *MetricMetadataAPI) GetAllMetrics(context metadata.Context) ([]api.Metri
 	return a.db.GetAllMetrics()
 }
 
+// MigrateMetricNameShards moves the names in every row of metric_name_set
+// into the shards they belong to under the configured shard count, including
+// the legacy shard 0 row and rows filled under a smaller shard count. Names are
+// copied before they're removed from their old row, so no reader misses them,
+// and the migration can safely be run again. It returns the number of names
+// moved.
+func (a *MetricMetadataAPI) MigrateMetricNameShards() (int, error) {
+	return a.db.MigrateMetricNameShards()
+}
+
 // CheckHealthy checks if the underlying connection to Cassandra is healthy
 func (a *MetricMetadataAPI) CheckHealthy() error {
 	return a.db.CheckHealthy()
 }
 
+// recentlyWritten remembers the metrics written by this process for a while,
+// so that adding them again doesn't touch Cassandra. Entries expire after the
+// TTL, so metrics removed by another process are written again. Once it holds
+// its limit, it forgets everything; that only costs writing the active
+// metrics again.
+type recentlyWritten struct {
+	mutex   sync.Mutex
+	limit   int
+	ttl     time.Duration
+	clock   util.Clock
+	count   int
+	metrics map[api.MetricKey]map[string]time.Time // metric key => serialized tagset => when it was written
+}
+
+func newRecentlyWritten(limit int, ttl time.Duration, clock util.Clock) *recentlyWritten {
+	return &recentlyWritten{
+		limit:   limit,
+		ttl:     ttl,
+		clock:   clock,
+		metrics: map[api.MetricKey]map[string]time.Time{},
+	}
+}
+
+// filter returns the metrics which haven't been written recently, without duplicates.
+func (r *recentlyWritten) filter(metrics []api.TaggedMetric) []api.TaggedMetric {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	result := []api.TaggedMetric{}
+	included := map[api.MetricKey]map[string]struct{}{}
+	cutoff := r.clock.Now().Add(-r.ttl)
+	for _, metric := range metrics {
+		serialized := metric.TagSet.Serialize()
+		if written, ok := r.metrics[metric.MetricKey][serialized]; ok && written.After(cutoff) {
+			continue
+		}
+		if _, ok := included[metric.MetricKey][serialized]; ok {
+			continue
+		}
+		if included[metric.MetricKey] == nil {
+			included[metric.MetricKey] = map[string]struct{}{}
+		}
+		included[metric.MetricKey][serialized] = struct{}{}
+		result = append(result, metric)
+	}
+	return result
+}
+
+// add remembers the metrics as written.
+func (r *recentlyWritten) add(metrics []api.TaggedMetric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.count+len(metrics) > r.limit {
+		r.metrics = map[api.MetricKey]map[string]time.Time{}
+		r.count = 0
+	}
+	now := r.clock.Now()
+	for _, metric := range metrics {
+		tagSets, ok := r.metrics[metric.MetricKey]
+		if !ok {
+			tagSets = map[string]time.Time{}
+			r.metrics[metric.MetricKey] = tagSets
+		}
+		serialized := metric.TagSet.Serialize()
+		if _, ok := tagSets[serialized]; !ok {
+			r.count++
+		}
+		tagSets[serialized] = now
+	}
+}
+
+// forget drops a single metric, so that it is written when it is next added.
+func (r *recentlyWritten) forget(metric api.TaggedMetric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	serialized := metric.TagSet.Serialize()
+	if _, ok := r.metrics[metric.MetricKey][serialized]; ok {
+		delete(r.metrics[metric.MetricKey], serialized)
+		r.count--
+	}
+}
+
+// forgetKey drops every tagset of the metric.
+func (r *recentlyWritten) forgetKey(metricKey api.MetricKey) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.count -= len(r.metrics[metricKey])
+	delete(r.metrics, metricKey)
+}
+
 type cassandraDatabase struct {
 	session *gocql.Session
+	shards  int           // the number of metric_name_set rows (values below 1 mean 1)
+	ttl     time.Duration // how long the entries written by PlanBatches live (0 means forever)
+
+	lastSeen bool // whether PlanBatches writes the last-seen time of each tagset
 }
 
 // NewCassandraDatabase creates an instance of database, backed by Cassandra.
-func newCassandraDatabase(clusterConfig *gocql.ClusterConfig) (cassandraDatabase, error) {
+func newCassandraDatabase(clusterConfig *gocql.ClusterConfig, shards int, ttl time.Duration, lastSeen bool) (cassandraDatabase, error) {
 	session, err := clusterConfig.CreateSession()
 	if err != nil {
 		return cassandraDatabase{}, err
 	}
 	return cassandraDatabase{
 		session: session,
+		shards:   shards,
+		ttl:      ttl,
+		lastSeen: lastSeen,
 	}, nil
 }
 
+// shardCount returns the number of metric_name_set rows.
+func (db *cassandraDatabase) shardCount() int {
+	if db.shards < 1 {
+		return 1
+	}
+	return db.shards
+}
+
+// shard returns the metric_name_set row which holds the metric key.
+func (db *cassandraDatabase) shard(metricKey api.MetricKey) int {
+	if db.shardCount() == 1 {
+		return 0
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(metricKey))
+	return int(hash.Sum32() % uint32(db.shardCount()))
+}
+
 // AddMetricName inserts the metric to Cassandra.
 func (db *cassandraDatabase) AddMetricName(metricKey api.MetricKey, tagSet api.TagSet) error {
 	if err := db.session.Query("INSERT INTO metric_names (metric_key, tag_set) VALUES (?, ?)", metricKey, tagSet.Serialize()).Exec(); err != nil {
 		return err
 	}
-	if err := db.session.Query("UPDATE metric_name_set SET metric_names = metric_names + ? WHERE shard = ?", []string{string(metricKey)}, 0).Exec(); err != nil {
+	if err := db.session.Query("UPDATE metric_name_set SET metric_names = metric_names + ? WHERE shard = ?", []string{string(metricKey)}, db.shard(metricKey)).Exec(); err != nil {
 		return err
 	}
 	return nil
@@ -148,7 +447,7 @@ func (db *cassandraDatabase) AddMetricNames(metrics []api.TaggedMetric) error {
 		boundQuery = db.session.Bind(queryUpdate, func(q *gocql.QueryInfo) ([]interface{}, error) {
 			return []interface{}{
 				[]string{string(m.MetricKey)},
-				0,
+				db.shard(m.MetricKey),
 			}, nil
 		})
 		boundQuery.Consistency(gocql.One)
@@ -161,6 +460,124 @@ func (db *cassandraDatabase) AddMetricNames(metrics []api.TaggedMetric) error {
 	return nil
 }
 
+// statement is a single CQL statement and its arguments.
+type statement struct {
+	query     string
+	arguments []interface{}
+}
+
+// PlanBatches groups the statements which write the metrics by the partition
+// they modify, and splits each group into batches of at most batchSize
+// statements. Additions to the same tag_index or metric_name_set row are
+// merged into a single statement. When the database tracks activity, each
+// tagset records now as its last-seen time. Every entry is written with the
+// database's TTL.
+func (db *cassandraDatabase) PlanBatches(metrics []api.TaggedMetric, batchSize int, now time.Time) [][]statement {
+	ttl := int(db.ttl / time.Second)
+	partitions := map[string][]statement{} // table and partition key => statements
+	order := []string{}                    // partitions in the order they were first seen
+	appendStatement := func(partition string, s statement) {
+		if _, ok := partitions[partition]; !ok {
+			order = append(order, partition)
+		}
+		partitions[partition] = append(partitions[partition], s)
+	}
+
+	type tagPair struct {
+		key   string
+		value string
+	}
+	tagIndex := map[tagPair][]string{} // tag key-value pair => metric keys
+	tagOrder := []tagPair{}
+	shards := map[int][]string{} // shard => metric keys
+	shardOrder := []int{}
+	indexed := map[tagPair]map[api.MetricKey]bool{}
+	named := map[api.MetricKey]bool{}
+	for _, metric := range metrics {
+		if db.lastSeen {
+			appendStatement("metric_names\x00"+string(metric.MetricKey), statement{
+				query:     "INSERT INTO metric_names (metric_key, tag_set, last_seen) VALUES (?, ?, ?) USING TTL ?",
+				arguments: []interface{}{metric.MetricKey, metric.TagSet.Serialize(), now, ttl},
+			})
+		} else {
+			appendStatement("metric_names\x00"+string(metric.MetricKey), statement{
+				query:     "INSERT INTO metric_names (metric_key, tag_set) VALUES (?, ?) USING TTL ?",
+				arguments: []interface{}{metric.MetricKey, metric.TagSet.Serialize(), ttl},
+			})
+		}
+		keys := make([]string, 0, len(metric.TagSet))
+		for key := range metric.TagSet {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			pair := tagPair{key, metric.TagSet[key]}
+			if indexed[pair][metric.MetricKey] {
+				continue
+			}
+			if indexed[pair] == nil {
+				indexed[pair] = map[api.MetricKey]bool{}
+				tagOrder = append(tagOrder, pair)
+			}
+			indexed[pair][metric.MetricKey] = true
+			tagIndex[pair] = append(tagIndex[pair], string(metric.MetricKey))
+		}
+		if !named[metric.MetricKey] {
+			named[metric.MetricKey] = true
+			shard := db.shard(metric.MetricKey)
+			if _, ok := shards[shard]; !ok {
+				shardOrder = append(shardOrder, shard)
+			}
+			shards[shard] = append(shards[shard], string(metric.MetricKey))
+		}
+	}
+	for _, pair := range tagOrder {
+		appendStatement("tag_index\x00"+pair.key, statement{
+			query:     "UPDATE tag_index USING TTL ? SET metric_keys = metric_keys + ? WHERE tag_key = ? AND tag_value = ?",
+			arguments: []interface{}{ttl, tagIndex[pair], pair.key, pair.value},
+		})
+	}
+	for _, shard := range shardOrder {
+		appendStatement("metric_name_set\x00"+strconv.Itoa(shard), statement{
+			query:     "UPDATE metric_name_set USING TTL ? SET metric_names = metric_names + ? WHERE shard = ?",
+			arguments: []interface{}{ttl, shards[shard], shard},
+		})
+	}
+
+	batches := [][]statement{}
+	for _, partition := range order {
+		statements := partitions[partition]
+		for start := 0; start < len(statements); start += batchSize {
+			end := start + batchSize
+			if end > len(statements) {
+				end = len(statements)
+			}
+			batches = append(batches, statements[start:end])
+		}
+	}
+	return batches
+}
+
+// WriteBatches executes each batch as an unlogged batch, with at most
+// concurrency batches in flight at once.
+func (db *cassandraDatabase) WriteBatches(batches [][]statement, concurrency int) error {
+	queue := tasks.NewParallelQueue(concurrency, context.Background())
+	for _, statements := range batches {
+		statements := statements
+		queue.Do(func() error {
+			if len(statements) == 1 {
+				return db.session.Query(statements[0].query, statements[0].arguments...).Exec()
+			}
+			batch := db.session.NewBatch(gocql.UnloggedBatch)
+			for _, s := range statements {
+				batch.Query(s.query, s.arguments...)
+			}
+			return db.session.ExecuteBatch(batch)
+		})
+	}
+	return queue.Wait()
+}
+
 func (db *cassandraDatabase) AddToTagIndex(tagKey string, tagValue string, metricKey api.MetricKey) error {
 	err := db.session.Query(
 		"UPDATE tag_index SET metric_keys = metric_keys + ? WHERE tag_key = ? AND tag_value = ?",
@@ -194,6 +611,27 @@ func (db *cassandraDatabase) GetTagSet(metricKey api.MetricKey) ([]api.TagSet, e
 	return tags, nil
 }
 
+// GetLastSeen returns when each tagset of the metric was last written, by
+// serialized tagset. Tagsets without a last-seen time are left out.
+func (db *cassandraDatabase) GetLastSeen(metricKey api.MetricKey) (map[string]time.Time, error) {
+	lastSeen := map[string]time.Time{}
+	rawTag := ""
+	seen := time.Time{}
+	iterator := db.session.Query(
+		"SELECT tag_set, last_seen FROM metric_names WHERE metric_key = ?",
+		metricKey,
+	).Iter()
+	for iterator.Scan(&rawTag, &seen) {
+		if !seen.IsZero() {
+			lastSeen[rawTag] = seen
+		}
+	}
+	if err := iterator.Close(); err != nil {
+		return nil, err
+	}
+	return lastSeen, nil
+}
+
 func (db *cassandraDatabase) GetMetricKeys(tagKey string, tagValue string) ([]api.MetricKey, error) {
 	var keys []api.MetricKey
 	err := db.session.Query(
@@ -210,15 +648,124 @@ func (db *cassandraDatabase) GetMetricKeys(tagKey string, tagValue string) ([]ap
 	return keys, nil
 }
 
+// GetAllMetrics reads every shard of metric_name_set concurrently, returning
+// the metric keys in sorted order.
 func (db *cassandraDatabase) GetAllMetrics() ([]api.MetricKey, error) {
-	var keys []api.MetricKey
-	err := db.session.Query("SELECT metric_names FROM metric_name_set WHERE shard = ?", 0).Scan(&keys)
+	shards := db.shardCount()
+	if shards == 1 {
+		return db.getMetricNameShard(0)
+	}
+	concurrency := shards
+	if concurrency > maxShardReads {
+		concurrency = maxShardReads
+	}
+	queue := tasks.NewParallelQueue(concurrency, context.Background())
+	seen := map[api.MetricKey]bool{} // a name may be in two shards while they're being migrated
+	for shard := 0; shard < shards; shard++ {
+		shard := shard
+		queue.Do(func() error {
+			keys, err := db.getMetricNameShard(shard)
+			if err != nil {
+				return err
+			}
+			queue.Lock()
+			defer queue.Unlock()
+			for _, key := range keys {
+				seen[key] = true
+			}
+			return nil
+		})
+	}
+	if err := queue.Wait(); err != nil {
+		return nil, err
+	}
+	keys := make([]api.MetricKey, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Sort(api.MetricKeys(keys))
+	return keys, nil
+}
+
+// getMetricNameShard reads a single row of metric_name_set. A missing row is empty.
+func (db *cassandraDatabase) getMetricNameShard(shard int) ([]api.MetricKey, error) {
+	keys := []api.MetricKey{}
+	err := db.session.Query("SELECT metric_names FROM metric_name_set WHERE shard = ?", shard).Scan(&keys)
+	if err == gocql.ErrNotFound {
+		return []api.MetricKey{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 	return keys, nil
 }
 
+// MigrateMetricNameShards moves the names in every shard row which belong to
+// another shard under the current shard count.
+func (db *cassandraDatabase) MigrateMetricNameShards() (int, error) {
+	moved := 0
+	for from := 0; from < db.shardCount(); from++ {
+		keys, err := db.getMetricNameShard(from)
+		if err != nil {
+			return moved, err
+		}
+		moving := map[int][]string{} // shard => names to move there
+		for _, key := range keys {
+			if shard := db.shard(key); shard != from {
+				moving[shard] = append(moving[shard], string(key))
+			}
+		}
+		for shard, names := range moving {
+			for start := 0; start < len(names); start += migrationChunkSize {
+				end := start + migrationChunkSize
+				if end > len(names) {
+					end = len(names)
+				}
+				chunk := names[start:end]
+				if err := db.session.Query("UPDATE metric_name_set SET metric_names = metric_names + ? WHERE shard = ?", chunk, shard).Exec(); err != nil {
+					return moved, err
+				}
+				if err := db.session.Query("UPDATE metric_name_set SET metric_names = metric_names - ? WHERE shard = ?", chunk, from).Exec(); err != nil {
+					return moved, err
+				}
+				moved += len(chunk)
+			}
+		}
+	}
+	return moved, nil
+}
+
+// RemoveMetricName deletes a single tagset of the metric.
+func (db *cassandraDatabase) RemoveMetricName(metricKey api.MetricKey, tagSet api.TagSet) error {
+	return db.session.Query(
+		"DELETE FROM metric_names WHERE metric_key = ? AND tag_set = ?",
+		metricKey,
+		tagSet.Serialize(),
+	).Exec()
+}
+
+// RemoveMetricNames deletes every tagset of the metric.
+func (db *cassandraDatabase) RemoveMetricNames(metricKey api.MetricKey) error {
+	return db.session.Query("DELETE FROM metric_names WHERE metric_key = ?", metricKey).Exec()
+}
+
+// RemoveFromMetricNameSet removes the metric key from the set of all metrics.
+// Until main/shardmigrator has run, the name may still be held in another
+// shard row, so it is removed from every row.
+func (db *cassandraDatabase) RemoveFromMetricNameSet(metricKey api.MetricKey) error {
+	for shard := 0; shard < db.shardCount(); shard++ {
+		err := db.session.Query(
+			"UPDATE metric_name_set SET metric_names = metric_names - ? WHERE shard = ?",
+			[]string{string(metricKey)},
+			shard,
+		).Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (db *cassandraDatabase) RemoveFromTagIndex(tagKey string, tagValue string, metricKey api.MetricKey) error {
 	return db.session.Query(
 		"UPDATE tag_index SET metric_keys = metric_keys - ? WHERE tag_key = ? AND tag_value = ?",
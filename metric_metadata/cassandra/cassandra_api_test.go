@@ -18,10 +18,12 @@ import (
 	"fmt"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/square/metrics/api"
 	"github.com/square/metrics/metric_metadata"
 	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
 )
 
 func clearCassandraInstance(t *testing.T, db *cassandraDatabase, metricName api.MetricKey, tagString string) {
@@ -222,3 +224,58 @@ func TestTagIndexAPI(t *testing.T) {
 		a.EqInt(len(rows), 2)
 	}
 }
+
+func TestRemoveMetricAPI(t *testing.T) {
+	a := assert.New(t)
+	cassandra, context := newCassandraAPI(t)
+	defer cleanAPI(t, cassandra)
+
+	a.CheckError(cassandra.AddMetrics([]api.TaggedMetric{
+		{MetricKey: "a.b.c", TagSet: api.TagSet{"host": "a", "dc": "east"}},
+		{MetricKey: "a.b.c", TagSet: api.TagSet{"host": "b", "dc": "east"}},
+		{MetricKey: "d.e.f", TagSet: api.TagSet{"host": "a"}},
+	}, context))
+
+	// The tag index keeps pairs still used by another tagset of the metric.
+	a.CheckError(cassandra.RemoveMetric(api.TaggedMetric{MetricKey: "a.b.c", TagSet: api.TagSet{"host": "a", "dc": "east"}}, context))
+	tagSets, err := cassandra.GetAllTags("a.b.c", context)
+	a.CheckError(err)
+	a.Eq(tagSets, []api.TagSet{{"host": "b", "dc": "east"}})
+	keys, err := cassandra.GetMetricsForTag("dc", "east", context)
+	a.CheckError(err)
+	a.Eq(keys, []api.MetricKey{"a.b.c"})
+	keys, err = cassandra.GetMetricsForTag("host", "a", context)
+	a.CheckError(err)
+	a.Eq(keys, []api.MetricKey{"d.e.f"})
+
+	a.CheckError(cassandra.RemoveMetricKey("a.b.c", context))
+	if _, err := cassandra.GetAllTags("a.b.c", context); err == nil {
+		t.Errorf("Cassandra API should error on fetching a removed metric")
+	}
+	metrics, err := cassandra.GetAllMetrics(context)
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"d.e.f"})
+}
+
+func TestFilterActiveAPI(t *testing.T) {
+	a := assert.New(t)
+	cassandra, context := newCassandraAPI(t)
+	defer cleanAPI(t, cassandra)
+	clock := mocks.NewTestClock(time.Unix(100000, 0))
+	cassandra.config.Clock = clock
+	cassandra.config.TrackActivity = true
+	cassandra.db.lastSeen = true
+	cassandra.recent.clock = clock
+
+	hostA := api.TagSet{"host": "a"}
+	hostB := api.TagSet{"host": "b"}
+	a.CheckError(cassandra.AddMetric(api.TaggedMetric{MetricKey: "a.b.c", TagSet: hostA}, context))
+	clock.Move(3 * time.Hour)
+	a.CheckError(cassandra.AddMetric(api.TaggedMetric{MetricKey: "a.b.c", TagSet: hostB}, context))
+
+	// host=a was last written more than ActivitySlack before, and host=c's activity is unknown.
+	hostC := api.TagSet{"host": "c"}
+	active, err := cassandra.FilterActive("a.b.c", []api.TagSet{hostA, hostB, hostC}, clock.Now().Add(-30*time.Minute), context)
+	a.CheckError(err)
+	a.Eq(active, []api.TagSet{hostB, hostC})
+}
@@ -17,12 +17,14 @@ package cassandra
 import (
 	"fmt"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gocql/gocql"
 	"github.com/square/metrics/api"
 	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
 )
 
 func newDatabase(t *testing.T) *cassandraDatabase {
@@ -185,3 +187,202 @@ func Test_TagIndex_DB(t *testing.T) {
 		a.EqString(string(rows[0]), "d.e.f")
 	}
 }
+
+func TestShard(t *testing.T) {
+	a := assert.New(t)
+	legacy := cassandraDatabase{}
+	a.EqInt(legacy.shardCount(), 1)
+	a.EqInt(legacy.shard("metric.a"), 0)
+
+	sharded := cassandraDatabase{shards: 8}
+	counts := make([]int, 8)
+	for i := 0; i < 1000; i++ {
+		key := api.MetricKey(fmt.Sprintf("metric.%d", i))
+		shard := sharded.shard(key)
+		if shard < 0 || shard >= 8 {
+			t.Fatalf("shard %d of %s is out of range", shard, key)
+		}
+		a.EqInt(sharded.shard(key), shard) // stable
+		counts[shard]++
+	}
+	for shard, count := range counts {
+		if count == 0 {
+			t.Errorf("no metric was assigned to shard %d", shard)
+		}
+	}
+}
+
+func Test_MigrateMetricNameShards_DB(t *testing.T) {
+	a := assert.New(t)
+	db := newDatabase(t)
+	if db == nil {
+		return
+	}
+	defer cleanDatabase(t, db)
+	expected := []api.MetricKey{}
+	for i := 0; i < 20; i++ {
+		key := api.MetricKey(fmt.Sprintf("metric.%02d", i))
+		a.CheckError(db.AddMetricName(key, api.TagSet{"foo": "a"}))
+		expected = append(expected, key)
+	}
+
+	db.shards = 4
+	keys, err := db.GetAllMetrics()
+	a.CheckError(err)
+	a.Eq(keys, expected) // the legacy row is still read
+
+	moved, err := db.MigrateMetricNameShards()
+	a.CheckError(err)
+	legacy, err := db.getMetricNameShard(0)
+	a.CheckError(err)
+	a.EqInt(moved+len(legacy), len(expected))
+	for _, key := range legacy {
+		a.EqInt(db.shard(key), 0)
+	}
+	keys, err = db.GetAllMetrics()
+	a.CheckError(err)
+	a.Eq(keys, expected)
+
+	// Migrating again moves nothing.
+	moved, err = db.MigrateMetricNameShards()
+	a.CheckError(err)
+	a.EqInt(moved, 0)
+
+	// Raising the shard count again moves names out of the old shards.
+	db.shards = 8
+	_, err = db.MigrateMetricNameShards()
+	a.CheckError(err)
+	for shard := 0; shard < 8; shard++ {
+		names, err := db.getMetricNameShard(shard)
+		a.CheckError(err)
+		for _, key := range names {
+			a.EqInt(db.shard(key), shard)
+		}
+	}
+	keys, err = db.GetAllMetrics()
+	a.CheckError(err)
+	a.Eq(keys, expected)
+}
+
+func Test_RemoveFromMetricNameSet_Unmigrated_DB(t *testing.T) {
+	a := assert.New(t)
+	db := newDatabase(t)
+	if db == nil {
+		return
+	}
+	defer cleanDatabase(t, db)
+	a.CheckError(db.AddMetricName("metric.a", api.TagSet{"foo": "a"}))
+
+	// The name is still in the legacy row, since the migration hasn't run.
+	db.shards = 4
+	a.CheckError(db.RemoveFromMetricNameSet("metric.a"))
+	keys, err := db.GetAllMetrics()
+	a.CheckError(err)
+	a.EqInt(len(keys), 0)
+}
+
+// partitionOf returns the table and partition key written by the statement.
+func partitionOf(s statement) string {
+	switch {
+	case strings.Contains(s.query, "metric_names ("):
+		return fmt.Sprintf("metric_names %v", s.arguments[0])
+	case strings.Contains(s.query, "tag_index"):
+		return fmt.Sprintf("tag_index %v", s.arguments[2])
+	default:
+		return fmt.Sprintf("metric_name_set %v", s.arguments[2])
+	}
+}
+
+func TestPlanBatches(t *testing.T) {
+	a := assert.New(t)
+	db := cassandraDatabase{shards: 2, ttl: time.Hour, lastSeen: true}
+	now := time.Unix(1000, 0)
+	batches := db.PlanBatches([]api.TaggedMetric{
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "a", "dc": "east"}},
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "b", "dc": "east"}},
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "c", "dc": "east"}},
+		{MetricKey: "memory", TagSet: api.TagSet{"host": "a"}},
+	}, 2, now)
+
+	queries := map[string]int{}
+	for _, batch := range batches {
+		if len(batch) > 2 {
+			t.Errorf("batch of %d statements exceeds the batch size", len(batch))
+		}
+		for _, s := range batch {
+			queries[s.query]++
+		}
+		// Every statement in a batch writes the same partition.
+		for _, s := range batch {
+			a.EqString(partitionOf(s), partitionOf(batch[0]))
+		}
+	}
+	a.EqInt(queries["INSERT INTO metric_names (metric_key, tag_set, last_seen) VALUES (?, ?, ?) USING TTL ?"], 4)
+	// host=a is shared by both metrics, and dc=east by all three cpu tagsets.
+	a.EqInt(queries["UPDATE tag_index USING TTL ? SET metric_keys = metric_keys + ? WHERE tag_key = ? AND tag_value = ?"], 4)
+	a.EqInt(queries["UPDATE metric_name_set USING TTL ? SET metric_names = metric_names + ? WHERE shard = ?"], len(map[int]bool{db.shard("cpu"): true, db.shard("memory"): true}))
+	for _, batch := range batches {
+		for _, s := range batch {
+			if strings.HasPrefix(s.query, "INSERT") {
+				a.Eq(s.arguments[2], now)
+				a.Eq(s.arguments[3], 3600)
+				continue
+			}
+			a.Eq(s.arguments[0], 3600)
+			if s.arguments[2] == "dc" {
+				a.Eq(s.arguments[1], []string{"cpu"})
+			}
+			if s.arguments[2] == "host" && s.arguments[3] == "a" {
+				a.Eq(s.arguments[1], []string{"cpu", "memory"})
+			}
+		}
+	}
+
+	// Without activity tracking, the last_seen column isn't written, since
+	// it may not exist.
+	db.lastSeen = false
+	for _, batch := range db.PlanBatches([]api.TaggedMetric{{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}}}, 2, now) {
+		for _, s := range batch {
+			if strings.HasPrefix(s.query, "INSERT") {
+				a.EqString(s.query, "INSERT INTO metric_names (metric_key, tag_set) VALUES (?, ?) USING TTL ?")
+				a.Eq(s.arguments, []interface{}{api.MetricKey("cpu"), "host=a", 3600})
+			}
+		}
+	}
+}
+
+func TestRecentlyWritten(t *testing.T) {
+	a := assert.New(t)
+	clock := mocks.NewTestClock(time.Unix(0, 0))
+	recent := newRecentlyWritten(3, time.Minute, clock)
+	cpuA := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}}
+	cpuB := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}}
+	memory := api.TaggedMetric{MetricKey: "memory", TagSet: api.TagSet{"host": "a"}}
+
+	a.Eq(recent.filter([]api.TaggedMetric{cpuA, cpuA, cpuB}), []api.TaggedMetric{cpuA, cpuB})
+	recent.add([]api.TaggedMetric{cpuA, cpuB})
+	a.Eq(recent.filter([]api.TaggedMetric{cpuA, memory}), []api.TaggedMetric{memory})
+
+	recent.forget(cpuA)
+	a.Eq(recent.filter([]api.TaggedMetric{cpuA, cpuB}), []api.TaggedMetric{cpuA})
+	recent.add([]api.TaggedMetric{cpuA})
+	recent.forgetKey("cpu")
+	a.EqInt(recent.count, 0)
+	a.Eq(recent.filter([]api.TaggedMetric{cpuA, cpuB}), []api.TaggedMetric{cpuA, cpuB})
+
+	// Exceeding the limit forgets everything written before.
+	recent.add([]api.TaggedMetric{cpuA, cpuB, memory})
+	a.EqInt(recent.count, 3)
+	recent.add([]api.TaggedMetric{{MetricKey: "disk", TagSet: api.TagSet{}}})
+	a.EqInt(recent.count, 1)
+	a.Eq(recent.filter([]api.TaggedMetric{cpuA}), []api.TaggedMetric{cpuA})
+
+	// Entries expire after the TTL, so that they're written again.
+	disk := api.TaggedMetric{MetricKey: "disk", TagSet: api.TagSet{}}
+	a.Eq(recent.filter([]api.TaggedMetric{disk}), []api.TaggedMetric{})
+	clock.Move(time.Minute)
+	a.Eq(recent.filter([]api.TaggedMetric{disk}), []api.TaggedMetric{disk})
+	recent.add([]api.TaggedMetric{disk})
+	a.EqInt(recent.count, 1)
+	a.Eq(recent.filter([]api.TaggedMetric{disk}), []api.TaggedMetric{})
+}
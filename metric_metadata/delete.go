@@ -0,0 +1,27 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import "github.com/square/metrics/api"
+
+// MetricDeleteAPI is an interface for removing metric metadata from the index.
+type MetricDeleteAPI interface {
+	// RemoveMetric removes a single tagset of the metric from the system.
+	RemoveMetric(metric api.TaggedMetric, context Context) error
+	// RemoveMetricKey removes the metric and all of its tagsets from the system.
+	RemoveMetricKey(metricKey api.MetricKey, context Context) error
+	// CheckHealthy checks if this MetricAPI is healthy, returning a possible error
+	CheckHealthy() error
+}
@@ -0,0 +1,532 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package disk holds an embedded, file-backed metadata.MetricAPI for
+// deployments which are too small to need Cassandra.
+//
+// New metrics are appended to a log file, which is synced before AddMetrics
+// returns. Removals are appended to the log as tombstones in the same way.
+// Once the log is long enough, the whole index is compacted into an index file
+// (written to a temporary file and renamed into place) and the log is emptied.
+// On startup the index is loaded and the log replayed; a record torn by a
+// crash at the end of the log is discarded.
+//
+// Last-seen times are only kept in memory, so after a restart every tagset is
+// treated as seen on startup. Sweeping idle tagsets compacts the index, which
+// is how their removal is persisted.
+package disk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/log"
+	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/metric_metadata/memory"
+	"github.com/square/metrics/util"
+)
+
+const (
+	indexFileName = "index"
+	logFileName   = "log"
+)
+
+// MetricMetadataAPI is a metadata API whose indexes are held in memory and
+// persisted to a directory.
+type MetricMetadataAPI struct {
+	config  Config
+	indexes *memory.MetricMetadataAPI
+
+	mutex      sync.Mutex // held while writing to the log or compacting
+	log        *os.File
+	logRecords int // the number of records in the log
+}
+
+// MetricMetadataAPI implements MetricAPI, MetricUpdateAPI, MetricDeleteAPI and MetricActivityAPI
+var _ metadata.MetricAPI = (*MetricMetadataAPI)(nil)
+var _ metadata.MetricUpdateAPI = (*MetricMetadataAPI)(nil)
+var _ metadata.MetricDeleteAPI = (*MetricMetadataAPI)(nil)
+var _ metadata.MetricActivityAPI = (*MetricMetadataAPI)(nil)
+
+// Config stores data needed to instantiate a MetricMetadataAPI.
+type Config struct {
+	Directory           string        `yaml:"directory"`            // Directory holds the index and log files (it is created if missing).
+	CompactionThreshold int           `yaml:"compaction_threshold"` // CompactionThreshold is the number of log records which triggers a compaction (default 100000).
+	TagSetTTL           time.Duration `yaml:"tagset_ttl"`           // TagSetTTL is how long a tagset may go without being added before Sweep removes it (optional).
+	SweepInterval       time.Duration `yaml:"sweep_interval"`       // SweepInterval is how often SweepPeriodically calls Sweep (default 1m).
+	ActivitySlack       time.Duration `yaml:"activity_slack"`       // ActivitySlack is how long after it was last added a tagset is still considered active (default 2h).
+
+	Clock util.Clock `yaml:"-"`
+}
+
+// NewMetricMetadataAPI opens (or creates) the metadata stored in the configured directory.
+func NewMetricMetadataAPI(config Config) (*MetricMetadataAPI, error) {
+	if config.Directory == "" {
+		return nil, fmt.Errorf("a directory is required for the file-backed metadata API")
+	}
+	if config.CompactionThreshold == 0 {
+		config.CompactionThreshold = 100000
+	}
+	if config.SweepInterval == 0 {
+		config.SweepInterval = time.Minute
+	}
+	if config.Clock == nil {
+		config.Clock = util.RealClock{}
+	}
+	if err := os.MkdirAll(config.Directory, 0755); err != nil {
+		return nil, err
+	}
+	indexes, err := memory.NewMetricMetadataAPI(memory.Config{
+		TagSetTTL:     config.TagSetTTL,
+		SweepInterval: config.SweepInterval,
+		ActivitySlack: config.ActivitySlack,
+		Clock:         config.Clock,
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &MetricMetadataAPI{
+		config:  config,
+		indexes: indexes,
+	}
+
+	// The index is only ever replaced atomically, so it must be intact.
+	if index, err := os.Open(result.path(indexFileName)); err == nil {
+		_, _, err := readRecords(index, indexes)
+		index.Close()
+		if err != nil {
+			return nil, fmt.Errorf("metadata index %s is corrupt: %s", result.path(indexFileName), err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	logFile, err := os.OpenFile(result.path(logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	valid, count, err := readRecords(logFile, indexes)
+	if err != nil {
+		// A crash can only tear the end of the log, so everything after the
+		// last complete record is discarded.
+		log.Warningf("Discarding the end of metadata log %s after offset %d: %s", result.path(logFileName), valid, err.Error())
+		if err := logFile.Truncate(valid); err != nil {
+			logFile.Close()
+			return nil, err
+		}
+	}
+	if _, err := logFile.Seek(valid, io.SeekStart); err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	result.log = logFile
+	result.logRecords = count
+	return result, nil
+}
+
+func (a *MetricMetadataAPI) path(name string) string {
+	return filepath.Join(a.config.Directory, name)
+}
+
+// AddMetric adds the metric, persisting it before returning.
+func (a *MetricMetadataAPI) AddMetric(metric api.TaggedMetric, context metadata.Context) error {
+	return a.AddMetrics([]api.TaggedMetric{metric}, context)
+}
+
+// AddMetrics adds the metrics, persisting them before returning. Metrics
+// which are already known only have their last-seen times refreshed.
+func (a *MetricMetadataAPI) AddMetrics(metrics []api.TaggedMetric, context metadata.Context) error {
+	defer context.Profiler.Record("Disk AddMetrics")()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.log == nil {
+		return fmt.Errorf("the file-backed metadata API has been closed")
+	}
+
+	added := []api.TaggedMetric{}
+	buffer := []byte{}
+	for _, metric := range metrics {
+		if a.indexes.Contains(metric) {
+			continue
+		}
+		record, err := encodeRecord(metric)
+		if err != nil {
+			return err
+		}
+		buffer = append(buffer, record...)
+		added = append(added, metric)
+	}
+	if len(added) == 0 {
+		return a.indexes.AddMetrics(metrics, metadata.Context{})
+	}
+	if err := a.appendLog(buffer); err != nil {
+		return err
+	}
+	// The metrics are only visible once they're durable.
+	if err := a.indexes.AddMetrics(metrics, metadata.Context{}); err != nil {
+		return err
+	}
+	return a.logged(len(added))
+}
+
+// appendLog writes the records to the end of the log and syncs it. It must be
+// called while holding the mutex.
+func (a *MetricMetadataAPI) appendLog(records []byte) error {
+	if _, err := a.log.Write(records); err != nil {
+		return err
+	}
+	return a.log.Sync()
+}
+
+// logged counts records appended to the log, compacting it once it reaches
+// the threshold. It must be called while holding the mutex.
+func (a *MetricMetadataAPI) logged(count int) error {
+	a.logRecords += count
+	if a.logRecords >= a.config.CompactionThreshold {
+		return a.compact()
+	}
+	return nil
+}
+
+// RemoveMetric removes a single tagset of the metric, logging a tombstone to
+// persist its removal.
+func (a *MetricMetadataAPI) RemoveMetric(metric api.TaggedMetric, context metadata.Context) error {
+	defer context.Profiler.Record("Disk RemoveMetric")()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.log == nil {
+		return fmt.Errorf("the file-backed metadata API has been closed")
+	}
+	if !a.indexes.Contains(metric) {
+		return nil
+	}
+	tombstone, err := encodeTombstone(metric, removeTagSet)
+	if err != nil {
+		return err
+	}
+	if err := a.appendLog(tombstone); err != nil {
+		return err
+	}
+	if err := a.indexes.RemoveMetric(metric, metadata.Context{}); err != nil {
+		return err
+	}
+	return a.logged(1)
+}
+
+// RemoveMetricKey removes the metric and all of its tagsets, logging a
+// tombstone to persist their removal.
+func (a *MetricMetadataAPI) RemoveMetricKey(metricKey api.MetricKey, context metadata.Context) error {
+	defer context.Profiler.Record("Disk RemoveMetricKey")()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.log == nil {
+		return fmt.Errorf("the file-backed metadata API has been closed")
+	}
+	if _, err := a.indexes.GetAllTags(metricKey, metadata.Context{}); err != nil {
+		return nil // the metric is already missing
+	}
+	tombstone, err := encodeTombstone(api.TaggedMetric{MetricKey: metricKey, TagSet: api.NewTagSet()}, removeMetricKey)
+	if err != nil {
+		return err
+	}
+	if err := a.appendLog(tombstone); err != nil {
+		return err
+	}
+	if err := a.indexes.RemoveMetricKey(metricKey, metadata.Context{}); err != nil {
+		return err
+	}
+	return a.logged(1)
+}
+
+// Compact writes every metric to a new index file and empties the log.
+func (a *MetricMetadataAPI) Compact() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.log == nil {
+		return fmt.Errorf("the file-backed metadata API has been closed")
+	}
+	return a.compact()
+}
+
+// Sweep removes the tagsets which have been idle for longer than TagSetTTL,
+// compacting the index to persist their removal. It returns how many were
+// removed, and does nothing if no TTL is configured.
+func (a *MetricMetadataAPI) Sweep() (int, error) {
+	if a.config.TagSetTTL == 0 {
+		return 0, nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.log == nil {
+		return 0, fmt.Errorf("the file-backed metadata API has been closed")
+	}
+	removed := a.indexes.ExpireIdle(a.config.Clock.Now().Add(-a.config.TagSetTTL))
+	if removed == 0 {
+		return 0, nil
+	}
+	log.Infof("Expired %d idle tagsets from the file-backed metadata API", removed)
+	return removed, a.compact()
+}
+
+// SweepPeriodically calls Sweep every SweepInterval, logging any errors. It
+// never returns, so it should be run in its own goroutine.
+func (a *MetricMetadataAPI) SweepPeriodically() {
+	for range time.Tick(a.config.SweepInterval) {
+		if _, err := a.Sweep(); err != nil {
+			log.Errorf("Error sweeping idle metadata: %s", err.Error())
+		}
+	}
+}
+
+// compact must be called while holding the mutex.
+func (a *MetricMetadataAPI) compact() error {
+	temporary, err := ioutil.TempFile(a.config.Directory, indexFileName+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := a.writeIndex(temporary); err != nil {
+		temporary.Close()
+		os.Remove(temporary.Name())
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+	if err := os.Rename(temporary.Name(), a.path(indexFileName)); err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+	// The rename must be durable before the log is emptied, or a crash could
+	// bring back the old index without the log records it was missing.
+	if err := syncDirectory(a.config.Directory); err != nil {
+		return err
+	}
+	// A crash before the log is emptied just replays records already in the
+	// index, which changes nothing.
+	if err := a.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := a.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	a.logRecords = 0
+	return a.log.Sync()
+}
+
+// syncDirectory syncs the directory, persisting the files renamed into it.
+func syncDirectory(path string) error {
+	directory, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := directory.Sync(); err != nil {
+		directory.Close()
+		return err
+	}
+	return directory.Close()
+}
+
+func (a *MetricMetadataAPI) writeIndex(file *os.File) error {
+	writer := bufio.NewWriter(file)
+	metricKeys, err := a.indexes.GetAllMetrics(metadata.Context{})
+	if err != nil {
+		return err
+	}
+	for _, metricKey := range metricKeys {
+		tagSets, err := a.indexes.GetAllTags(metricKey, metadata.Context{})
+		if err != nil {
+			return err
+		}
+		for _, tagSet := range tagSets {
+			record, err := encodeRecord(api.TaggedMetric{MetricKey: metricKey, TagSet: tagSet})
+			if err != nil {
+				return err
+			}
+			if _, err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Close closes the log. The API cannot be updated afterwards.
+func (a *MetricMetadataAPI) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.log == nil {
+		return nil
+	}
+	err := a.log.Close()
+	a.log = nil
+	return err
+}
+
+// GetAllTags returns the tagsets of the metric, or a NoSuchMetricError.
+func (a *MetricMetadataAPI) GetAllTags(metricKey api.MetricKey, context metadata.Context) ([]api.TagSet, error) {
+	defer context.Profiler.Record("Disk GetAllTags")()
+	return a.indexes.GetAllTags(metricKey, metadata.Context{})
+}
+
+// GetAllMetrics returns every metric key, in sorted order.
+func (a *MetricMetadataAPI) GetAllMetrics(context metadata.Context) ([]api.MetricKey, error) {
+	defer context.Profiler.Record("Disk GetAllMetrics")()
+	return a.indexes.GetAllMetrics(metadata.Context{})
+}
+
+// GetMetricsForTag returns the metric keys with the tag key-value pair, in sorted order.
+func (a *MetricMetadataAPI) GetMetricsForTag(tagKey, tagValue string, context metadata.Context) ([]api.MetricKey, error) {
+	defer context.Profiler.Record("Disk GetMetricsForTag")()
+	return a.indexes.GetMetricsForTag(tagKey, tagValue, metadata.Context{})
+}
+
+// FilterActive returns the tagsets which may have been active since the given time.
+func (a *MetricMetadataAPI) FilterActive(metricKey api.MetricKey, tagSets []api.TagSet, since time.Time, context metadata.Context) ([]api.TagSet, error) {
+	defer context.Profiler.Record("Disk FilterActive")()
+	return a.indexes.FilterActive(metricKey, tagSets, since, metadata.Context{})
+}
+
+// CheckHealthy checks that the log is still open.
+func (a *MetricMetadataAPI) CheckHealthy() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.log == nil {
+		return fmt.Errorf("the file-backed metadata API has been closed")
+	}
+	return nil
+}
+
+// Records
+// -------
+
+// A record is one line holding the CRC32 of its payload in hexadecimal, a
+// space, and the payload: the JSON array [metric key, serialized tagset]. A
+// tombstone has the kind of removal as a third element; removeMetricKey
+// tombstones have an empty tagset.
+
+const (
+	removeTagSet    = "remove"     // removeTagSet tombstones remove a single tagset.
+	removeMetricKey = "remove_key" // removeMetricKey tombstones remove the metric and all of its tagsets.
+)
+
+// record is a decoded record.
+type record struct {
+	metric  api.TaggedMetric
+	removal string // removal is empty for additions
+}
+
+func encodeRecord(metric api.TaggedMetric) ([]byte, error) {
+	return encodePayload([]string{string(metric.MetricKey), metric.TagSet.Serialize()})
+}
+
+func encodeTombstone(metric api.TaggedMetric, removal string) ([]byte, error) {
+	return encodePayload([]string{string(metric.MetricKey), metric.TagSet.Serialize(), removal})
+}
+
+func encodePayload(fields []string) ([]byte, error) {
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)), nil
+}
+
+func decodeRecord(line string) (record, error) {
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return record{}, fmt.Errorf("malformed record %q", line)
+	}
+	checksum, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return record{}, fmt.Errorf("malformed checksum in record %q", line)
+	}
+	if uint32(checksum) != crc32.ChecksumIEEE([]byte(parts[1])) {
+		return record{}, fmt.Errorf("checksum mismatch in record %q", line)
+	}
+	var payload []string
+	if err := json.Unmarshal([]byte(parts[1]), &payload); err != nil || len(payload) < 2 || len(payload) > 3 {
+		return record{}, fmt.Errorf("malformed payload in record %q", line)
+	}
+	removal := ""
+	if len(payload) == 3 {
+		removal = payload[2]
+		if removal != removeTagSet && removal != removeMetricKey {
+			return record{}, fmt.Errorf("unknown removal in record %q", line)
+		}
+	}
+	tagSet := api.NewTagSet() // ParseTagSet rejects the empty tagset.
+	if payload[1] != "" {
+		tagSet = api.ParseTagSet(payload[1])
+		if tagSet == nil {
+			return record{}, fmt.Errorf("malformed tagset in record %q", line)
+		}
+	}
+	return record{metric: api.TaggedMetric{MetricKey: api.MetricKey(payload[0]), TagSet: tagSet}, removal: removal}, nil
+}
+
+// apply adds the record's metric to the indexes, or removes it for a tombstone.
+func (r record) apply(indexes *memory.MetricMetadataAPI) error {
+	switch r.removal {
+	case removeTagSet:
+		return indexes.RemoveMetric(r.metric, metadata.Context{})
+	case removeMetricKey:
+		return indexes.RemoveMetricKey(r.metric.MetricKey, metadata.Context{})
+	}
+	return indexes.AddMetric(r.metric, metadata.Context{})
+}
+
+// readRecords applies each record in the file to the indexes. It returns the
+// offset just past the last valid record and the number of valid records,
+// along with an error describing the first invalid one (if any).
+func readRecords(file *os.File, indexes *memory.MetricMetadataAPI) (int64, int, error) {
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	count := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if line != "" {
+				return offset, count, fmt.Errorf("incomplete record %q", line)
+			}
+			return offset, count, nil
+		}
+		if err != nil {
+			return offset, count, err
+		}
+		record, err := decodeRecord(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return offset, count, err
+		}
+		if err := record.apply(indexes); err != nil {
+			return offset, count, err
+		}
+		offset += int64(len(line))
+		count++
+	}
+}
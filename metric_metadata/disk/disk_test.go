@@ -0,0 +1,219 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+)
+
+func tempDirectory(t *testing.T) string {
+	directory, err := ioutil.TempDir("", "disk-metadata")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory: %s", err.Error())
+	}
+	return directory
+}
+
+func open(t *testing.T, config Config) *MetricMetadataAPI {
+	result, err := NewMetricMetadataAPI(config)
+	if err != nil {
+		t.Fatalf("Unexpected error opening metadata: %s", err.Error())
+	}
+	return result
+}
+
+func checkTags(a assert.Assert, metadataAPI *MetricMetadataAPI, metricKey api.MetricKey, expected []api.TagSet) {
+	tagSets, err := metadataAPI.GetAllTags(metricKey, metadata.Context{})
+	a.CheckError(err)
+	a.Eq(tagSets, expected)
+}
+
+func TestPersistence(t *testing.T) {
+	a := assert.New(t)
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+	config := Config{Directory: filepath.Join(directory, "metadata")}
+
+	metadataAPI := open(t, config)
+	a.CheckError(metadataAPI.AddMetrics([]api.TaggedMetric{
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}},
+	}, metadata.Context{}))
+	a.CheckError(metadataAPI.AddMetric(api.TaggedMetric{MetricKey: "uptime", TagSet: api.TagSet{}}, metadata.Context{}))
+	a.CheckError(metadataAPI.AddMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}}, metadata.Context{}))
+	a.EqInt(metadataAPI.logRecords, 3) // duplicates aren't logged
+	a.CheckError(metadataAPI.Close())
+	if err := metadataAPI.AddMetric(api.TaggedMetric{MetricKey: "cpu"}, metadata.Context{}); err == nil {
+		t.Errorf("expected an error adding to a closed API")
+	}
+
+	reopened := open(t, config)
+	defer reopened.Close()
+	checkTags(a, reopened, "cpu", []api.TagSet{{"host": "a"}, {"host": "b"}})
+	checkTags(a, reopened, "uptime", []api.TagSet{{}})
+	metrics, err := reopened.GetMetricsForTag("host", "b", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"cpu"})
+
+	_, err = reopened.GetAllTags("missing", metadata.Context{})
+	if _, ok := err.(metadata.NoSuchMetricError); !ok {
+		t.Errorf("expected a NoSuchMetricError for a missing metric, but got %#v", err)
+	}
+}
+
+func TestTornLog(t *testing.T) {
+	a := assert.New(t)
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+	config := Config{Directory: directory}
+
+	metadataAPI := open(t, config)
+	a.CheckError(metadataAPI.AddMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}}, metadata.Context{}))
+	a.CheckError(metadataAPI.Close())
+
+	// Simulate a crash partway through appending a record.
+	record, err := encodeRecord(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}})
+	a.CheckError(err)
+	logFile, err := os.OpenFile(filepath.Join(directory, logFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	a.CheckError(err)
+	_, err = logFile.Write(record[:len(record)/2])
+	a.CheckError(err)
+	a.CheckError(logFile.Close())
+
+	recovered := open(t, config)
+	checkTags(a, recovered, "cpu", []api.TagSet{{"host": "a"}})
+	// New records are appended after the last complete one.
+	a.CheckError(recovered.AddMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "c"}}, metadata.Context{}))
+	a.CheckError(recovered.Close())
+
+	reopened := open(t, config)
+	defer reopened.Close()
+	checkTags(a, reopened, "cpu", []api.TagSet{{"host": "a"}, {"host": "c"}})
+}
+
+func TestCompaction(t *testing.T) {
+	a := assert.New(t)
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+	config := Config{Directory: directory, CompactionThreshold: 3}
+
+	metadataAPI := open(t, config)
+	for _, host := range []string{"a", "b", "c", "d"} {
+		a.CheckError(metadataAPI.AddMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": host}}, metadata.Context{}))
+	}
+	// The third record triggered a compaction, leaving only the fourth in the log.
+	a.EqInt(metadataAPI.logRecords, 1)
+	a.CheckError(metadataAPI.Close())
+
+	reopened := open(t, config)
+	checkTags(a, reopened, "cpu", []api.TagSet{{"host": "a"}, {"host": "b"}, {"host": "c"}, {"host": "d"}})
+	a.CheckError(reopened.Compact())
+	a.EqInt(reopened.logRecords, 0)
+	a.CheckError(reopened.Close())
+
+	// A corrupt index is an error rather than silently losing metrics.
+	a.CheckError(ioutil.WriteFile(filepath.Join(directory, indexFileName), []byte("00000000 [\"cpu\", \"host=a\"]\n"), 0644))
+	if _, err := NewMetricMetadataAPI(config); err == nil {
+		t.Errorf("expected an error opening a corrupt index")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	a := assert.New(t)
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+	clock := mocks.NewTestClock(time.Unix(100000, 0))
+	config := Config{Directory: directory, TagSetTTL: time.Hour, Clock: clock}
+
+	metadataAPI := open(t, config)
+	a.CheckError(metadataAPI.AddMetrics([]api.TaggedMetric{
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}},
+	}, metadata.Context{}))
+	clock.Move(40 * time.Minute)
+	// Adding a known metric again refreshes it without logging it twice.
+	a.CheckError(metadataAPI.AddMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}}, metadata.Context{}))
+	a.EqInt(metadataAPI.logRecords, 2)
+
+	clock.Move(40 * time.Minute)
+	removed, err := metadataAPI.Sweep()
+	a.CheckError(err)
+	a.EqInt(removed, 1)
+	checkTags(a, metadataAPI, "cpu", []api.TagSet{{"host": "b"}})
+	a.EqInt(metadataAPI.logRecords, 0) // the removal was compacted into the index
+	a.CheckError(metadataAPI.Close())
+
+	reopened := open(t, config)
+	checkTags(a, reopened, "cpu", []api.TagSet{{"host": "b"}})
+	a.CheckError(reopened.Close())
+}
+
+func TestRemove(t *testing.T) {
+	a := assert.New(t)
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+	config := Config{Directory: directory}
+
+	metadataAPI := open(t, config)
+	a.CheckError(metadataAPI.AddMetrics([]api.TaggedMetric{
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}},
+		{MetricKey: "uptime", TagSet: api.TagSet{"host": "a"}},
+	}, metadata.Context{}))
+	a.CheckError(metadataAPI.RemoveMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}}, metadata.Context{}))
+	a.CheckError(metadataAPI.RemoveMetricKey("uptime", metadata.Context{}))
+	// Removing missing metrics does nothing.
+	a.CheckError(metadataAPI.RemoveMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "z"}}, metadata.Context{}))
+	a.CheckError(metadataAPI.RemoveMetricKey("missing", metadata.Context{}))
+	checkTags(a, metadataAPI, "cpu", []api.TagSet{{"host": "b"}})
+	// The removals are logged as tombstones rather than rewriting the index.
+	a.EqInt(metadataAPI.logRecords, 5)
+	if _, err := os.Stat(filepath.Join(directory, indexFileName)); !os.IsNotExist(err) {
+		t.Errorf("expected no index to be written, but got %#v", err)
+	}
+	a.CheckError(metadataAPI.Close())
+
+	reopened := open(t, config)
+	checkTags(a, reopened, "cpu", []api.TagSet{{"host": "b"}})
+	if _, err := reopened.GetAllTags("uptime", metadata.Context{}); err == nil {
+		t.Errorf("expected an error for a removed metric")
+	}
+	// A removed tagset can be added again after its tombstone.
+	a.CheckError(reopened.AddMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}}, metadata.Context{}))
+	a.CheckError(reopened.Close())
+
+	replayed := open(t, config)
+	checkTags(a, replayed, "cpu", []api.TagSet{{"host": "a"}, {"host": "b"}})
+	// Compaction drops the removed metrics from the index.
+	a.CheckError(replayed.Compact())
+	a.CheckError(replayed.Close())
+
+	compacted := open(t, config)
+	defer compacted.Close()
+	a.EqInt(compacted.logRecords, 0)
+	checkTags(a, compacted, "cpu", []api.TagSet{{"host": "a"}, {"host": "b"}})
+	if _, err := compacted.GetAllTags("uptime", metadata.Context{}); err == nil {
+		t.Errorf("expected an error for a removed metric")
+	}
+}
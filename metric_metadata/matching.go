@@ -0,0 +1,30 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/query/predicate"
+)
+
+// MetricMatchingAPI is an optional extension of MetricAPI for backends which
+// can use their indexes to narrow down the tagsets satisfying a predicate.
+// Callers should fall back to GetAllTags when it isn't implemented.
+type MetricMatchingAPI interface {
+	MetricAPI
+	// GetTagsMatching retrieves the tagsets of the given metric which satisfy
+	// the predicate. Like GetAllTags, it fails if the metric doesn't exist.
+	GetTagsMatching(metricKey api.MetricKey, predicate predicate.Predicate, context Context) ([]api.TagSet, error)
+}
@@ -0,0 +1,440 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory holds an in-memory metadata.MetricAPI which can optionally
+// be snapshotted to a local file, for running MQE without Cassandra.
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/log"
+	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/util"
+)
+
+// MetricMetadataAPI holds metric metadata in memory, indexed both from metric
+// keys to tagsets and from tag key-value pairs to metric keys. It also records
+// when each tagset was last added, so that idle tagsets can be expired.
+type MetricMetadataAPI struct {
+	config Config
+
+	mutex      sync.RWMutex
+	tagSets    map[api.MetricKey]map[string]api.TagSet // metric key => serialized tagset => tagset
+	lastSeen   map[api.MetricKey]map[string]time.Time  // metric key => serialized tagset => when it was last added
+	tagIndex   map[tagPair]map[api.MetricKey]int       // tag key-value pair => metric key => number of its tagsets with the pair
+	generation uint64                                  // incremented by every change
+
+	snapshotMutex sync.Mutex // held while saving a snapshot
+	saved         uint64     // the generation of the last snapshot, guarded by snapshotMutex
+}
+
+// MetricMetadataAPI implements MetricAPI, MetricUpdateAPI, MetricDeleteAPI and MetricActivityAPI
+var _ metadata.MetricAPI = (*MetricMetadataAPI)(nil)
+var _ metadata.MetricUpdateAPI = (*MetricMetadataAPI)(nil)
+var _ metadata.MetricDeleteAPI = (*MetricMetadataAPI)(nil)
+var _ metadata.MetricActivityAPI = (*MetricMetadataAPI)(nil)
+
+// Config stores data needed to instantiate a MetricMetadataAPI.
+type Config struct {
+	// SnapshotPath is the file that the metadata is loaded from on startup and
+	// saved to by Snapshot (optional).
+	SnapshotPath string `yaml:"snapshot_path"`
+	// SnapshotInterval is how often SnapshotPeriodically saves the metadata (default 1m).
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+	// TagSetTTL is how long a tagset may go without being added again before
+	// Sweep removes it (optional; by default tagsets never expire).
+	TagSetTTL time.Duration `yaml:"tagset_ttl"`
+	// SweepInterval is how often SweepPeriodically calls Sweep (default 1m).
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+	// ActivitySlack is how long after it was last added a tagset is still
+	// considered active by FilterActive. It should exceed how often producers
+	// add their metrics again (default 2h).
+	ActivitySlack time.Duration `yaml:"activity_slack"`
+
+	Clock util.Clock `yaml:"-"`
+}
+
+type tagPair struct {
+	key   string
+	value string
+}
+
+// snapshot is the JSON format of a snapshot file: each metric key maps to
+// its serialized tagsets, and to when each of them was last added (in
+// milliseconds since the epoch).
+type snapshot struct {
+	Metrics  map[api.MetricKey][]string         `json:"metrics"`
+	LastSeen map[api.MetricKey]map[string]int64 `json:"last_seen,omitempty"`
+}
+
+// NewMetricMetadataAPI creates an empty MetricMetadataAPI, loading the
+// snapshot file if one is configured and exists.
+func NewMetricMetadataAPI(config Config) (*MetricMetadataAPI, error) {
+	if config.SnapshotInterval == 0 {
+		config.SnapshotInterval = time.Minute
+	}
+	if config.SweepInterval == 0 {
+		config.SweepInterval = time.Minute
+	}
+	if config.ActivitySlack == 0 {
+		config.ActivitySlack = 2 * time.Hour
+	}
+	if config.Clock == nil {
+		config.Clock = util.RealClock{}
+	}
+	result := &MetricMetadataAPI{
+		config:   config,
+		tagSets:  map[api.MetricKey]map[string]api.TagSet{},
+		lastSeen: map[api.MetricKey]map[string]time.Time{},
+		tagIndex: map[tagPair]map[api.MetricKey]int{},
+	}
+	if config.SnapshotPath == "" {
+		return result, nil
+	}
+	contents, err := ioutil.ReadFile(config.SnapshotPath)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var loaded snapshot
+	if err := json.Unmarshal(contents, &loaded); err != nil {
+		return nil, fmt.Errorf("cannot read metadata snapshot %s: %s", config.SnapshotPath, err.Error())
+	}
+	// Tagsets saved without a last-seen time are treated as seen on startup.
+	now := config.Clock.Now()
+	for metricKey, serialized := range loaded.Metrics {
+		for _, raw := range serialized {
+			tagSet := api.ParseTagSet(raw)
+			if raw == "" {
+				tagSet = api.NewTagSet() // ParseTagSet rejects the empty tagset.
+			}
+			if tagSet == nil {
+				return nil, fmt.Errorf("cannot read metadata snapshot %s: invalid tagset %q for metric %s", config.SnapshotPath, raw, metricKey)
+			}
+			seen := now
+			if millis, ok := loaded.LastSeen[metricKey][raw]; ok {
+				seen = time.Unix(0, millis*1e6)
+			}
+			result.add(api.TaggedMetric{MetricKey: metricKey, TagSet: tagSet}, seen)
+		}
+	}
+	result.saved = result.generation
+	return result, nil
+}
+
+// add indexes the metric, recording when it was seen. The caller must hold
+// the write lock.
+func (a *MetricMetadataAPI) add(metric api.TaggedMetric, seen time.Time) {
+	serialized := metric.TagSet.Serialize()
+	tagSets, ok := a.tagSets[metric.MetricKey]
+	if !ok {
+		tagSets = map[string]api.TagSet{}
+		a.tagSets[metric.MetricKey] = tagSets
+		a.lastSeen[metric.MetricKey] = map[string]time.Time{}
+	}
+	if previous, ok := a.lastSeen[metric.MetricKey][serialized]; !ok || previous.Before(seen) {
+		a.lastSeen[metric.MetricKey][serialized] = seen
+		a.generation++
+	}
+	if _, ok := tagSets[serialized]; ok {
+		return
+	}
+	tagSets[serialized] = metric.TagSet.Clone()
+	for key, value := range metric.TagSet {
+		pair := tagPair{key, value}
+		metrics, ok := a.tagIndex[pair]
+		if !ok {
+			metrics = map[api.MetricKey]int{}
+			a.tagIndex[pair] = metrics
+		}
+		metrics[metric.MetricKey]++
+	}
+	a.generation++
+}
+
+// remove forgets a single tagset of the metric. The caller must hold the
+// write lock.
+func (a *MetricMetadataAPI) remove(metricKey api.MetricKey, serialized string) {
+	tagSet, ok := a.tagSets[metricKey][serialized]
+	if !ok {
+		return
+	}
+	delete(a.tagSets[metricKey], serialized)
+	delete(a.lastSeen[metricKey], serialized)
+	for key, value := range tagSet {
+		pair := tagPair{key, value}
+		a.tagIndex[pair][metricKey]--
+		if a.tagIndex[pair][metricKey] > 0 {
+			continue // another tagset of the metric still has the pair
+		}
+		delete(a.tagIndex[pair], metricKey)
+		if len(a.tagIndex[pair]) == 0 {
+			delete(a.tagIndex, pair)
+		}
+	}
+	if len(a.tagSets[metricKey]) == 0 {
+		delete(a.tagSets, metricKey)
+		delete(a.lastSeen, metricKey)
+	}
+	a.generation++
+}
+
+// Contains returns whether the metric has been added.
+func (a *MetricMetadataAPI) Contains(metric api.TaggedMetric) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	_, ok := a.tagSets[metric.MetricKey][metric.TagSet.Serialize()]
+	return ok
+}
+
+// AddMetric adds the metric to the indexes.
+func (a *MetricMetadataAPI) AddMetric(metric api.TaggedMetric, context metadata.Context) error {
+	return a.AddMetrics([]api.TaggedMetric{metric}, context)
+}
+
+// AddMetrics adds the metrics to the indexes.
+func (a *MetricMetadataAPI) AddMetrics(metrics []api.TaggedMetric, context metadata.Context) error {
+	defer context.Profiler.Record("Memory AddMetrics")()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := a.config.Clock.Now()
+	for _, metric := range metrics {
+		a.add(metric, now)
+	}
+	return nil
+}
+
+// RemoveMetric removes a single tagset of the metric from the indexes.
+func (a *MetricMetadataAPI) RemoveMetric(metric api.TaggedMetric, context metadata.Context) error {
+	defer context.Profiler.Record("Memory RemoveMetric")()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.remove(metric.MetricKey, metric.TagSet.Serialize())
+	return nil
+}
+
+// RemoveMetricKey removes the metric and all of its tagsets from the indexes.
+func (a *MetricMetadataAPI) RemoveMetricKey(metricKey api.MetricKey, context metadata.Context) error {
+	defer context.Profiler.Record("Memory RemoveMetricKey")()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for serialized := range a.tagSets[metricKey] {
+		a.remove(metricKey, serialized)
+	}
+	return nil
+}
+
+// FilterActive returns the tagsets which were last added no more than
+// ActivitySlack before the given time. Unknown tagsets are kept.
+func (a *MetricMetadataAPI) FilterActive(metricKey api.MetricKey, tagSets []api.TagSet, since time.Time, context metadata.Context) ([]api.TagSet, error) {
+	defer context.Profiler.Record("Memory FilterActive")()
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	threshold := since.Add(-a.config.ActivitySlack)
+	lastSeen := a.lastSeen[metricKey]
+	result := []api.TagSet{}
+	for _, tagSet := range tagSets {
+		if seen, ok := lastSeen[tagSet.Serialize()]; ok && seen.Before(threshold) {
+			continue
+		}
+		result = append(result, tagSet)
+	}
+	return result, nil
+}
+
+// ExpireIdle removes every tagset which hasn't been added since the cutoff,
+// returning how many were removed. Metrics left without tagsets are removed.
+func (a *MetricMetadataAPI) ExpireIdle(cutoff time.Time) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	removed := 0
+	for metricKey, lastSeen := range a.lastSeen {
+		for serialized, seen := range lastSeen {
+			if seen.Before(cutoff) {
+				a.remove(metricKey, serialized)
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// Sweep removes the tagsets which have been idle for longer than TagSetTTL,
+// returning how many were removed. It does nothing if no TTL is configured.
+func (a *MetricMetadataAPI) Sweep() int {
+	if a.config.TagSetTTL == 0 {
+		return 0
+	}
+	removed := a.ExpireIdle(a.config.Clock.Now().Add(-a.config.TagSetTTL))
+	if removed != 0 {
+		log.Infof("Expired %d idle tagsets from the in-memory metadata API", removed)
+	}
+	return removed
+}
+
+// SweepPeriodically calls Sweep every SweepInterval. It never returns, so it
+// should be run in its own goroutine.
+func (a *MetricMetadataAPI) SweepPeriodically() {
+	for range time.Tick(a.config.SweepInterval) {
+		a.Sweep()
+	}
+}
+
+// GetAllTags returns the tagsets of the metric, or a NoSuchMetricError.
+func (a *MetricMetadataAPI) GetAllTags(metricKey api.MetricKey, context metadata.Context) ([]api.TagSet, error) {
+	defer context.Profiler.Record("Memory GetAllTags")()
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	tagSets, ok := a.tagSets[metricKey]
+	if !ok {
+		return nil, metadata.NewNoSuchMetricError(string(metricKey))
+	}
+	serialized := make([]string, 0, len(tagSets))
+	for raw := range tagSets {
+		serialized = append(serialized, raw)
+	}
+	sort.Strings(serialized)
+	result := make([]api.TagSet, len(serialized))
+	for i, raw := range serialized {
+		result[i] = tagSets[raw].Clone()
+	}
+	return result, nil
+}
+
+// GetAllMetrics returns every metric key, in sorted order.
+func (a *MetricMetadataAPI) GetAllMetrics(context metadata.Context) ([]api.MetricKey, error) {
+	defer context.Profiler.Record("Memory GetAllMetrics")()
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	keys := make([]string, 0, len(a.tagSets))
+	for metricKey := range a.tagSets {
+		keys = append(keys, string(metricKey))
+	}
+	return sortedMetricKeys(keys), nil
+}
+
+// GetMetricsForTag returns the metric keys which have a tagset with the given
+// tag key-value pair, in sorted order.
+func (a *MetricMetadataAPI) GetMetricsForTag(tagKey, tagValue string, context metadata.Context) ([]api.MetricKey, error) {
+	defer context.Profiler.Record("Memory GetMetricsForTag")()
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	metrics := a.tagIndex[tagPair{tagKey, tagValue}]
+	keys := make([]string, 0, len(metrics))
+	for metricKey := range metrics {
+		keys = append(keys, string(metricKey))
+	}
+	return sortedMetricKeys(keys), nil
+}
+
+// CheckHealthy always succeeds, since the metadata is in memory.
+func (a *MetricMetadataAPI) CheckHealthy() error {
+	return nil
+}
+
+// Snapshot saves the metadata to the configured snapshot file, if it has
+// changed since it was loaded or last saved. The metadata is only locked for
+// reading while it is copied, not while it is written. The file is replaced
+// atomically, so a crash while saving leaves the previous snapshot intact.
+func (a *MetricMetadataAPI) Snapshot() error {
+	if a.config.SnapshotPath == "" {
+		return fmt.Errorf("no snapshot path is configured for the in-memory metadata API")
+	}
+	a.snapshotMutex.Lock()
+	defer a.snapshotMutex.Unlock()
+	saved, generation, changed := a.copySnapshot()
+	if !changed {
+		return nil
+	}
+	contents, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	temporary, err := ioutil.TempFile(filepath.Dir(a.config.SnapshotPath), filepath.Base(a.config.SnapshotPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := temporary.Write(contents); err != nil {
+		temporary.Close()
+		os.Remove(temporary.Name())
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+	if err := os.Rename(temporary.Name(), a.config.SnapshotPath); err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+	a.saved = generation
+	return nil
+}
+
+// copySnapshot copies the metadata into a snapshot under the read lock, along
+// with its generation. It reports no change if that generation has already
+// been saved. The caller must hold snapshotMutex.
+func (a *MetricMetadataAPI) copySnapshot() (snapshot, uint64, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.generation == a.saved {
+		return snapshot{}, a.generation, false
+	}
+	saved := snapshot{
+		Metrics:  map[api.MetricKey][]string{},
+		LastSeen: map[api.MetricKey]map[string]int64{},
+	}
+	for metricKey, tagSets := range a.tagSets {
+		serialized := make([]string, 0, len(tagSets))
+		lastSeen := map[string]int64{}
+		for raw := range tagSets {
+			serialized = append(serialized, raw)
+			lastSeen[raw] = a.lastSeen[metricKey][raw].UnixNano() / 1e6
+		}
+		saved.LastSeen[metricKey] = lastSeen
+		sort.Strings(serialized)
+		saved.Metrics[metricKey] = serialized
+	}
+	return saved, a.generation, true
+}
+
+// SnapshotPeriodically calls Snapshot every SnapshotInterval, logging any
+// errors. It never returns, so it should be run in its own goroutine.
+func (a *MetricMetadataAPI) SnapshotPeriodically() {
+	for range time.Tick(a.config.SnapshotInterval) {
+		if err := a.Snapshot(); err != nil {
+			log.Errorf("Error saving metadata snapshot: %s", err.Error())
+		}
+	}
+}
+
+func sortedMetricKeys(keys []string) []api.MetricKey {
+	sort.Strings(keys)
+	result := make([]api.MetricKey, len(keys))
+	for i, key := range keys {
+		result[i] = api.MetricKey(key)
+	}
+	return result
+}
@@ -0,0 +1,244 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+)
+
+var testMetrics = []api.TaggedMetric{
+	{MetricKey: "cpu", TagSet: api.TagSet{"host": "a", "dc": "north"}},
+	{MetricKey: "cpu", TagSet: api.TagSet{"host": "b", "dc": "south"}},
+	{MetricKey: "cpu", TagSet: api.TagSet{"host": "a", "dc": "north"}}, // duplicate
+	{MetricKey: "memory", TagSet: api.TagSet{"host": "a"}},
+	{MetricKey: "uptime", TagSet: api.TagSet{}},
+}
+
+func checkContents(a assert.Assert, metadataAPI *MetricMetadataAPI) {
+	metrics, err := metadataAPI.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"cpu", "memory", "uptime"})
+
+	tagSets, err := metadataAPI.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(tagSets, []api.TagSet{{"host": "a", "dc": "north"}, {"host": "b", "dc": "south"}})
+
+	tagSets, err = metadataAPI.GetAllTags("uptime", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(tagSets, []api.TagSet{{}})
+
+	metrics, err = metadataAPI.GetMetricsForTag("host", "a", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"cpu", "memory"})
+
+	metrics, err = metadataAPI.GetMetricsForTag("dc", "south", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"cpu"})
+
+	metrics, err = metadataAPI.GetMetricsForTag("dc", "east", metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(len(metrics), 0)
+}
+
+func TestMetricMetadataAPI(t *testing.T) {
+	a := assert.New(t)
+	metadataAPI, err := NewMetricMetadataAPI(Config{})
+	a.CheckError(err)
+	a.CheckError(metadataAPI.AddMetrics(testMetrics[:2], metadata.Context{}))
+	for _, metric := range testMetrics[2:] {
+		a.CheckError(metadataAPI.AddMetric(metric, metadata.Context{}))
+	}
+	checkContents(a, metadataAPI)
+	a.Eq(metadataAPI.Contains(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"dc": "south", "host": "b"}}), true)
+	a.Eq(metadataAPI.Contains(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}}), false)
+
+	if _, err := metadataAPI.GetAllTags("missing", metadata.Context{}); err == nil {
+		t.Errorf("expected an error for a missing metric")
+	} else if _, ok := err.(metadata.NoSuchMetricError); !ok {
+		t.Errorf("expected a NoSuchMetricError for a missing metric, but got %#v", err)
+	}
+
+	// Modifying the returned tagsets doesn't modify the index.
+	tagSets, err := metadataAPI.GetAllTags("memory", metadata.Context{})
+	a.CheckError(err)
+	tagSets[0]["host"] = "modified"
+	tagSets, err = metadataAPI.GetAllTags("memory", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(tagSets, []api.TagSet{{"host": "a"}})
+
+	if err := metadataAPI.Snapshot(); err == nil {
+		t.Errorf("expected an error snapshotting without a snapshot path")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	a := assert.New(t)
+	directory, err := ioutil.TempDir("", "metadata-snapshot")
+	a.CheckError(err)
+	defer os.RemoveAll(directory)
+	config := Config{SnapshotPath: filepath.Join(directory, "metadata.json")}
+
+	// A missing snapshot file starts empty.
+	original, err := NewMetricMetadataAPI(config)
+	a.CheckError(err)
+	metrics, err := original.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(len(metrics), 0)
+
+	a.CheckError(original.AddMetrics(testMetrics, metadata.Context{}))
+	a.CheckError(original.Snapshot())
+
+	loaded, err := NewMetricMetadataAPI(config)
+	a.CheckError(err)
+	checkContents(a, loaded)
+
+	// An unchanged API isn't saved again.
+	a.CheckError(os.Remove(config.SnapshotPath))
+	a.CheckError(original.Snapshot())
+	if _, err := os.Stat(config.SnapshotPath); !os.IsNotExist(err) {
+		t.Errorf("expected an unchanged API not to be saved")
+	}
+
+	// Metrics may be added while a snapshot is being saved.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			original.AddMetric(api.TaggedMetric{MetricKey: "concurrent", TagSet: api.TagSet{"index": fmt.Sprintf("%d", i)}}, metadata.Context{})
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		a.CheckError(original.Snapshot())
+	}
+	<-done
+	a.CheckError(original.Snapshot())
+	loaded, err = NewMetricMetadataAPI(config)
+	a.CheckError(err)
+	tagSets, err := loaded.GetAllTags("concurrent", metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(len(tagSets), 100)
+
+	// A corrupt snapshot is reported rather than silently discarded.
+	a.CheckError(ioutil.WriteFile(config.SnapshotPath, []byte("{not json"), 0644))
+	if _, err := NewMetricMetadataAPI(config); err == nil {
+		t.Errorf("expected an error loading a corrupt snapshot")
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	a := assert.New(t)
+	clock := mocks.NewTestClock(time.Unix(100000, 0))
+	directory, err := ioutil.TempDir("", "metadata-last-seen")
+	a.CheckError(err)
+	defer os.RemoveAll(directory)
+	config := Config{
+		SnapshotPath:  filepath.Join(directory, "metadata.json"),
+		TagSetTTL:     24 * time.Hour,
+		ActivitySlack: time.Hour,
+		Clock:         clock,
+	}
+	metadataAPI, err := NewMetricMetadataAPI(config)
+	a.CheckError(err)
+	hostA := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a", "dc": "north"}}
+	hostB := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "b", "dc": "north"}}
+	a.CheckError(metadataAPI.AddMetrics([]api.TaggedMetric{hostA, hostB}, metadata.Context{}))
+	clock.Move(12 * time.Hour)
+	a.CheckError(metadataAPI.AddMetric(hostB, metadata.Context{})) // only b is still reporting
+
+	all := []api.TagSet{hostA.TagSet, hostB.TagSet, {"host": "unknown"}}
+	active, err := metadataAPI.FilterActive("cpu", all, clock.Now().Add(-30*time.Minute), metadata.Context{})
+	a.CheckError(err)
+	a.Eq(active, []api.TagSet{hostB.TagSet, {"host": "unknown"}})
+	// Within the slack, a is still considered active.
+	active, err = metadataAPI.FilterActive("cpu", all, time.Unix(100000, 0).Add(30*time.Minute), metadata.Context{})
+	a.CheckError(err)
+	a.Eq(active, all)
+
+	// Last-seen times survive a snapshot.
+	a.CheckError(metadataAPI.Snapshot())
+	loaded, err := NewMetricMetadataAPI(config)
+	a.CheckError(err)
+	active, err = loaded.FilterActive("cpu", all[:2], clock.Now().Add(-30*time.Minute), metadata.Context{})
+	a.CheckError(err)
+	a.Eq(active, []api.TagSet{hostB.TagSet})
+
+	// Nothing has been idle for a day yet.
+	a.EqInt(metadataAPI.Sweep(), 0)
+	clock.Move(13 * time.Hour)
+	a.EqInt(metadataAPI.Sweep(), 1)
+	tagSets, err := metadataAPI.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(tagSets, []api.TagSet{hostB.TagSet})
+	metrics, err := metadataAPI.GetMetricsForTag("host", "a", metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(len(metrics), 0)
+	metrics, err = metadataAPI.GetMetricsForTag("dc", "north", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"cpu"})
+
+	// Metrics left without tagsets are removed entirely.
+	clock.Move(24 * time.Hour)
+	a.EqInt(metadataAPI.Sweep(), 1)
+	metrics, err = metadataAPI.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(len(metrics), 0)
+}
+
+func TestRemove(t *testing.T) {
+	a := assert.New(t)
+	metadataAPI, err := NewMetricMetadataAPI(Config{})
+	a.CheckError(err)
+	a.CheckError(metadataAPI.AddMetrics(testMetrics, metadata.Context{}))
+
+	a.CheckError(metadataAPI.RemoveMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "b", "dc": "south"}}, metadata.Context{}))
+	tagSets, err := metadataAPI.GetAllTags("cpu", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(tagSets, []api.TagSet{{"host": "a", "dc": "north"}})
+	metrics, err := metadataAPI.GetMetricsForTag("dc", "south", metadata.Context{})
+	a.CheckError(err)
+	a.EqInt(len(metrics), 0)
+
+	// A pair stays indexed while another tagset of the metric has it.
+	a.CheckError(metadataAPI.AddMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "c", "dc": "north"}}, metadata.Context{}))
+	a.CheckError(metadataAPI.RemoveMetric(api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a", "dc": "north"}}, metadata.Context{}))
+	metrics, err = metadataAPI.GetMetricsForTag("dc", "north", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"cpu"})
+	metrics, err = metadataAPI.GetMetricsForTag("host", "a", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"memory"})
+
+	a.CheckError(metadataAPI.RemoveMetricKey("cpu", metadata.Context{}))
+	metrics, err = metadataAPI.GetAllMetrics(metadata.Context{})
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"memory", "uptime"})
+	metrics, err = metadataAPI.GetMetricsForTag("host", "a", metadata.Context{})
+	a.CheckError(err)
+	a.Eq(metrics, []api.MetricKey{"memory"})
+
+	// Removing missing metrics does nothing.
+	a.CheckError(metadataAPI.RemoveMetricKey("cpu", metadata.Context{}))
+	a.CheckError(metadataAPI.RemoveMetric(api.TaggedMetric{MetricKey: "memory", TagSet: api.TagSet{"host": "z"}}, metadata.Context{}))
+}
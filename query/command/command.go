@@ -34,14 +34,17 @@ import (
 
 // ExecutionContext is the context supplied when invoking a command.
 type ExecutionContext struct {
-	TimeseriesStorageAPI  timeseries.StorageAPI // the backend
-	MetricMetadataAPI     metadata.MetricAPI    // the api
-	FetchLimit            int                   // the maximum number of fetches
-	Timeout               time.Duration         // optional
-	Registry              function.Registry     // optional
-	SlotLimit             int                   // optional (0 => default 1000)
-	Profiler              *inspect.Profiler     // optional
-	AdditionalConstraints predicate.Predicate   // optional. Additional contrains for describe and select commands
+	TimeseriesStorageAPI  timeseries.StorageAPI   // the backend
+	MetricMetadataAPI     metadata.MetricAPI      // the api
+	FetchLimit            int                     // the maximum number of fetches
+	Timeout               time.Duration           // optional
+	Registry              function.Registry       // optional
+	SlotLimit             int                     // optional (0 => default 1000)
+	PointLimit            int                     // optional (0 => unlimited). Limits the points fetched and computed by select commands
+	Profiler              *inspect.Profiler       // optional
+	AdditionalConstraints predicate.Predicate     // optional. Additional contrains for describe and select commands
+	PartialResults        function.PartialResults // optional. What to do with series which fail to be fetched (by default, fail the query)
+	Tenant                string                  // optional. The tenant to fetch data for (by default, the backend's)
 
 	Ctx netcontext.Context
 }
@@ -98,12 +101,20 @@ func (cmd *DescribeCommand) Execute(context ExecutionContext) (Result, error) {
 	// We generate a simple update function that closes around the profiler
 	// so if we do have a cache miss it's correctly reported on this request.
 
-	tagsets, err := context.MetricMetadataAPI.GetAllTags(cmd.MetricName, metadata.Context{
+	metadataContext := metadata.Context{
 		Profiler: context.Profiler,
-	})
+	}
+	tagsets, err := context.MetricMetadataAPI.GetAllTags(cmd.MetricName, metadataContext)
 	if err != nil {
 		return Result{}, err
 	}
+	// Only describe the tagsets which may still be active.
+	if activityAPI, ok := context.MetricMetadataAPI.(metadata.MetricActivityAPI); ok {
+		tagsets, err = activityAPI.FilterActive(cmd.MetricName, tagsets, time.Now(), metadataContext)
+		if err != nil {
+			return Result{}, err
+		}
+	}
 
 	// Splitting each tag key into its own set of values is helpful for discovering actual metrics.
 	predicate := predicate.All(cmd.Predicate, context.AdditionalConstraints)
@@ -276,6 +287,7 @@ func (cmd *SelectCommand) Execute(context ExecutionContext) (Result, error) {
 	evaluationContext := function.EvaluationContextBuilder{
 		MetricMetadataAPI:    context.MetricMetadataAPI,
 		FetchLimit:           function.NewFetchCounter(context.FetchLimit),
+		PointLimit:           function.NewPointCounter(context.PointLimit),
 		TimeseriesStorageAPI: context.TimeseriesStorageAPI,
 		Predicate:            predicate.All(cmd.Predicate, context.AdditionalConstraints),
 		SampleMethod:         cmd.Context.SampleMethod,
@@ -284,6 +296,8 @@ func (cmd *SelectCommand) Execute(context ExecutionContext) (Result, error) {
 		Registry:        r,
 		Profiler:        context.Profiler,
 		EvaluationNotes: new(function.EvaluationNotes),
+		PartialResults:  context.PartialResults,
+		Tenant:          context.Tenant,
 
 		Ctx: ctx,
 	}.Build()
@@ -357,11 +371,14 @@ func (cmd *SelectCommand) Execute(context ExecutionContext) (Result, error) {
 			return Result{}, fmt.Errorf("query %s does not result in a timeseries or scalar.", cmd.Expressions[i].ExpressionDescription(function.StringQuery))
 		}
 
+		points := evaluationContext.PointLimit()
 		return Result{
 			Body: body,
 			Metadata: map[string]interface{}{
 				"description": description,
 				"notes":       evaluationContext.Notes(),
+				"partial":     evaluationContext.Partial(),
+				"points":      map[string]int{"fetched": points.Fetched(), "materialized": points.Materialized(), "limit": points.Limit()},
 				"resolution":  chosenResolution,
 			},
 		}, nil
@@ -16,6 +16,7 @@ package expression
 
 import (
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
@@ -23,6 +24,7 @@ import (
 	"github.com/square/metrics/function"
 	"github.com/square/metrics/metric_metadata"
 	"github.com/square/metrics/query/predicate"
+	"github.com/square/metrics/tasks"
 	"github.com/square/metrics/timeseries"
 	"github.com/square/metrics/util"
 )
@@ -97,14 +99,20 @@ func (expr *MetricFetchExpression) ActualEvaluate(context function.EvaluationCon
 	// Merge predicates appropriately
 	p := predicate.All(expr.Predicate, context.Predicate())
 
-	metricTagSets, err := context.MetricMetadataAPI().GetAllTags(api.MetricKey(expr.MetricName), metadata.Context{
+	metadataContext := metadata.Context{
 		Profiler: context.Profiler(),
-	})
-
+	}
+	filtered, err := fetchMatchingTags(context.MetricMetadataAPI(), api.MetricKey(expr.MetricName), p, metadataContext)
 	if err != nil {
 		return nil, err
 	}
-	filtered := applyPredicates(metricTagSets, p)
+	// Tagsets known to be inactive throughout the timerange would only fetch NaNs.
+	if activityAPI, ok := context.MetricMetadataAPI().(metadata.MetricActivityAPI); ok {
+		filtered, err = activityAPI.FilterActive(api.MetricKey(expr.MetricName), filtered, context.Timerange().Start(), metadataContext)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	if err := context.FetchLimitConsume(len(filtered)); err != nil {
 		return nil, err
@@ -115,23 +123,105 @@ func (expr *MetricFetchExpression) ActualEvaluate(context function.EvaluationCon
 		metrics[i] = api.TaggedMetric{MetricKey: api.MetricKey(expr.MetricName), TagSet: filtered[i]}
 	}
 
+	if err := context.PointLimitConsumeFetched(len(metrics) * context.Timerange().Slots()); err != nil {
+		return nil, err
+	}
+	details := timeseries.RequestDetails{
+		SampleMethod: context.SampleMethod(),
+		Timerange:    context.Timerange(),
+		Ctx:          context.Ctx(),
+		Profiler:     context.Profiler(),
+		Tenant:       context.Tenant(),
+	}
 	seriesList, err := context.TimeseriesStorageAPI().FetchMultipleTimeseries(
 		timeseries.FetchMultipleRequest{
-			Metrics: metrics,
-			RequestDetails: timeseries.RequestDetails{
-				SampleMethod: context.SampleMethod(),
-				Timerange:    context.Timerange(),
-				Ctx:          context.Ctx(),
-				Profiler:     context.Profiler(),
-			},
+			Metrics:        metrics,
+			RequestDetails: details,
 		},
 	)
 	if err != nil {
-		return nil, err
+		if context.PartialResults() == function.PartialResultsNone || context.Ctx().Err() != nil || !isSeriesError(err) {
+			return nil, err
+		}
+		// Find out which series failed by fetching them one at a time.
+		return fetchPartial(context, metrics, details)
 	}
 	return function.SeriesListValue(seriesList), nil
 }
 
+// partialFetchConcurrency bounds the single fetches made by fetchPartial.
+const partialFetchConcurrency = 10
+
+// isSeriesError returns whether the error concerns a single series, so that
+// the other series can still be fetched without it: an invalid series, or an
+// IO error or timeout while fetching it. Other errors (such as authorization
+// failures, an open circuit breaker or a cancelled query) fail every series.
+func isSeriesError(err error) bool {
+	seriesErr, ok := err.(timeseries.Error)
+	if !ok {
+		return false
+	}
+	switch seriesErr.Code {
+	case timeseries.InvalidSeriesError, timeseries.FetchIOError, timeseries.FetchTimeoutError:
+		return true
+	}
+	return false
+}
+
+// fetchPartial fetches each metric separately. Series which fail with a
+// series error are omitted or NaN-filled, as set by the context's
+// PartialResults, and their distinct errors are added as notes. Any other
+// error fails the whole fetch.
+func fetchPartial(context function.EvaluationContext, metrics []api.TaggedMetric, details timeseries.RequestDetails) (function.Value, error) {
+	defer context.Profiler().RecordWithDescription("Partial FetchMultipleTimeseries", fmt.Sprintf("%d series", len(metrics)))()
+	results := make([]api.Timeseries, len(metrics))
+	errors := make([]error, len(metrics))
+	queue := tasks.NewParallelQueue(partialFetchConcurrency, details.Ctx)
+	for i := range metrics {
+		i := i
+		queue.Do(func() error {
+			results[i], errors[i] = context.TimeseriesStorageAPI().FetchSingleTimeseries(timeseries.FetchRequest{
+				Metric:         metrics[i],
+				RequestDetails: details,
+			})
+			return nil
+		})
+	}
+	if err := queue.Wait(); err != nil {
+		return nil, err
+	}
+	if err := details.Ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, err := range errors {
+		if err != nil && !isSeriesError(err) {
+			return nil, err
+		}
+	}
+
+	series := []api.Timeseries{}
+	noted := map[string]bool{}
+	for i := range metrics {
+		if errors[i] == nil {
+			series = append(series, results[i])
+			continue
+		}
+		if message := errors[i].Error(); !noted[message] {
+			noted[message] = true
+			context.AddFailedSeries(errors[i])
+		}
+		if context.PartialResults() == function.PartialResultsNaN {
+			values := make([]float64, details.Timerange.Slots())
+			for j := range values {
+				values[j] = math.NaN()
+			}
+			series = append(series, api.Timeseries{Values: values, TagSet: metrics[i].TagSet})
+		}
+	}
+	return function.SeriesListValue(api.SeriesList{Series: series}), nil
+}
+
 func (expr *MetricFetchExpression) ExpressionDescription(mode function.DescriptionMode) string {
 	if mode == function.StringMemoization() {
 		return fmt.Sprintf("fetch[%q][%s]", expr.MetricName, expr.Predicate.Query())
@@ -237,6 +327,19 @@ func (expr *AnnotationExpression) ExpressionDescription(mode function.Descriptio
 // Auxiliary functions
 // ===================
 
+// fetchMatchingTags lets the metadata API narrow down the tagsets itself when
+// it supports it; otherwise every tagset is fetched and filtered here.
+func fetchMatchingTags(metadataAPI metadata.MetricAPI, metricKey api.MetricKey, p predicate.Predicate, context metadata.Context) ([]api.TagSet, error) {
+	if matchingAPI, ok := metadataAPI.(metadata.MetricMatchingAPI); ok {
+		return matchingAPI.GetTagsMatching(metricKey, p, context)
+	}
+	metricTagSets, err := metadataAPI.GetAllTags(metricKey, context)
+	if err != nil {
+		return nil, err
+	}
+	return applyPredicates(metricTagSets, p), nil
+}
+
 func applyPredicates(tagSets []api.TagSet, predicate predicate.Predicate) []api.TagSet {
 	output := []api.TagSet{}
 	for _, ts := range tagSets {
@@ -358,7 +358,6 @@ func (p *Parser) insertPropertyKeyValue() {
 	switch key {
 	case "sample":
 		// If the key is "sample", it means we're in a "sample by" declaration.
-		// Only three possible sample methods are defined: min, max, or mean.
 		switch value {
 		case "max":
 			contextNode.SampleMethod = timeseries.SampleMax
@@ -366,10 +365,20 @@ func (p *Parser) insertPropertyKeyValue() {
 			contextNode.SampleMethod = timeseries.SampleMin
 		case "mean":
 			contextNode.SampleMethod = timeseries.SampleMean
+		case "count":
+			contextNode.SampleMethod = timeseries.SampleCount
+		case "sum":
+			contextNode.SampleMethod = timeseries.SampleSum
+		case "stddev":
+			contextNode.SampleMethod = timeseries.SampleStddev
 		default:
+			if method, ok := timeseries.PercentileSampleMethod(string(value)); ok {
+				contextNode.SampleMethod = method
+				break
+			}
 			p.flagSyntaxError(SyntaxError{
 				token:   string(value),
-				message: fmt.Sprintf("Expected sampling method 'max', 'min', or 'mean' but got %s", value),
+				message: fmt.Sprintf("Expected sampling method 'max', 'min', 'mean', 'count', 'sum', 'stddev' or a percentile such as 'p99' but got %s", value),
 			})
 		}
 	case "from", "to":
@@ -183,3 +183,21 @@ func (p RegexMatcher) Apply(tagset api.TagSet) bool {
 func (p RegexMatcher) Query() string {
 	return fmt.Sprintf("%s match %q", util.EscapeIdentifier(p.Tag), p.Regex.String())
 }
+
+// RequiredMatchers returns the list matchers which every tagset satisfying the
+// predicate must also satisfy. These are the equality and "in" clauses found by
+// descending through conjunctions; backends can answer them from their indexes
+// before applying the full predicate to what remains.
+func RequiredMatchers(predicate Predicate) []ListMatcher {
+	switch p := predicate.(type) {
+	case ListMatcher:
+		return []ListMatcher{p}
+	case AndPredicate:
+		result := []ListMatcher{}
+		for _, child := range p.Predicates {
+			result = append(result, RequiredMatchers(child)...)
+		}
+		return result
+	}
+	return nil
+}
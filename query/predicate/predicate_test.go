@@ -0,0 +1,48 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package predicate
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/square/metrics/testing_support/assert"
+)
+
+func TestRequiredMatchers(t *testing.T) {
+	host := ListMatcher{Tag: "host", Values: []string{"a", "b"}}
+	dc := ListMatcher{Tag: "dc", Values: []string{"east"}}
+	regex := RegexMatcher{Tag: "app", Regex: regexp.MustCompile("web")}
+	tests := []struct {
+		predicate Predicate
+		expected  []ListMatcher
+	}{
+		{TruePredicate{}, nil},
+		{host, []ListMatcher{host}},
+		{regex, nil},
+		{All(host, regex, All(dc, TruePredicate{})), []ListMatcher{host, dc}},
+		{Any(host, dc), nil},
+		{NotPredicate{host}, nil},
+		{All(regex, NotPredicate{dc}), []ListMatcher{}},
+	}
+	for _, test := range tests {
+		a := assert.New(t).Contextf("%s", test.predicate.Query())
+		actual := RequiredMatchers(test.predicate)
+		a.MustEqInt(len(actual), len(test.expected))
+		for i := range actual {
+			a.EqString(actual[i].Query(), test.expected[i].Query())
+		}
+	}
+}
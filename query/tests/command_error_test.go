@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/square/metrics/api"
+	"github.com/square/metrics/function"
 	"github.com/square/metrics/query/command"
 	"github.com/square/metrics/query/parser"
 	"github.com/square/metrics/testing_support/mocks"
@@ -67,3 +68,67 @@ func TestCommandError(t *testing.T) {
 		t.Errorf(`"6 additional series" expected in error message %s`, err.Error())
 	}
 }
+
+func TestCommandPointLimit(t *testing.T) {
+	testTimerange, err := api.NewTimerange(0, 120, 30)
+	if err != nil {
+		t.Fatalf("Error creating timerange for test: %s", err.Error())
+	}
+	comboAPI := mocks.NewComboAPI(testTimerange,
+		api.Timeseries{Values: []float64{1, 2, 3, 4, 5}, TagSet: api.TagSet{"metric": "testmetric", "host": "h1"}},
+		api.Timeseries{Values: []float64{5, 4, 3, 4, 5}, TagSet: api.TagSet{"metric": "testmetric", "host": "h2"}},
+		api.Timeseries{Values: []float64{1, 7, 7, 7, 5}, TagSet: api.TagSet{"metric": "testmetric", "host": "h3"}},
+	)
+	context := command.ExecutionContext{
+		TimeseriesStorageAPI: comboAPI,
+		MetricMetadataAPI:    comboAPI,
+		FetchLimit:           100,
+		PointLimit:           20,
+		Ctx:                  context.Background(),
+	}
+
+	// 3 series of 5 points fit within the limit, and the usage is reported.
+	fetchCommand, err := parser.Parse(`select testmetric from 0 to 120 resolution 30ms`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	result, err := fetchCommand.Execute(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	points := result.Metadata["points"].(map[string]int)
+	if points["fetched"] != 15 || points["materialized"] != 0 || points["limit"] != 20 {
+		t.Errorf("unexpected point usage %+v", points)
+	}
+
+	// Joining them computes another 15 points, which exceeds the limit.
+	joinCommand, err := parser.Parse(`select testmetric + testmetric from 0 to 120 resolution 30ms`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	_, err = joinCommand.Execute(context)
+	if err == nil {
+		t.Fatalf("expected error due to exceeding the point limit")
+	}
+	limitErr, ok := err.(function.LimitError)
+	if !ok {
+		t.Fatalf("expected a LimitError but got %#v", err)
+	}
+	if limitErr.Actual() != 30 || limitErr.Limit() != 20 {
+		t.Errorf("unexpected actual %v and limit %v in %s", limitErr.Actual(), limitErr.Limit(), err.Error())
+	}
+
+	// The aggregate of the series computes 5 points, which fits.
+	aggregateCommand, err := parser.Parse(`select aggregate.sum(testmetric) from 0 to 120 resolution 30ms`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	result, err = aggregateCommand.Execute(context)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	points = result.Metadata["points"].(map[string]int)
+	if points["fetched"] != 15 || points["materialized"] != 5 {
+		t.Errorf("unexpected point usage %+v", points)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Integration test for the query execution.
+package tests
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/metric_metadata"
+	"github.com/square/metrics/metric_metadata/memory"
+	"github.com/square/metrics/query/command"
+	"github.com/square/metrics/query/parser"
+	"github.com/square/metrics/query/predicate"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+)
+
+// matchingMetadata records the predicates it is asked to match.
+type matchingMetadata struct {
+	mocks.FakeComboAPI
+	predicates *[]string
+}
+
+func (m matchingMetadata) GetTagsMatching(metricKey api.MetricKey, p predicate.Predicate, context metadata.Context) ([]api.TagSet, error) {
+	*m.predicates = append(*m.predicates, p.Query())
+	tagSets, err := m.GetAllTags(metricKey, context)
+	if err != nil {
+		return nil, err
+	}
+	result := []api.TagSet{}
+	for _, tagSet := range tagSets {
+		if p.Apply(tagSet) {
+			result = append(result, tagSet)
+		}
+	}
+	return result, nil
+}
+
+func TestCommandMatchingMetadata(t *testing.T) {
+	a := assert.New(t)
+	testTimerange, err := api.NewTimerange(0, 120, 30)
+	a.CheckError(err)
+	comboAPI := mocks.NewComboAPI(testTimerange,
+		api.Timeseries{Values: []float64{1, 2, 3, 4, 5}, TagSet: api.TagSet{"metric": "testmetric", "host": "h1"}},
+		api.Timeseries{Values: []float64{5, 4, 3, 4, 5}, TagSet: api.TagSet{"metric": "testmetric", "host": "h2"}},
+	)
+	predicates := []string{}
+	matching := matchingMetadata{FakeComboAPI: comboAPI, predicates: &predicates}
+
+	// The same query is answered with and without the extension.
+	for _, metadataAPI := range []metadata.MetricAPI{comboAPI, matching} {
+		testCommand, err := parser.Parse(`select testmetric where host = 'h2' from 0 to 120 resolution 30ms`)
+		a.CheckError(err)
+		result, err := testCommand.Execute(command.ExecutionContext{
+			TimeseriesStorageAPI: comboAPI,
+			MetricMetadataAPI:    metadataAPI,
+			FetchLimit:           100,
+			Ctx:                  context.Background(),
+		})
+		a.CheckError(err)
+		series := result.Body.([]command.QueryResult)[0].Series
+		a.MustEqInt(len(series), 1)
+		a.EqString(series[0].TagSet["host"], "h2")
+		a.EqFloatArray(series[0].Values, []float64{5, 4, 3, 4, 5}, 1e-9)
+	}
+	a.MustEqInt(len(predicates), 1)
+	if !strings.Contains(predicates[0], `host = "h2"`) {
+		t.Errorf("expected the where clause to be pushed down, but got %q", predicates[0])
+	}
+}
+
+func TestCommandSkipsInactiveTagSets(t *testing.T) {
+	a := assert.New(t)
+	testTimerange, err := api.NewTimerange(0, 120, 30)
+	a.CheckError(err)
+	h1 := api.TagSet{"metric": "testmetric", "host": "h1"}
+	h2 := api.TagSet{"metric": "testmetric", "host": "h2"}
+	comboAPI := mocks.NewComboAPI(testTimerange,
+		api.Timeseries{Values: []float64{1, 2, 3, 4, 5}, TagSet: h1},
+		api.Timeseries{Values: []float64{5, 4, 3, 4, 5}, TagSet: h2},
+	)
+	clock := mocks.NewTestClock(time.Unix(0, 0))
+	metadataAPI, err := memory.NewMetricMetadataAPI(memory.Config{ActivitySlack: time.Hour, Clock: clock})
+	a.CheckError(err)
+	a.CheckError(metadataAPI.AddMetrics([]api.TaggedMetric{{MetricKey: "testmetric", TagSet: h1}, {MetricKey: "testmetric", TagSet: h2}}, metadata.Context{}))
+	clock.Move(10 * time.Hour)
+	a.CheckError(metadataAPI.AddMetric(api.TaggedMetric{MetricKey: "testmetric", TagSet: h2}, metadata.Context{}))
+
+	for _, test := range []struct {
+		query    string
+		expected int
+	}{
+		{`select testmetric from 0 to 120 resolution 30ms`, 2},
+		{`select testmetric from 36000000 to 36000120 resolution 30ms`, 1}, // h1 was last seen 10 hours earlier
+	} {
+		testCommand, err := parser.Parse(test.query)
+		a.CheckError(err)
+		result, err := testCommand.Execute(command.ExecutionContext{
+			TimeseriesStorageAPI: comboAPI,
+			MetricMetadataAPI:    metadataAPI,
+			FetchLimit:           100,
+			Ctx:                  context.Background(),
+		})
+		a.CheckError(err)
+		series := result.Body.([]command.QueryResult)[0].Series
+		a.Contextf("%s", test.query).MustEqInt(len(series), test.expected)
+		if test.expected == 1 {
+			a.EqString(series[0].TagSet["host"], "h2")
+		}
+	}
+}
+
+func TestDescribeSkipsInactiveTagSets(t *testing.T) {
+	a := assert.New(t)
+	clock := mocks.NewTestClock(time.Now().Add(-10 * time.Hour))
+	metadataAPI, err := memory.NewMetricMetadataAPI(memory.Config{ActivitySlack: time.Hour, Clock: clock})
+	a.CheckError(err)
+	a.CheckError(metadataAPI.AddMetrics([]api.TaggedMetric{
+		{MetricKey: "testmetric", TagSet: api.TagSet{"host": "h1"}},
+		{MetricKey: "testmetric", TagSet: api.TagSet{"host": "h2"}},
+	}, metadata.Context{}))
+	clock.Move(10 * time.Hour)
+	a.CheckError(metadataAPI.AddMetric(api.TaggedMetric{MetricKey: "testmetric", TagSet: api.TagSet{"host": "h2"}}, metadata.Context{}))
+
+	testCommand, err := parser.Parse(`describe testmetric`)
+	a.CheckError(err)
+	result, err := testCommand.Execute(command.ExecutionContext{
+		MetricMetadataAPI: metadataAPI,
+		FetchLimit:        100,
+		Ctx:               context.Background(),
+	})
+	a.CheckError(err)
+	a.Eq(result.Body, map[string][]string{"host": {"h2"}}) // h1 was last seen 10 hours ago
+}
@@ -0,0 +1,197 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Integration test for the query execution.
+package tests
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/function"
+	"github.com/square/metrics/query/command"
+	"github.com/square/metrics/query/parser"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+	"github.com/square/metrics/timeseries"
+)
+
+// failingStorage fails to fetch the series of one host with the given code,
+// or with the given error if it is set.
+type failingStorage struct {
+	mocks.FakeComboAPI
+	host string
+	code timeseries.ErrorCode
+	err  error
+}
+
+func (f failingStorage) FetchSingleTimeseries(request timeseries.FetchRequest) (api.Timeseries, error) {
+	if request.Metric.TagSet["host"] == f.host {
+		if f.err != nil {
+			return api.Timeseries{}, f.err
+		}
+		return api.Timeseries{}, timeseries.Error{Metric: request.Metric, Code: f.code, Message: "backend unavailable"}
+	}
+	return f.FakeComboAPI.FetchSingleTimeseries(request)
+}
+
+func (f failingStorage) FetchMultipleTimeseries(request timeseries.FetchMultipleRequest) (api.SeriesList, error) {
+	list := api.SeriesList{}
+	for _, single := range request.ToSingle() {
+		series, err := f.FetchSingleTimeseries(single)
+		if err != nil {
+			return api.SeriesList{}, err
+		}
+		list.Series = append(list.Series, series)
+	}
+	return list, nil
+}
+
+func TestCommandPartialResults(t *testing.T) {
+	testTimerange, err := api.NewTimerange(0, 120, 30)
+	if err != nil {
+		t.Fatalf("Error creating timerange for test: %s", err.Error())
+	}
+	comboAPI := mocks.NewComboAPI(testTimerange,
+		api.Timeseries{Values: []float64{1, 2, 3, 4, 5}, TagSet: api.TagSet{"metric": "testmetric", "host": "h1"}},
+		api.Timeseries{Values: []float64{5, 4, 3, 4, 5}, TagSet: api.TagSet{"metric": "testmetric", "host": "h2"}},
+		api.Timeseries{Values: []float64{1, 7, 7, 7, 5}, TagSet: api.TagSet{"metric": "testmetric", "host": "h3"}},
+	)
+	storage := failingStorage{FakeComboAPI: comboAPI, host: "h2", code: timeseries.InvalidSeriesError}
+	nan := math.NaN()
+
+	for _, test := range []struct {
+		mode     function.PartialResults
+		expected map[string][]float64 // host => values
+	}{
+		{function.PartialResultsNaN, map[string][]float64{
+			"h1": {1, 2, 3, 4, 5},
+			"h2": {nan, nan, nan, nan, nan},
+			"h3": {1, 7, 7, 7, 5},
+		}},
+		{function.PartialResultsOmit, map[string][]float64{
+			"h1": {1, 2, 3, 4, 5},
+			"h3": {1, 7, 7, 7, 5},
+		}},
+	} {
+		a := assert.New(t).Contextf("mode=%d", test.mode)
+		testCommand, err := parser.Parse(`select testmetric from 0 to 120 resolution 30ms`)
+		a.CheckError(err)
+		result, err := testCommand.Execute(command.ExecutionContext{
+			TimeseriesStorageAPI: storage,
+			MetricMetadataAPI:    comboAPI,
+			FetchLimit:           100,
+			PartialResults:       test.mode,
+			Ctx:                  context.Background(),
+		})
+		a.CheckError(err)
+		series := result.Body.([]command.QueryResult)[0].Series
+		a.EqInt(len(series), len(test.expected))
+		for _, s := range series {
+			expected, ok := test.expected[s.TagSet["host"]]
+			if !ok {
+				t.Errorf("unexpected series %+v in mode %d", s.TagSet, test.mode)
+				continue
+			}
+			a.Contextf("host=%s", s.TagSet["host"]).EqFloatArray(s.Values, expected, 1e-9)
+		}
+		a.Eq(result.Metadata["partial"], true)
+		notes := result.Metadata["notes"].([]string)
+		a.MustEqInt(len(notes), 1)
+		if !strings.Contains(notes[0], "backend unavailable") {
+			t.Errorf("expected the fetch error in the notes, but got %q", notes[0])
+		}
+	}
+
+	// By default, the whole query fails.
+	testCommand, err := parser.Parse(`select testmetric from 0 to 120 resolution 30ms`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, err := testCommand.Execute(command.ExecutionContext{
+		TimeseriesStorageAPI: storage,
+		MetricMetadataAPI:    comboAPI,
+		FetchLimit:           100,
+		Ctx:                  context.Background(),
+	}); err == nil {
+		t.Errorf("expected an error without partial results")
+	}
+
+	// IO errors and timeouts while fetching a single series are also partial.
+	for _, code := range []timeseries.ErrorCode{timeseries.FetchIOError, timeseries.FetchTimeoutError} {
+		a := assert.New(t).Contextf("code=%d", code)
+		result, err := testCommand.Execute(command.ExecutionContext{
+			TimeseriesStorageAPI: failingStorage{FakeComboAPI: comboAPI, host: "h2", code: code},
+			MetricMetadataAPI:    comboAPI,
+			FetchLimit:           100,
+			PartialResults:       function.PartialResultsOmit,
+			Ctx:                  context.Background(),
+		})
+		a.CheckError(err)
+		a.EqInt(len(result.Body.([]command.QueryResult)[0].Series), 2)
+		a.Eq(result.Metadata["partial"], true)
+	}
+
+	// Errors which aren't about a single series fail the whole query.
+	for _, test := range []struct {
+		name string
+		err  error
+	}{
+		{"open circuit breaker", timeseries.FetchError{Code: http.StatusServiceUnavailable, Message: "circuit breaker is open"}},
+		{"rejected tenant", timeseries.FetchError{Code: http.StatusForbidden, Message: "tenant is not allowed"}},
+		{"limit", timeseries.Error{Code: timeseries.LimitError, Message: "too many series"}},
+	} {
+		if _, err := testCommand.Execute(command.ExecutionContext{
+			TimeseriesStorageAPI: failingStorage{FakeComboAPI: comboAPI, host: "h2", err: test.err},
+			MetricMetadataAPI:    comboAPI,
+			FetchLimit:           100,
+			PartialResults:       function.PartialResultsNaN,
+			Ctx:                  context.Background(),
+		}); err == nil {
+			t.Errorf("expected an error for the %s", test.name)
+		}
+	}
+
+	// A cancelled query fails, even though the error is about a single series.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := testCommand.Execute(command.ExecutionContext{
+		TimeseriesStorageAPI: failingStorage{FakeComboAPI: comboAPI, host: "h2", code: timeseries.FetchTimeoutError},
+		MetricMetadataAPI:    comboAPI,
+		FetchLimit:           100,
+		PartialResults:       function.PartialResultsNaN,
+		Ctx:                  cancelled,
+	}); err == nil {
+		t.Errorf("expected an error for a cancelled query")
+	}
+
+	// Queries which fetch everything are not partial.
+	result, err := testCommand.Execute(command.ExecutionContext{
+		TimeseriesStorageAPI: comboAPI,
+		MetricMetadataAPI:    comboAPI,
+		FetchLimit:           100,
+		PartialResults:       function.PartialResultsNaN,
+		Ctx:                  context.Background(),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if result.Metadata["partial"] != false {
+		t.Errorf("expected a complete result, but got metadata %+v", result.Metadata)
+	}
+}
@@ -117,6 +117,11 @@ var selects = []string{
 	"x from 0 to 0 resolution '17m'",
 	"x from 0 to 0 sample by 'max'",
 	"x from 0 to 0 sample   by 'max'",
+	"x from 0 to 0 sample by 'count'",
+	"x from 0 to 0 sample by 'sum'",
+	"x from 0 to 0 sample by 'stddev'",
+	"x from 0 to 0 sample by 'p99'",
+	"x from 0 to 0 sample by 'p999'",
 	// selects - aggregate functions
 	"scalar.max(x) from 0 to 0",
 	"aggregate.max(x, y) from 0 to 0",
@@ -185,6 +190,8 @@ var syntaxErrorQuery = []string{
 	"select x from 0 to 1 to 0",
 	"select x from 0 resolution '30s' resolution '25s' to 0",
 	"select x from 0 from 1 sample by 'min' sample by 'min' to 0",
+	"select x from 0 to 0 sample by 'median'",
+	"select x from 0 to 0 sample by 'p12'",
 	"select f(3 groupby x) from 0 to 0",
 	"select c group by a from 0 to 0",
 	"select x[] from 0 to 0",
@@ -20,11 +20,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 )
 
 type FakeHTTPClient struct {
 	responses map[string]Response
+
+	mutex    sync.Mutex
+	queued   map[string][]Response // url => responses to give before falling back to responses
+	requests map[string]int        // url => number of requests received
+	posted   map[string][]string   // url => bodies of the POST requests it received
 }
 
 type Response struct {
@@ -36,15 +42,42 @@ type Response struct {
 func NewFakeHTTPClient() *FakeHTTPClient {
 	return &FakeHTTPClient{
 		responses: make(map[string]Response),
+		queued:    make(map[string][]Response),
+		requests:  make(map[string]int),
+		posted:    make(map[string][]string),
 	}
 }
 
 func (c *FakeHTTPClient) SetResponse(url string, r Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.responses[url] = r
 }
 
+// QueueResponses makes the next requests to the url receive the given
+// responses, in order. Later requests receive the response set by SetResponse.
+func (c *FakeHTTPClient) QueueResponses(url string, responses ...Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.queued[url] = append(c.queued[url], responses...)
+}
+
+// RequestCount returns the number of requests made to the url.
+func (c *FakeHTTPClient) RequestCount(url string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.requests[url]
+}
+
 func (c *FakeHTTPClient) Get(url string) (*http.Response, error) {
+	c.mutex.Lock()
+	c.requests[url]++
 	r, exists := c.responses[url]
+	if queue := c.queued[url]; len(queue) != 0 {
+		r, exists = queue[0], true
+		c.queued[url] = queue[1:]
+	}
+	c.mutex.Unlock()
 	if !exists {
 		return nil, fmt.Errorf("the FakeHTTPClient's Get() method received unexpected url %s, mappings: %+v", url, c.responses)
 	}
@@ -61,9 +94,28 @@ func (c *FakeHTTPClient) Get(url string) (*http.Response, error) {
 	return &resp, nil
 }
 
+// PostedBodies returns the bodies of the POST requests sent to the url, in order.
+func (c *FakeHTTPClient) PostedBodies(url string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.posted[url]...)
+}
+
 func (c *FakeHTTPClient) Do(request *http.Request) (*http.Response, error) {
-	if request.Method != "GET" {
-		panic("FakeHTTPClient only supports GET requests in method Do(req)")
+	switch request.Method {
+	case "GET":
+		return c.Get(request.URL.String())
+	case "POST":
+		// POST requests are answered like GET requests after recording their bodies.
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			return nil, err
+		}
+		c.mutex.Lock()
+		c.posted[request.URL.String()] = append(c.posted[request.URL.String()], string(body))
+		c.mutex.Unlock()
+		return c.Get(request.URL.String())
+	default:
+		panic("FakeHTTPClient only supports GET and POST requests in method Do(req)")
 	}
-	return c.Get(request.URL.String())
 }
@@ -0,0 +1,121 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueflood
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/tasks"
+	"github.com/square/metrics/timeseries"
+)
+
+// batchResponse is the JSON response of the batched /views endpoint.
+type batchResponse struct {
+	Metrics []batchMetric `json:"metrics"`
+}
+
+type batchMetric struct {
+	Metric string        `json:"metric"`
+	Data   []metricPoint `json:"data"`
+}
+
+// fetchBatchedTimeseries fetches the metrics by POSTing batches of their
+// graphite names to the /views endpoint, once for each resolution interval of
+// the plan, and splits the responses back into a series per metric.
+func (b *Blueflood) fetchBatchedTimeseries(request timeseries.FetchMultipleRequest, plan fetchPlan) (api.SeriesList, error) {
+	names := make([]string, len(request.Metrics))
+	for i, metric := range request.Metrics {
+		graphiteName, err := b.config.GraphiteMetricConverter.ToGraphiteName(metric)
+		if err != nil {
+			return api.SeriesList{}, timeseries.Error{Metric: metric, Code: timeseries.InvalidSeriesError, Message: "cannot convert to graphite name"}
+		}
+		names[i] = string(graphiteName)
+	}
+
+	allPoints := make([][]metricPoint, len(request.Metrics))
+	queue := tasks.NewParallelQueue(b.config.MaxSimultaneousRequests, request.Ctx)
+	for resolution, interval := range plan.intervals {
+		for start := 0; start < len(names); start += b.config.BatchSize {
+			resolution, interval, start := resolution, interval, start
+			end := start + b.config.BatchSize
+			if end > len(names) {
+				end = len(names)
+			}
+			queue.Do(func() error {
+				defer request.Profiler.RecordWithDescription("Blueflood FetchMultipleTimeseries Batch", fmt.Sprintf("%d metrics at %+v", end-start, resolution.Resolution))()
+				metrics, err := b.fetchBatchHTTP(request.Metrics[start], plan.tenant, names[start:end], queryParameters(interval, plan.sampler, resolution).Encode(), request.Ctx)
+				if err != nil {
+					return err
+				}
+				indices := map[string][]int{} // graphite name => indices of the metrics in this batch
+				for i := start; i < end; i++ {
+					indices[names[i]] = append(indices[names[i]], i)
+				}
+				queue.Lock()
+				defer queue.Unlock()
+				for _, metric := range metrics {
+					for _, index := range indices[metric.Metric] {
+						allPoints[index] = append(allPoints[index], metric.Data...)
+					}
+				}
+				return nil
+			})
+		}
+	}
+	if err := queue.Wait(); err != nil {
+		return api.SeriesList{}, err
+	}
+
+	results := make([]api.Timeseries, len(request.Metrics))
+	for i, metric := range request.Metrics {
+		results[i] = api.Timeseries{
+			Values: samplePoints(allPoints[i], plan.timerange, plan.sampler),
+			TagSet: metric.TagSet,
+		}
+	}
+	return api.SeriesList{
+		Series: results,
+	}, nil
+}
+
+// fetchBatchHTTP POSTs the graphite names to the /views endpoint.
+// The first metric of the batch is used to describe errors.
+func (b *Blueflood) fetchBatchHTTP(first api.TaggedMetric, tenant string, names []string, rawQuery string, ctx context.Context) ([]batchMetric, error) {
+	body, err := json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+	queryURL := fmt.Sprintf("%s/v2.0/%s/views?%s", b.config.BaseURL, url.PathEscape(tenant), rawQuery)
+	newRequest := func() (*http.Request, error) {
+		request, err := http.NewRequest("POST", queryURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		return request, nil
+	}
+	var parsedJSON batchResponse
+	// Only GETs are idempotent, so the POST isn't retried or hedged.
+	if err := b.performFetch(first, newRequest, false, ctx, &parsedJSON); err != nil {
+		return nil, err
+	}
+	return parsedJSON.Metrics, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueflood
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/util"
+)
+
+func TestBluefloodBatchedQueries(t *testing.T) {
+	a := assert.New(t)
+	nowMillis := int64(739908000000)
+	nowFunc := TimeSource{GetTime: func() time.Time {
+		return time.Unix(nowMillis/1000, nowMillis%1000*1e6)
+	}}
+	testClient := mocks.NewFakeHTTPClient()
+	batchURL := "https://blueflood.url/v2.0/square/views?from=739907880000&resolution=FULL&select=numPoints%2Caverage&to=739907999999"
+	// Every batch receives the same response; metrics outside the batch are ignored.
+	testClient.SetResponse(batchURL, mocks.Response{
+		Body: `{
+			"metrics": [
+				{
+					"metric": "a.graphite",
+					"unit": "unknown",
+					"type": "number",
+					"data": [
+						{"numPoints": 1, "timestamp": 739907880000, "average": 1},
+						{"numPoints": 1, "timestamp": 739907940000, "average": 3}
+					]
+				},
+				{
+					"metric": "b.graphite",
+					"data": [{"numPoints": 1, "timestamp": 739907910000, "average": 2}]
+				},
+				{
+					"metric": "c.graphite",
+					"data": [{"numPoints": 1, "timestamp": 739907970000, "average": 4}]
+				}
+			]
+		}`,
+		StatusCode: 200,
+	})
+	converter := &mocks.FakeGraphiteConverter{
+		MetricMap: map[util.GraphiteMetric]api.TaggedMetric{
+			"a.graphite": {MetricKey: "some.key", TagSet: api.TagSet{"tag": "a"}},
+			"b.graphite": {MetricKey: "some.key", TagSet: api.TagSet{"tag": "b"}},
+			"c.graphite": {MetricKey: "some.key", TagSet: api.TagSet{"tag": "c"}},
+		},
+	}
+	blueflood := NewBlueflood(Config{
+		BaseURL:                 "https://blueflood.url",
+		TenantID:                "square",
+		Resolutions:             []Resolution{resolutionFull, resolution5Min, resolution60Min, resolution1440Min},
+		MaxSimultaneousRequests: 5,
+		BatchSize:               2,
+		GraphiteMetricConverter: converter,
+		HTTPClient:              testClient,
+		TimeSource:              nowFunc,
+	})
+
+	timerange, err := api.NewTimerange(nowMillis-120000, nowMillis, 30000)
+	a.CheckError(err)
+	result, err := blueflood.FetchMultipleTimeseries(timeseries.FetchMultipleRequest{
+		Metrics: []api.TaggedMetric{
+			{MetricKey: "some.key", TagSet: api.TagSet{"tag": "a"}},
+			{MetricKey: "some.key", TagSet: api.TagSet{"tag": "b"}},
+			{MetricKey: "some.key", TagSet: api.TagSet{"tag": "c"}},
+		},
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	a.CheckError(err)
+	nan := math.NaN()
+	a.MustEqInt(len(result.Series), 3)
+	a.EqFloatArray(result.Series[0].Values, []float64{1, nan, 3, nan, nan}, 1e-9)
+	a.EqFloatArray(result.Series[1].Values, []float64{nan, 2, nan, nan, nan}, 1e-9)
+	a.EqFloatArray(result.Series[2].Values, []float64{nan, nan, nan, 4, nan}, 1e-9)
+	a.Eq(result.Series[2].TagSet, api.TagSet{"tag": "c"})
+
+	// The three metrics are split into two batches.
+	bodies := testClient.PostedBodies(batchURL)
+	a.MustEqInt(len(bodies), 2)
+	batches := make([][]string, len(bodies))
+	for i := range bodies {
+		a.CheckError(json.Unmarshal([]byte(bodies[i]), &batches[i]))
+	}
+	if len(batches[0]) < len(batches[1]) {
+		batches[0], batches[1] = batches[1], batches[0]
+	}
+	a.Eq(batches, [][]string{{"a.graphite", "b.graphite"}, {"c.graphite"}})
+}
@@ -16,13 +16,11 @@ package blueflood
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/square/metrics/api"
@@ -34,11 +32,14 @@ import (
 
 // Blueflood is a timeseries storage API instance.
 type Blueflood struct {
-	config Config
+	config    Config
+	breaker   *breaker
+	latencies *latencyTracker
 }
 
-//Blueflood implements TimeseriesStorageAPI
+//Blueflood implements TimeseriesStorageAPI and StorageUpdateAPI
 var _ timeseries.StorageAPI = (*Blueflood)(nil)
+var _ timeseries.StorageUpdateAPI = (*Blueflood)(nil)
 
 // TimeSource represents a source of time values.
 // Its zero value will give the current time.
@@ -67,9 +68,20 @@ func (r Resolution) String() string {
 
 type Config struct {
 	BaseURL                 string       `yaml:"base_url"`
-	TenantID                string       `yaml:"tenant_id"`
+	TenantID                string       `yaml:"tenant_id"`             // TenantID is used for requests which don't name a tenant
+	Tenants                 []string     `yaml:"tenants"`               // if non-empty, requests may only name these tenants (or TenantID)
 	Resolutions             []Resolution `yaml:"resolutions"`           // Resolutions are ordered by priority: best (typically finest) first.
 	MaxSimultaneousRequests int          `yaml:"simultaneous_requests"` // simultaneous requests limits the number of concurrent single-fetches for each multi-fetch
+	BatchSize               int          `yaml:"batch_size"`            // if positive, multi-fetches POST up to this many metric names to /views at once
+
+	Retries          int           `yaml:"retries"`           // Retries is the number of extra attempts made for single (GET) fetches which fail with IO or 5xx errors.
+	RetryBackoff     time.Duration `yaml:"retry_backoff"`     // RetryBackoff is the delay before the first retry, doubling after each one (default 100ms).
+	HedgePercentile  float64       `yaml:"hedge_percentile"`  // If positive (e.g. 0.95), a second request is sent when a single (GET) fetch is slower than this percentile of recent fetches.
+	BreakerThreshold int           `yaml:"breaker_threshold"` // If positive, this many consecutive failed fetches open the circuit breaker, failing fetches immediately.
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`  // BreakerCooldown is how long the circuit breaker stays open before a trial fetch (default 30s).
+
+	IngestURL        string        `yaml:"ingest_url"` // IngestURL is where datapoints are written (defaults to BaseURL)
+	IngestTimeToLive time.Duration `yaml:"ingest_ttl"` // IngestTimeToLive is how long Blueflood keeps written datapoints (defaults to 1 day)
 
 	GraphiteMetricConverter util.GraphiteConverter
 
@@ -85,9 +97,24 @@ func NewBlueflood(c Config) timeseries.StorageAPI {
 	if c.MaxSimultaneousRequests == 0 {
 		c.MaxSimultaneousRequests = 5
 	}
+	if c.IngestURL == "" {
+		c.IngestURL = c.BaseURL
+	}
+	if c.IngestTimeToLive == 0 {
+		c.IngestTimeToLive = 24 * time.Hour
+	}
+
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 100 * time.Millisecond
+	}
+	if c.BreakerCooldown == 0 {
+		c.BreakerCooldown = 30 * time.Second
+	}
 
 	b := &Blueflood{
-		config: c,
+		config:    c,
+		breaker:   &breaker{threshold: c.BreakerThreshold, cooldown: c.BreakerCooldown},
+		latencies: &latencyTracker{},
 	}
 	// TODO: copy internal config structures to prevent modification?
 	return b
@@ -148,6 +175,10 @@ func (b *Blueflood) FetchMultipleTimeseries(request timeseries.FetchMultipleRequ
 		return api.SeriesList{}, err
 	}
 
+	if b.config.BatchSize > 0 {
+		return b.fetchBatchedTimeseries(request, plan)
+	}
+
 	singleRequests := request.ToSingle()
 	results := make([]api.Timeseries, len(singleRequests))
 	queue := tasks.NewParallelQueue(b.config.MaxSimultaneousRequests, request.Ctx)
@@ -178,6 +209,7 @@ type fetchPlan struct {
 	intervals map[Resolution]api.Interval
 	sampler   sampler
 	timerange api.Timerange
+	tenant    string
 }
 
 // createPlan uses the specified request details (which don't depend on the
@@ -187,6 +219,10 @@ func (b *Blueflood) createPlan(request timeseries.RequestDetails) (fetchPlan, er
 	if !ok {
 		return fetchPlan{}, fmt.Errorf("unsupported SampleMethod %s", request.SampleMethod.String())
 	}
+	tenant, err := b.chooseTenant(request.Tenant)
+	if err != nil {
+		return fetchPlan{}, err
+	}
 	// Extend it one point forward, unless that would fetch past the current time.
 	modifiedRange := request.Timerange
 	if modifiedRange.End().Add(modifiedRange.Resolution()).Before(b.config.TimeSource.Now()) {
@@ -200,9 +236,27 @@ func (b *Blueflood) createPlan(request timeseries.RequestDetails) (fetchPlan, er
 		intervals: intervals,
 		sampler:   samplerFunc,
 		timerange: request.Timerange,
+		tenant:    tenant,
 	}, nil
 }
 
+// chooseTenant returns the tenant to fetch from for a request naming the given
+// tenant, checking it against the allowed tenants.
+func (b *Blueflood) chooseTenant(requested string) (string, error) {
+	if requested == "" || requested == b.config.TenantID {
+		return b.config.TenantID, nil
+	}
+	if len(b.config.Tenants) == 0 {
+		return requested, nil
+	}
+	for _, allowed := range b.config.Tenants {
+		if requested == allowed {
+			return requested, nil
+		}
+	}
+	return "", timeseries.FetchError{Code: http.StatusForbidden, Message: fmt.Sprintf("tenant %q is not allowed to query Blueflood", requested)}
+}
+
 // fetchTimeseries uses the provided plan to fetch the timeseries from Blueflood
 // using several HTTP queries. FetchMultipleTimeseries defers to this method,
 // rather than FetchSingleTimeseries, in order to prevent duplicating work on a
@@ -215,12 +269,12 @@ func (b *Blueflood) fetchTimeseries(metric api.TaggedMetric, plan fetchPlan, pro
 		queue.Do(func() error {
 			defer profiler.RecordWithDescription("Blueflood FetchSingleTimeseries Resolution", fmt.Sprintf("%s at %+v", metric.String(), resolution.Resolution))()
 			// Construct the URL
-			queryURL, err := b.constructURL(metric, interval, plan.sampler, resolution)
+			queryURL, err := b.constructURL(metric, plan.tenant, interval, plan.sampler, resolution)
 			if err != nil {
 				return err
 			}
 			// Then query it.
-			points, err := b.fetchTimeseriesHTTP(queryURL, ctx)
+			points, err := b.fetchTimeseriesHTTP(metric, queryURL, ctx)
 			if err != nil {
 				return err
 			}
@@ -247,25 +301,30 @@ func (b *Blueflood) fetchTimeseries(metric api.TaggedMetric, plan fetchPlan, pro
 // ----------------
 
 // constructURL creates the URL to the blueflood's backend to fetch the data from.
-func (b *Blueflood) constructURL(metric api.TaggedMetric, interval api.Interval, sampler sampler, resolution Resolution) (*url.URL, error) {
+func (b *Blueflood) constructURL(metric api.TaggedMetric, tenant string, interval api.Interval, sampler sampler, resolution Resolution) (*url.URL, error) {
 	graphiteName, err := b.config.GraphiteMetricConverter.ToGraphiteName(metric)
 	if err != nil {
 		return nil, timeseries.Error{Metric: metric, Code: timeseries.InvalidSeriesError, Message: "cannot convert to graphite name"}
 	}
 
-	result, err := url.Parse(fmt.Sprintf("%s/v2.0/%s/views/%s", b.config.BaseURL, b.config.TenantID, graphiteName))
+	result, err := url.Parse(fmt.Sprintf("%s/v2.0/%s/views/%s", b.config.BaseURL, url.PathEscape(tenant), graphiteName))
 	if err != nil {
 		return nil, timeseries.Error{Metric: metric, Code: timeseries.InvalidSeriesError, Message: fmt.Sprintf("cannot generate URL for tagged metric with graphite name %s", graphiteName)}
 	}
 
-	result.RawQuery = url.Values{
+	result.RawQuery = queryParameters(interval, sampler, resolution).Encode()
+
+	return result, nil
+}
+
+// queryParameters describes the points to fetch from a /views endpoint.
+func queryParameters(interval api.Interval, sampler sampler, resolution Resolution) url.Values {
+	return url.Values{
 		"from":       {strconv.FormatInt(int64(interval.Start.UnixNano()/1e6), 10)},
 		"to":         {strconv.FormatInt(int64(interval.End.UnixNano()/1e6-1), 10)},
 		"resolution": {resolution.Name},
-		"select":     {fmt.Sprintf("numPoints,%s", strings.ToLower(sampler.fieldName))},
-	}.Encode()
-
-	return result, nil
+		"select":     {sampler.selectFields()},
+	}
 }
 
 type httpClient interface {
@@ -275,28 +334,13 @@ type httpClient interface {
 }
 
 // fetch fetches from the backend, asynchronously calling performFetch and cancelling on timeout.
-func (b *Blueflood) fetchTimeseriesHTTP(queryURL *url.URL, ctx context.Context) ([]metricPoint, error) {
-	request, err := http.NewRequest("GET", queryURL.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-	request.Cancel = ctx.Done()
-	response, err := b.config.HTTPClient.Do(request)
-	if err != nil {
-		return nil, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error fetching from Blueflood at URL %q: %s", queryURL.String(), err.Error())}
-	}
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error reading from Blueflood response body at URL %q: %s", queryURL.String(), err.Error())}
-	}
-	err = response.Body.Close()
-	if err != nil {
-		return nil, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error finishing response from Blueflood at URL %q: %s", queryURL.String(), err.Error())}
+func (b *Blueflood) fetchTimeseriesHTTP(metric api.TaggedMetric, queryURL *url.URL, ctx context.Context) ([]metricPoint, error) {
+	newRequest := func() (*http.Request, error) {
+		return http.NewRequest("GET", queryURL.String(), nil)
 	}
 	var parsedJSON queryResponse
-	err = json.Unmarshal(body, &parsedJSON)
-	if err != nil {
-		return nil, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error unmarshaling JSON from Blueflood at URL %q: %s;\nBody:%s", queryURL.String(), err.Error(), body)}
+	if err := b.performFetch(metric, newRequest, true, ctx, &parsedJSON); err != nil {
+		return nil, err
 	}
 	return parsedJSON.Values, nil
 }
@@ -312,4 +356,7 @@ type metricPoint struct {
 	Max       float64 `json:"max"`
 	Min       float64 `json:"min"`
 	Variance  float64 `json:"variance"`
+	// Percentiles are only present for metrics (such as timers) which keep them.
+	// They are keyed by percentile without a "p" prefix, such as "99" or "999".
+	Percentiles map[string]float64 `json:"percentiles"`
 }
@@ -0,0 +1,96 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueflood
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/util"
+)
+
+// ingestPoint is the JSON form of a datapoint accepted by Blueflood's ingest endpoint.
+type ingestPoint struct {
+	CollectionTime int64   `json:"collectionTime"`
+	TimeToLive     int64   `json:"ttlInSeconds"`
+	MetricValue    float64 `json:"metricValue"`
+	MetricName     string  `json:"metricName"`
+}
+
+// WritePoints converts the datapoints' metrics to graphite names and POSTs
+// them to Blueflood's ingest endpoint. NaN and infinite values have no JSON
+// form, so those datapoints are dropped rather than failing the batch.
+func (b *Blueflood) WritePoints(request timeseries.WriteRequest) error {
+	defer request.Profiler.RecordWithDescription("Blueflood WritePoints", fmt.Sprintf("%d datapoints", len(request.Datapoints)))()
+	if len(request.Datapoints) == 0 {
+		return nil
+	}
+	names := map[string]util.GraphiteMetric{} // metric => graphite name, to convert each metric once
+	points := make([]ingestPoint, 0, len(request.Datapoints))
+	for _, datapoint := range request.Datapoints {
+		if math.IsNaN(datapoint.Value) || math.IsInf(datapoint.Value, 0) {
+			continue
+		}
+		key := datapoint.Metric.String()
+		name, ok := names[key]
+		if !ok {
+			var err error
+			name, err = b.config.GraphiteMetricConverter.ToGraphiteName(datapoint.Metric)
+			if err != nil {
+				return timeseries.Error{Metric: datapoint.Metric, Code: timeseries.InvalidSeriesError, Message: "cannot convert to graphite name"}
+			}
+			names[key] = name
+		}
+		points = append(points, ingestPoint{
+			CollectionTime: datapoint.Timestamp.UnixNano() / 1e6,
+			TimeToLive:     int64(b.config.IngestTimeToLive / time.Second),
+			MetricValue:    datapoint.Value,
+			MetricName:     string(name),
+		})
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+
+	ingestURL := fmt.Sprintf("%s/v2.0/%s/ingest", b.config.IngestURL, b.config.TenantID)
+	httpRequest, err := http.NewRequest("POST", ingestURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if request.Ctx != nil {
+		httpRequest.Cancel = request.Ctx.Done()
+	}
+	response, err := b.config.HTTPClient.Do(httpRequest)
+	if err != nil {
+		return timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error writing to Blueflood at URL %q: %s", ingestURL, err.Error())}
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		return timeseries.FetchError{Code: 500, Message: fmt.Sprintf("Blueflood at URL %q rejected datapoints with status %d: %s", ingestURL, response.StatusCode, responseBody)}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueflood
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/util"
+)
+
+func TestWritePoints(t *testing.T) {
+	a := assert.New(t)
+	testClient := mocks.NewFakeHTTPClient()
+	ingestURL := "https://blueflood-ingest.url/v2.0/square/ingest"
+	testClient.SetResponse(ingestURL, mocks.Response{StatusCode: 200})
+	blueflood := NewBlueflood(Config{
+		BaseURL:   "https://blueflood.url",
+		IngestURL: "https://blueflood-ingest.url",
+		TenantID:  "square",
+		GraphiteMetricConverter: &mocks.FakeGraphiteConverter{
+			MetricMap: map[util.GraphiteMetric]api.TaggedMetric{
+				"some.key.graphite": {MetricKey: "some.key", TagSet: api.TagSet{"tag": "value"}},
+			},
+		},
+		HTTPClient: testClient,
+	}).(timeseries.StorageUpdateAPI)
+
+	metric := api.TaggedMetric{MetricKey: "some.key", TagSet: api.TagSet{"tag": "value"}}
+	err := blueflood.WritePoints(timeseries.WriteRequest{
+		Datapoints: []timeseries.Datapoint{
+			{Metric: metric, Timestamp: time.Unix(739907880, 0), Value: 5},
+			{Metric: metric, Timestamp: time.Unix(739907910, 500e6), Value: -2.5},
+		},
+		Ctx: context.Background(),
+	})
+	a.CheckError(err)
+
+	bodies := testClient.PostedBodies(ingestURL)
+	a.MustEqInt(len(bodies), 1)
+	posted := []ingestPoint{}
+	a.CheckError(json.Unmarshal([]byte(bodies[0]), &posted))
+	a.Eq(posted, []ingestPoint{
+		{CollectionTime: 739907880000, TimeToLive: 86400, MetricValue: 5, MetricName: "some.key.graphite"},
+		{CollectionTime: 739907910500, TimeToLive: 86400, MetricValue: -2.5, MetricName: "some.key.graphite"},
+	})
+
+	// Metrics without a graphite name are rejected before anything is written.
+	err = blueflood.WritePoints(timeseries.WriteRequest{
+		Datapoints: []timeseries.Datapoint{
+			{Metric: metric, Timestamp: time.Unix(739907940, 0), Value: 1},
+			{Metric: api.TaggedMetric{MetricKey: "unknown", TagSet: api.TagSet{}}, Timestamp: time.Unix(739907940, 0), Value: 1},
+		},
+		Ctx: context.Background(),
+	})
+	if seriesErr, ok := err.(timeseries.Error); !ok || seriesErr.Code != timeseries.InvalidSeriesError {
+		t.Errorf("expected an InvalidSeriesError for an unconvertible metric, but got %#v", err)
+	}
+	a.EqInt(len(testClient.PostedBodies(ingestURL)), 1)
+
+	// Non-finite values can't be encoded, so they're dropped and the finite
+	// points are still written.
+	err = blueflood.WritePoints(timeseries.WriteRequest{
+		Datapoints: []timeseries.Datapoint{
+			{Metric: metric, Timestamp: time.Unix(739907970, 0), Value: math.NaN()},
+			{Metric: metric, Timestamp: time.Unix(739908000, 0), Value: 3},
+			{Metric: metric, Timestamp: time.Unix(739908030, 0), Value: math.Inf(-1)},
+		},
+		Ctx: context.Background(),
+	})
+	a.CheckError(err)
+	bodies = testClient.PostedBodies(ingestURL)
+	a.MustEqInt(len(bodies), 2)
+	posted = []ingestPoint{}
+	a.CheckError(json.Unmarshal([]byte(bodies[1]), &posted))
+	a.Eq(posted, []ingestPoint{
+		{CollectionTime: 739908000000, TimeToLive: 86400, MetricValue: 3, MetricName: "some.key.graphite"},
+	})
+
+	// A batch with only non-finite values writes nothing.
+	err = blueflood.WritePoints(timeseries.WriteRequest{
+		Datapoints: []timeseries.Datapoint{
+			{Metric: metric, Timestamp: time.Unix(739908060, 0), Value: math.Inf(1)},
+		},
+		Ctx: context.Background(),
+	})
+	a.CheckError(err)
+	a.EqInt(len(testClient.PostedBodies(ingestURL)), 2)
+}
+
+func TestWritePointsRejected(t *testing.T) {
+	testClient := mocks.NewFakeHTTPClient()
+	testClient.SetResponse("https://blueflood.url/v2.0/square/ingest", mocks.Response{StatusCode: 400, Body: "bad points"})
+	blueflood := NewBlueflood(Config{
+		BaseURL:  "https://blueflood.url",
+		TenantID: "square",
+		GraphiteMetricConverter: &mocks.FakeGraphiteConverter{
+			MetricMap: map[util.GraphiteMetric]api.TaggedMetric{
+				"some.key": {MetricKey: "some.key", TagSet: api.TagSet{}},
+			},
+		},
+		HTTPClient: testClient,
+	}).(timeseries.StorageUpdateAPI)
+	err := blueflood.WritePoints(timeseries.WriteRequest{
+		Datapoints: []timeseries.Datapoint{
+			{Metric: api.TaggedMetric{MetricKey: "some.key", TagSet: api.TagSet{}}, Timestamp: time.Unix(0, 0), Value: 1},
+		},
+		Ctx: context.Background(),
+	})
+	if _, ok := err.(timeseries.FetchError); !ok {
+		t.Errorf("expected a FetchError for a rejected write, but got %#v", err)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueflood
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/timeseries"
+)
+
+const (
+	latencySamples    = 128 // latencySamples is the number of recent fetch latencies remembered for hedging.
+	minLatencySamples = 20  // minLatencySamples is the number of latencies needed before fetches are hedged.
+)
+
+// attemptOutcome is the result of a single HTTP request to Blueflood.
+type attemptOutcome struct {
+	url       string
+	body      []byte
+	retryable bool // retryable is set for failures which another attempt may avoid
+	err       error
+}
+
+// performFetch sends requests created by newRequest to Blueflood (cancelling
+// them when the context is done) and unmarshals the JSON response into the
+// result. Nothing is sent while the circuit breaker is open. Idempotent
+// requests are retried when they fail and hedged when they're slow; others
+// are only sent once.
+func (b *Blueflood) performFetch(metric api.TaggedMetric, newRequest func() (*http.Request, error), idempotent bool, ctx context.Context, result interface{}) error {
+	retries := 0
+	if idempotent {
+		retries = b.config.Retries
+	}
+	backoff := b.config.RetryBackoff
+	var outcome attemptOutcome
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return timeseries.Error{Metric: metric, Code: timeseries.FetchTimeoutError, Message: fmt.Sprintf("gave up retrying Blueflood after %d attempts: %s", attempt, outcome.err.Error())}
+			}
+			backoff *= 2
+		}
+		if !b.breaker.allow(b.config.TimeSource.Now()) {
+			// Every series would fail the same way, so this isn't a series error.
+			return timeseries.FetchError{Code: http.StatusServiceUnavailable, Message: "Blueflood circuit breaker is open after repeated failures"}
+		}
+		if idempotent {
+			outcome = b.hedgedAttempt(newRequest, ctx)
+		} else {
+			outcome = b.attempt(newRequest, ctx)
+		}
+		// Only failures which may be transient count against the backend, and
+		// attempts cut short by the context say nothing about it.
+		if ctx.Err() != nil {
+			b.breaker.release()
+		} else {
+			b.breaker.record(outcome.err == nil || !outcome.retryable, b.config.TimeSource.Now())
+		}
+		if outcome.err == nil || !outcome.retryable {
+			break
+		}
+	}
+	if outcome.err != nil {
+		return outcome.err
+	}
+	if err := json.Unmarshal(outcome.body, result); err != nil {
+		return timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error unmarshaling JSON from Blueflood at URL %q: %s;\nBody:%s", outcome.url, err.Error(), outcome.body)}
+	}
+	return nil
+}
+
+// hedgedAttempt makes a request, and if hedging is enabled and the request is
+// slower than the configured percentile of recent requests, makes a second
+// one. The first successful response is used.
+func (b *Blueflood) hedgedAttempt(newRequest func() (*http.Request, error), ctx context.Context) attemptOutcome {
+	if b.config.HedgePercentile <= 0 {
+		return b.attempt(newRequest, ctx)
+	}
+	delay, ok := b.latencies.percentile(b.config.HedgePercentile)
+	if !ok {
+		return b.attempt(newRequest, ctx)
+	}
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel() // cancels whichever request is still running
+	outcomes := make(chan attemptOutcome, 2)
+	launch := func() {
+		go func() {
+			outcomes <- b.attempt(newRequest, hedgeCtx)
+		}()
+	}
+	launch()
+	pending, hedged := 1, false
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var outcome attemptOutcome
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			hedged = true
+			pending++
+			launch()
+		case outcome = <-outcomes:
+			pending--
+			if outcome.err == nil || !hedged {
+				return outcome
+			}
+		}
+	}
+	return outcome
+}
+
+// attempt makes a single request to Blueflood.
+func (b *Blueflood) attempt(newRequest func() (*http.Request, error), ctx context.Context) attemptOutcome {
+	request, err := newRequest()
+	if err != nil {
+		return attemptOutcome{err: err}
+	}
+	queryURL := request.URL
+	request.Cancel = ctx.Done()
+	start := time.Now()
+	response, err := b.config.HTTPClient.Do(request)
+	if err != nil {
+		// Client errors won't be fixed by trying again.
+		retryable := response == nil || response.StatusCode/100 != 4
+		return attemptOutcome{retryable: retryable, err: timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error fetching from Blueflood at URL %q: %s", queryURL.String(), err.Error())}}
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return attemptOutcome{retryable: true, err: timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error reading from Blueflood response body at URL %q: %s", queryURL.String(), err.Error())}}
+	}
+	err = response.Body.Close()
+	if err != nil {
+		return attemptOutcome{retryable: true, err: timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error finishing response from Blueflood at URL %q: %s", queryURL.String(), err.Error())}}
+	}
+	if response.StatusCode/100 == 5 {
+		return attemptOutcome{retryable: true, err: timeseries.FetchError{Code: 500, Message: fmt.Sprintf("Blueflood at URL %q returned status %d: %s", queryURL.String(), response.StatusCode, body)}}
+	}
+	b.latencies.record(time.Since(start))
+	return attemptOutcome{url: queryURL.String(), body: body}
+}
+
+// breaker is a circuit breaker. After threshold consecutive failures it opens,
+// rejecting requests until the cooldown has passed. Then a single trial request
+// is let through, which closes the breaker if it succeeds.
+type breaker struct {
+	threshold int // threshold is 0 if the breaker is disabled
+	cooldown  time.Duration
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool // trial is set while the trial request is in flight
+}
+
+// allow returns whether a request may be sent.
+func (br *breaker) allow(now time.Time) bool {
+	if br.threshold <= 0 {
+		return true
+	}
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	if br.failures < br.threshold {
+		return true
+	}
+	if now.Before(br.openUntil) || br.trial {
+		return false
+	}
+	br.trial = true
+	return true
+}
+
+// record notes the outcome of a request which was allowed.
+func (br *breaker) record(success bool, now time.Time) {
+	if br.threshold <= 0 {
+		return
+	}
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	br.trial = false
+	if success {
+		br.failures = 0
+		return
+	}
+	br.failures++
+	if br.failures >= br.threshold {
+		br.openUntil = now.Add(br.cooldown)
+	}
+}
+
+// release notes that a request which was allowed ended without an outcome,
+// so that another trial request may be let through.
+func (br *breaker) release() {
+	if br.threshold <= 0 {
+		return
+	}
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	br.trial = false
+}
+
+// latencyTracker remembers the latencies of recent successful requests.
+type latencyTracker struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+	next    int // next is the index of the oldest sample, once the samples are full
+}
+
+func (l *latencyTracker) record(latency time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, latency)
+		return
+	}
+	l.samples[l.next] = latency
+	l.next = (l.next + 1) % latencySamples
+}
+
+// percentile returns the given percentile (between 0 and 1) of the recent
+// latencies, or false if too few have been recorded.
+func (l *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	l.mutex.Lock()
+	sorted := append([]time.Duration{}, l.samples...)
+	l.mutex.Unlock()
+	if len(sorted) < minLatencySamples {
+		return 0, false
+	}
+	sort.Sort(durations(sorted))
+	index := int(p * float64(len(sorted)-1))
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index], true
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
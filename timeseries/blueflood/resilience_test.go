@@ -0,0 +1,229 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueflood
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/util"
+)
+
+const resilienceURL = "https://blueflood.url/v2.0/square/views/some.key.graphite?from=739907880000&resolution=FULL&select=numPoints%2Caverage&to=739907999999"
+
+var resilienceOK = mocks.Response{
+	Body:       `{"values": [{"numPoints": 1, "timestamp": 739907880000, "average": 5}]}`,
+	StatusCode: 200,
+}
+
+// resilienceTest fetches a single series from a Blueflood whose clock can be moved.
+type resilienceTest struct {
+	t         *testing.T
+	client    *mocks.FakeHTTPClient
+	now       time.Time
+	blueflood *Blueflood
+}
+
+func newResilienceTest(t *testing.T, config Config) *resilienceTest {
+	test := &resilienceTest{
+		t:      t,
+		client: mocks.NewFakeHTTPClient(),
+		now:    time.Unix(739908000, 0),
+	}
+	config.BaseURL = "https://blueflood.url"
+	config.TenantID = "square"
+	config.Resolutions = []Resolution{resolutionFull, resolution5Min, resolution60Min, resolution1440Min}
+	config.GraphiteMetricConverter = &mocks.FakeGraphiteConverter{
+		MetricMap: map[util.GraphiteMetric]api.TaggedMetric{
+			"some.key.graphite": {MetricKey: "some.key", TagSet: api.TagSet{"tag": "value"}},
+		},
+	}
+	config.HTTPClient = test.client
+	config.TimeSource = TimeSource{GetTime: func() time.Time { return test.now }}
+	test.blueflood = NewBlueflood(config).(*Blueflood)
+	return test
+}
+
+func (test *resilienceTest) fetch() (api.Timeseries, error) {
+	return test.fetchWithContext(context.Background())
+}
+
+func (test *resilienceTest) fetchWithContext(ctx context.Context) (api.Timeseries, error) {
+	timerange, err := api.NewTimerange(739907880000, 739908000000, 30000)
+	if err != nil {
+		test.t.Fatalf("Unexpected error creating timerange: %s", err.Error())
+	}
+	return test.blueflood.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: api.TaggedMetric{MetricKey: "some.key", TagSet: api.TagSet{"tag": "value"}},
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          ctx,
+		},
+	})
+}
+
+func TestRetries(t *testing.T) {
+	a := assert.New(t)
+	test := newResilienceTest(t, Config{Retries: 2, RetryBackoff: time.Millisecond})
+	test.client.SetResponse(resilienceURL, resilienceOK)
+	test.client.QueueResponses(resilienceURL, mocks.Response{StatusCode: 500}, mocks.Response{StatusCode: 503})
+
+	series, err := test.fetch()
+	a.CheckError(err)
+	a.EqFloat(series.Values[0], 5, 1e-9)
+	a.EqInt(test.client.RequestCount(resilienceURL), 3)
+
+	// Giving up after the last retry.
+	test.client.QueueResponses(resilienceURL, mocks.Response{StatusCode: 500}, mocks.Response{StatusCode: 500}, mocks.Response{StatusCode: 500})
+	if _, err := test.fetch(); err == nil {
+		t.Errorf("expected an error once every retry failed")
+	}
+	a.EqInt(test.client.RequestCount(resilienceURL), 6)
+}
+
+func TestClientErrorsAreNotRetried(t *testing.T) {
+	a := assert.New(t)
+	test := newResilienceTest(t, Config{Retries: 2, RetryBackoff: time.Millisecond})
+	test.client.SetResponse(resilienceURL, resilienceOK)
+	test.client.QueueResponses(resilienceURL, mocks.Response{StatusCode: 404})
+
+	if _, err := test.fetch(); err == nil {
+		t.Errorf("expected an error for a 404 response")
+	}
+	a.EqInt(test.client.RequestCount(resilienceURL), 1)
+}
+
+func TestBatchedFetchesAreNotRetried(t *testing.T) {
+	a := assert.New(t)
+	test := newResilienceTest(t, Config{Retries: 2, RetryBackoff: time.Millisecond, HedgePercentile: 0.9})
+	for i := 0; i < minLatencySamples; i++ {
+		test.blueflood.latencies.record(time.Millisecond)
+	}
+	batchURL := "https://blueflood.url/v2.0/square/views?from=739907880000&resolution=FULL&select=numPoints%2Caverage&to=739907999999"
+	test.client.SetResponse(batchURL, mocks.Response{Body: `{"metrics": []}`, StatusCode: 200})
+	slow := mocks.Response{Body: `{"metrics": []}`, StatusCode: 200, Delay: 50 * time.Millisecond}
+	test.client.QueueResponses(batchURL, mocks.Response{StatusCode: 500}, slow)
+
+	metric := api.TaggedMetric{MetricKey: "some.key", TagSet: api.TagSet{"tag": "value"}}
+	rawQuery := "from=739907880000&resolution=FULL&select=numPoints%2Caverage&to=739907999999"
+	if _, err := test.blueflood.fetchBatchHTTP(metric, "square", []string{"some.key.graphite"}, rawQuery, context.Background()); err == nil {
+		t.Errorf("expected an error for a 500 response")
+	}
+	a.EqInt(test.client.RequestCount(batchURL), 1)
+
+	// A slow POST isn't hedged either.
+	_, err := test.blueflood.fetchBatchHTTP(metric, "square", []string{"some.key.graphite"}, rawQuery, context.Background())
+	a.CheckError(err)
+	a.EqInt(test.client.RequestCount(batchURL), 2)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	a := assert.New(t)
+	test := newResilienceTest(t, Config{BreakerThreshold: 2, BreakerCooldown: time.Minute})
+	test.client.SetResponse(resilienceURL, mocks.Response{StatusCode: 500})
+
+	for i := 0; i < 2; i++ {
+		if _, err := test.fetch(); err == nil {
+			t.Fatalf("expected an error for a 500 response")
+		}
+	}
+	// The breaker is now open, so Blueflood isn't contacted.
+	_, err := test.fetch()
+	if fetchErr, ok := err.(timeseries.FetchError); !ok || fetchErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 FetchError from the open circuit breaker, but got %#v", err)
+	}
+	a.EqInt(test.client.RequestCount(resilienceURL), 2)
+
+	// After the cooldown, a successful trial closes the breaker.
+	// Since time has passed, the requested range is extended by a slot.
+	test.now = test.now.Add(time.Minute)
+	extendedURL := "https://blueflood.url/v2.0/square/views/some.key.graphite?from=739907880000&resolution=FULL&select=numPoints%2Caverage&to=739908029999"
+	test.client.SetResponse(extendedURL, resilienceOK)
+	_, err = test.fetch()
+	a.CheckError(err)
+	_, err = test.fetch()
+	a.CheckError(err)
+	a.EqInt(test.client.RequestCount(extendedURL), 2)
+}
+
+func TestCircuitBreakerIgnoresCancellation(t *testing.T) {
+	a := assert.New(t)
+	test := newResilienceTest(t, Config{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	test.client.SetResponse(resilienceURL, mocks.Response{StatusCode: 500, Delay: 20 * time.Millisecond})
+
+	// Failures of fetches whose context ended meanwhile aren't held against
+	// Blueflood.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		_, err := test.fetchWithContext(ctx)
+		cancel()
+		if err == nil {
+			t.Fatalf("expected an error for a timed out fetch")
+		}
+		// The fetch returns once its context ends, so wait for the attempt to finish.
+		time.Sleep(30 * time.Millisecond)
+	}
+	a.EqInt(test.client.RequestCount(resilienceURL), 2)
+
+	test.client.SetResponse(resilienceURL, resilienceOK)
+	_, err := test.fetch()
+	a.CheckError(err)
+	a.EqInt(test.client.RequestCount(resilienceURL), 3)
+}
+
+func TestHedgedRequests(t *testing.T) {
+	a := assert.New(t)
+	test := newResilienceTest(t, Config{HedgePercentile: 0.9})
+	for i := 0; i < minLatencySamples; i++ {
+		test.blueflood.latencies.record(time.Millisecond)
+	}
+	test.client.SetResponse(resilienceURL, resilienceOK)
+	slow := resilienceOK
+	slow.Delay = 500 * time.Millisecond
+	test.client.QueueResponses(resilienceURL, slow)
+
+	start := time.Now()
+	series, err := test.fetch()
+	a.CheckError(err)
+	a.EqFloat(series.Values[0], 5, 1e-9)
+	if elapsed := time.Since(start); elapsed >= slow.Delay {
+		t.Errorf("expected the hedged request to finish before the slow one, but it took %+v", elapsed)
+	}
+	a.EqInt(test.client.RequestCount(resilienceURL), 2)
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	a := assert.New(t)
+	tracker := &latencyTracker{}
+	if _, ok := tracker.percentile(0.5); ok {
+		t.Errorf("expected no percentile without enough samples")
+	}
+	for i := 1; i <= latencySamples+10; i++ {
+		tracker.record(time.Duration(i) * time.Millisecond)
+	}
+	// The oldest 10 samples have been replaced.
+	median, ok := tracker.percentile(0.5)
+	a.Eq(ok, true)
+	a.Eq(median, 74*time.Millisecond)
+	highest, _ := tracker.percentile(1)
+	a.Eq(highest, time.Duration(latencySamples+10)*time.Millisecond)
+}
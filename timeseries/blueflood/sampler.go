@@ -16,28 +16,32 @@ package blueflood
 
 import (
 	"math"
+	"strings"
 
 	"github.com/square/metrics/api"
 	"github.com/square/metrics/timeseries"
 )
 
 type sampler struct {
-	fieldName    string                          // Name of field in Blueflood JSON response
-	selectField  func(point metricPoint) float64 // Function for extracting field from metricPoint
-	sampleBucket func([]float64) float64         // Function to sample from the bucket (e.g., min, mean, max)
+	fieldNames   []string                    // Names of fields in Blueflood JSON response (besides numPoints)
+	sampleBucket func([]metricPoint) float64 // Function to sample from the bucket (e.g., min, mean, max)
+}
+
+// selectFields returns the value of the "select" query parameter for the sampler.
+func (s sampler) selectFields() string {
+	return strings.Join(append([]string{"numPoints"}, s.fieldNames...), ",")
 }
 
 // sampleResult samples the points into a uniform slice of float64s.
 func samplePoints(points []metricPoint, timerange api.Timerange, sampler sampler) []float64 {
 	// A bucket holds a set of points corresponding to one interval in the result.
-	buckets := make([][]float64, timerange.Slots())
+	buckets := make([][]metricPoint, timerange.Slots())
 	for _, point := range points {
-		pointValue := sampler.selectField(point)
 		index := (point.Timestamp - timerange.StartMillis()) / timerange.ResolutionMillis()
 		if index < 0 || int(index) >= len(buckets) {
 			continue
 		}
-		buckets[index] = append(buckets[index], pointValue)
+		buckets[index] = append(buckets[index], point)
 	}
 
 	// values will hold the final values to be returned as the series.
@@ -55,14 +59,13 @@ func samplePoints(points []metricPoint, timerange api.Timerange, sampler sampler
 
 var samplerMap = map[timeseries.SampleMethod]sampler{
 	timeseries.SampleMean: {
-		fieldName:   "average",
-		selectField: func(point metricPoint) float64 { return point.Average },
-		sampleBucket: func(bucket []float64) float64 {
+		fieldNames: []string{"average"},
+		sampleBucket: func(bucket []metricPoint) float64 {
 			value := 0.0
 			count := 0
-			for _, v := range bucket {
-				if !math.IsNaN(v) {
-					value += v
+			for _, point := range bucket {
+				if !math.IsNaN(point.Average) {
+					value += point.Average
 					count++
 				}
 			}
@@ -70,39 +73,122 @@ var samplerMap = map[timeseries.SampleMethod]sampler{
 		},
 	},
 	timeseries.SampleMin: {
-		fieldName:   "min",
-		selectField: func(point metricPoint) float64 { return point.Min },
-		sampleBucket: func(bucket []float64) float64 {
+		fieldNames: []string{"min"},
+		sampleBucket: func(bucket []metricPoint) float64 {
 			smallest := math.NaN()
-			for _, v := range bucket {
-				if math.IsNaN(v) {
+			for _, point := range bucket {
+				if math.IsNaN(point.Min) {
 					continue
 				}
 				if math.IsNaN(smallest) {
-					smallest = v
+					smallest = point.Min
 				} else {
-					smallest = math.Min(smallest, v)
+					smallest = math.Min(smallest, point.Min)
 				}
 			}
 			return smallest
 		},
 	},
 	timeseries.SampleMax: {
-		fieldName:   "max",
-		selectField: func(point metricPoint) float64 { return point.Max },
-		sampleBucket: func(bucket []float64) float64 {
+		fieldNames: []string{"max"},
+		sampleBucket: func(bucket []metricPoint) float64 {
 			largest := math.NaN()
-			for _, v := range bucket {
-				if math.IsNaN(v) {
+			for _, point := range bucket {
+				if math.IsNaN(point.Max) {
 					continue
 				}
 				if math.IsNaN(largest) {
-					largest = v
+					largest = point.Max
 				} else {
-					largest = math.Max(largest, v)
+					largest = math.Max(largest, point.Max)
 				}
 			}
 			return largest
 		},
 	},
+	timeseries.SampleCount: {
+		fieldNames: nil, // numPoints is always selected
+		sampleBucket: func(bucket []metricPoint) float64 {
+			count := 0
+			for _, point := range bucket {
+				count += point.Points
+			}
+			return float64(count)
+		},
+	},
+	timeseries.SampleSum: {
+		fieldNames: []string{"average"},
+		sampleBucket: func(bucket []metricPoint) float64 {
+			sum := 0.0
+			for _, point := range bucket {
+				if point.Points == 0 || math.IsNaN(point.Average) {
+					continue
+				}
+				sum += point.Average * float64(point.Points)
+			}
+			return sum
+		},
+	},
+	timeseries.SampleStddev: {
+		fieldNames: []string{"average", "variance"},
+		sampleBucket: func(bucket []metricPoint) float64 {
+			// Each point is a rollup of numPoints raw values with the given
+			// (population) mean and variance. Their pooled variance is the
+			// weighted mean of their variances plus the variance of their means.
+			count := 0.0
+			mean := 0.0
+			for _, point := range bucket {
+				if point.Points == 0 || math.IsNaN(point.Average) {
+					continue
+				}
+				count += float64(point.Points)
+				mean += point.Average * float64(point.Points)
+			}
+			if count == 0 {
+				return math.NaN()
+			}
+			mean /= count
+			variance := 0.0
+			for _, point := range bucket {
+				if point.Points == 0 || math.IsNaN(point.Average) {
+					continue
+				}
+				deviation := point.Average - mean
+				variance += float64(point.Points) * (point.Variance + deviation*deviation)
+			}
+			return math.Sqrt(variance / count)
+		},
+	},
+	timeseries.SampleP50:  percentileSampler(timeseries.SampleP50),
+	timeseries.SampleP75:  percentileSampler(timeseries.SampleP75),
+	timeseries.SampleP90:  percentileSampler(timeseries.SampleP90),
+	timeseries.SampleP95:  percentileSampler(timeseries.SampleP95),
+	timeseries.SampleP98:  percentileSampler(timeseries.SampleP98),
+	timeseries.SampleP99:  percentileSampler(timeseries.SampleP99),
+	timeseries.SampleP999: percentileSampler(timeseries.SampleP999),
+}
+
+// percentileSampler chooses a percentile from the points' "percentiles" field.
+// Percentiles of separate rollups can't be combined exactly, so when several
+// points fall into one slot the largest is chosen as an upper bound.
+func percentileSampler(method timeseries.SampleMethod) sampler {
+	percentile := method.Percentile()
+	return sampler{
+		fieldNames: []string{"percentiles"},
+		sampleBucket: func(bucket []metricPoint) float64 {
+			largest := math.NaN()
+			for _, point := range bucket {
+				value, ok := point.Percentiles[percentile]
+				if !ok || math.IsNaN(value) {
+					continue
+				}
+				if math.IsNaN(largest) {
+					largest = value
+				} else {
+					largest = math.Max(largest, value)
+				}
+			}
+			return largest
+		},
+	}
 }
@@ -0,0 +1,92 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueflood
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/timeseries"
+)
+
+func TestSamplePoints(t *testing.T) {
+	a := assert.New(t)
+	timerange, err := api.NewTimerange(0, 60000, 30000)
+	a.CheckError(err)
+	// The first slot holds two rollups: {1, 3} and {2, 4, 6, 8}.
+	// The second slot holds a single raw point, and the third is empty.
+	points := []metricPoint{
+		{Timestamp: 0, Points: 2, Average: 2, Variance: 1, Min: 1, Max: 3},
+		{Timestamp: 10000, Points: 4, Average: 5, Variance: 5, Min: 2, Max: 8},
+		{Timestamp: 30000, Points: 1, Average: 7, Min: 7, Max: 7},
+		{Timestamp: 90000, Points: 1, Average: 100, Min: 100, Max: 100}, // outside the timerange
+	}
+	nan := math.NaN()
+	tests := []struct {
+		method   timeseries.SampleMethod
+		selected string
+		expected []float64
+	}{
+		{timeseries.SampleMean, "numPoints,average", []float64{3.5, 7, nan}},
+		{timeseries.SampleMin, "numPoints,min", []float64{1, 7, nan}},
+		{timeseries.SampleMax, "numPoints,max", []float64{8, 7, nan}},
+		{timeseries.SampleCount, "numPoints", []float64{6, 1, nan}},
+		{timeseries.SampleSum, "numPoints,average", []float64{24, 7, nan}},
+		// The variance of {1, 3, 2, 4, 6, 8} is 34/6.
+		{timeseries.SampleStddev, "numPoints,average,variance", []float64{math.Sqrt(34.0 / 6), 0, nan}},
+	}
+	for _, test := range tests {
+		a := a.Contextf("%s", test.method)
+		sampler, ok := samplerMap[test.method]
+		if !ok {
+			t.Errorf("no sampler for %s", test.method)
+			continue
+		}
+		a.EqString(sampler.selectFields(), test.selected)
+		a.EqFloatArray(samplePoints(points, timerange, sampler), test.expected, 1e-9)
+	}
+}
+
+func TestSamplePercentiles(t *testing.T) {
+	a := assert.New(t)
+	timerange, err := api.NewTimerange(0, 60000, 30000)
+	a.CheckError(err)
+	var response queryResponse
+	a.CheckError(json.Unmarshal([]byte(`{"values": [
+		{"timestamp": 0, "numPoints": 10, "percentiles": {"50": 12, "99": 40, "999": 95}},
+		{"timestamp": 10000, "numPoints": 10, "percentiles": {"50": 14, "99": 35}},
+		{"timestamp": 30000, "numPoints": 10, "percentiles": {"50": 11}}
+	]}`), &response))
+
+	nan := math.NaN()
+	tests := []struct {
+		method   timeseries.SampleMethod
+		expected []float64
+	}{
+		{timeseries.SampleP50, []float64{14, 11, nan}},
+		{timeseries.SampleP99, []float64{40, nan, nan}},
+		{timeseries.SampleP999, []float64{95, nan, nan}},
+		{timeseries.SampleP75, []float64{nan, nan, nan}},
+	}
+	for _, test := range tests {
+		a := a.Contextf("%s", test.method)
+		sampler := samplerMap[test.method]
+		a.EqString(sampler.selectFields(), "numPoints,percentiles")
+		a.EqFloatArray(samplePoints(response.Values, timerange, sampler), test.expected, 1e-9)
+	}
+}
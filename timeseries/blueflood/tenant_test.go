@@ -0,0 +1,75 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blueflood
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/timeseries"
+)
+
+func TestTenants(t *testing.T) {
+	a := assert.New(t)
+	test := newResilienceTest(t, Config{Tenants: []string{"payments"}})
+	for _, tenant := range []string{"square", "payments"} {
+		test.client.SetResponse(strings.Replace(resilienceURL, "/square/", "/"+tenant+"/", 1), resilienceOK)
+	}
+	timerange, err := api.NewTimerange(739907880000, 739908000000, 30000)
+	a.CheckError(err)
+	fetch := func(tenant string) error {
+		_, err := test.blueflood.FetchSingleTimeseries(timeseries.FetchRequest{
+			Metric: api.TaggedMetric{MetricKey: "some.key", TagSet: api.TagSet{"tag": "value"}},
+			RequestDetails: timeseries.RequestDetails{
+				SampleMethod: timeseries.SampleMean,
+				Timerange:    timerange,
+				Ctx:          context.Background(),
+				Tenant:       tenant,
+			},
+		})
+		return err
+	}
+
+	// Requests without a tenant use TenantID, which is always allowed.
+	a.CheckError(fetch(""))
+	a.CheckError(fetch("square"))
+	a.EqInt(test.client.RequestCount(resilienceURL), 2)
+
+	a.CheckError(fetch("payments"))
+	a.EqInt(test.client.RequestCount(strings.Replace(resilienceURL, "/square/", "/payments/", 1)), 1)
+
+	err = fetch("other")
+	if fetchErr, ok := err.(timeseries.FetchError); !ok || fetchErr.ErrorCode() != http.StatusForbidden {
+		t.Errorf("expected a forbidden FetchError for a tenant which isn't allowed, but got %#v", err)
+	}
+
+	// Without an allow-list, any tenant may be named.
+	open := newResilienceTest(t, Config{})
+	open.client.SetResponse(strings.Replace(resilienceURL, "/square/", "/other/", 1), resilienceOK)
+	_, err = open.blueflood.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: api.TaggedMetric{MetricKey: "some.key", TagSet: api.TagSet{"tag": "value"}},
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+			Tenant:       "other",
+		},
+	})
+	a.CheckError(err)
+}
@@ -0,0 +1,407 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache holds a read-through caching decorator for timeseries.StorageAPI.
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/tasks"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/util"
+	"github.com/square/metrics/util/compress"
+)
+
+// Cache wraps a StorageAPI, remembering the values it has fetched so that
+// repeated queries only fetch the edges of the range they haven't seen yet.
+type Cache struct {
+	storage timeseries.StorageAPI
+	config  Config
+
+	mutex   sync.Mutex
+	entries map[cacheKey]*list.Element // values are *entry
+	recent  *list.List                 // entries ordered from most to least recently used
+}
+
+// Cache implements StorageAPI and StorageUpdateAPI
+var _ timeseries.StorageAPI = (*Cache)(nil)
+var _ timeseries.StorageUpdateAPI = (*Cache)(nil)
+
+// Config stores data needed to instantiate a Cache.
+type Config struct {
+	// MutableWindow is how far back from now data may still change in the
+	// backend at any resolution (e.g. the delay before ingested points are
+	// visible). Slots which end inside this window are never cached.
+	MutableWindow time.Duration `yaml:"mutable_window"`
+	MaxEntries    int           `yaml:"max_entries"` // MaxEntries bounds the number of cached series (default 10000).
+	MaxSlots      int           `yaml:"max_slots"`   // MaxSlots bounds the length of each cached series (default 10000).
+
+	// ResolutionWindows widens the mutable window for particular resolutions,
+	// e.g. to the FirstAvailable of each Blueflood rollup, whose slots are
+	// missing until the rollup has been made. The larger window applies.
+	ResolutionWindows map[time.Duration]time.Duration `yaml:"-"`
+
+	Clock util.Clock `yaml:"-"`
+}
+
+// cacheKey identifies the values of one series at one resolution.
+type cacheKey struct {
+	tenant       string
+	metric       string
+	resolution   int64
+	sampleMethod timeseries.SampleMethod
+}
+
+// entry holds the values of a contiguous, aligned range of slots, compressed
+// with util/compress. Entries are never modified after being stored; updates
+// replace them.
+type entry struct {
+	key        cacheKey
+	start      int64 // start of the first slot, in milliseconds
+	length     int   // number of slots
+	compressed []byte
+}
+
+func newEntry(key cacheKey, start int64, values []float64) *entry {
+	return &entry{
+		key:        key,
+		start:      start,
+		length:     len(values),
+		compressed: compress.CompressFloats(values),
+	}
+}
+
+// end returns the start of the last slot in the entry, in milliseconds.
+func (e *entry) end() int64 {
+	return e.start + int64(e.length-1)*e.key.resolution
+}
+
+// values decompresses the values held by the entry.
+func (e *entry) values() []float64 {
+	return compress.DecompressFloats(e.compressed, e.length)
+}
+
+// span is an inclusive range of slot starts, in milliseconds.
+type span struct {
+	from int64
+	to   int64
+}
+
+// NewCache wraps the given StorageAPI with a read-through cache.
+func NewCache(storage timeseries.StorageAPI, config Config) *Cache {
+	if config.MaxEntries == 0 {
+		config.MaxEntries = 10000
+	}
+	if config.MaxSlots == 0 {
+		config.MaxSlots = 10000
+	}
+	if config.Clock == nil {
+		config.Clock = util.RealClock{}
+	}
+	return &Cache{
+		storage: storage,
+		config:  config,
+		entries: map[cacheKey]*list.Element{},
+		recent:  list.New(),
+	}
+}
+
+// ChooseResolution defers to the underlying StorageAPI.
+func (c *Cache) ChooseResolution(requested api.Timerange, lowerBound time.Duration) (time.Duration, error) {
+	return c.storage.ChooseResolution(requested, lowerBound)
+}
+
+// CheckHealthy defers to the underlying StorageAPI.
+func (c *Cache) CheckHealthy() error {
+	return c.storage.CheckHealthy()
+}
+
+// WritePoints writes the datapoints to the underlying StorageAPI, which must
+// accept points. Cached slots at or after the earliest point written for a
+// metric are dropped, since the backend's values for them may have changed.
+func (c *Cache) WritePoints(request timeseries.WriteRequest) error {
+	updateAPI, ok := c.storage.(timeseries.StorageUpdateAPI)
+	if !ok {
+		return fmt.Errorf("the cached storage backend does not accept points")
+	}
+	if err := updateAPI.WritePoints(request); err != nil {
+		return err
+	}
+	earliest := map[string]int64{} // metric => earliest point written, in milliseconds
+	for _, datapoint := range request.Datapoints {
+		metric := metricName(datapoint.Metric)
+		timestamp := datapoint.Timestamp.UnixNano() / 1e6
+		if previous, ok := earliest[metric]; !ok || timestamp < previous {
+			earliest[metric] = timestamp
+		}
+	}
+	c.invalidate(earliest)
+	return nil
+}
+
+// FetchSingleTimeseries serves the metric from the cache where possible.
+func (c *Cache) FetchSingleTimeseries(request timeseries.FetchRequest) (api.Timeseries, error) {
+	list, err := c.FetchMultipleTimeseries(timeseries.FetchMultipleRequest{
+		Metrics:        []api.TaggedMetric{request.Metric},
+		RequestDetails: request.RequestDetails,
+	})
+	if err != nil {
+		return api.Timeseries{}, err
+	}
+	return list.Series[0], nil
+}
+
+// FetchMultipleTimeseries serves each metric from the cache where possible.
+// The slots missing from the cache are fetched from the underlying StorageAPI,
+// grouping together the metrics which are missing the same range.
+func (c *Cache) FetchMultipleTimeseries(request timeseries.FetchMultipleRequest) (api.SeriesList, error) {
+	defer request.Profiler.Record("Cache FetchMultipleTimeseries")()
+	timerange := request.Timerange
+	resolution := timerange.ResolutionMillis()
+
+	cached := make([]*entry, len(request.Metrics))
+	missing := map[span][]int{} // missing range => indices of the metrics missing it
+	for i, metric := range request.Metrics {
+		cached[i] = c.lookup(c.key(metric, request.RequestDetails))
+		for _, s := range missingSpans(cached[i], timerange) {
+			missing[s] = append(missing[s], i)
+		}
+	}
+
+	fetched := make([][]api.Timeseries, len(request.Metrics)) // the pieces fetched for each metric, in no particular order
+	fetchedSpans := make([][]span, len(request.Metrics))
+	if len(missing) != 0 {
+		queue := tasks.NewParallelQueue(len(missing), request.Ctx)
+		for s, indices := range missing {
+			s, indices := s, indices
+			queue.Do(func() error {
+				defer request.Profiler.RecordWithDescription("Cache FetchMultipleTimeseries Miss", fmt.Sprintf("%d series", len(indices)))()
+				missingRange, err := api.NewTimerange(s.from, s.to, resolution)
+				if err != nil {
+					return err
+				}
+				metrics := make([]api.TaggedMetric, len(indices))
+				for i, index := range indices {
+					metrics[i] = request.Metrics[index]
+				}
+				details := request.RequestDetails
+				details.Timerange = missingRange
+				list, err := c.storage.FetchMultipleTimeseries(timeseries.FetchMultipleRequest{
+					Metrics:        metrics,
+					RequestDetails: details,
+				})
+				if err != nil {
+					return err
+				}
+				if len(list.Series) != len(indices) {
+					return fmt.Errorf("cached storage backend returned %d series for %d metrics", len(list.Series), len(indices))
+				}
+				queue.Lock()
+				defer queue.Unlock()
+				for i, index := range indices {
+					fetched[index] = append(fetched[index], list.Series[i])
+					fetchedSpans[index] = append(fetchedSpans[index], s)
+				}
+				return nil
+			})
+		}
+		if err := queue.Wait(); err != nil {
+			// Nothing is stored, so series which callers NaN-fill after a
+			// failure (as partial results do) never reach the cache.
+			return api.SeriesList{}, err
+		}
+	}
+
+	lastCacheable := c.lastCacheableSlot(resolution)
+	results := make([]api.Timeseries, len(request.Metrics))
+	for i, metric := range request.Metrics {
+		values := make([]float64, timerange.Slots())
+		for j := range values {
+			values[j] = math.NaN()
+		}
+		if cached[i] != nil {
+			copyInto(values, timerange.StartMillis(), resolution, cached[i].start, cached[i].values())
+		}
+		for j := range fetched[i] {
+			copyInto(values, timerange.StartMillis(), resolution, fetchedSpans[i][j].from, fetched[i][j].Values)
+		}
+		results[i] = api.Timeseries{
+			Values: values,
+			TagSet: metric.TagSet,
+		}
+		if len(fetched[i]) != 0 {
+			c.store(cached[i], c.key(metric, request.RequestDetails), timerange, values, lastCacheable)
+		}
+	}
+	return api.SeriesList{
+		Series: results,
+	}, nil
+}
+
+// Helper functions
+// ----------------
+
+func (c *Cache) key(metric api.TaggedMetric, details timeseries.RequestDetails) cacheKey {
+	return cacheKey{
+		tenant:       details.Tenant,
+		metric:       metricName(metric),
+		resolution:   details.Timerange.ResolutionMillis(),
+		sampleMethod: details.SampleMethod,
+	}
+}
+
+// metricName identifies the metric within a cacheKey.
+func metricName(metric api.TaggedMetric) string {
+	return fmt.Sprintf("%s\x00%s", metric.MetricKey, metric.TagSet.Serialize())
+}
+
+// lookup returns the cache entry for the key (or nil), marking it as recently used.
+func (c *Cache) lookup(key cacheKey) *entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.recent.MoveToFront(element)
+	return element.Value.(*entry)
+}
+
+// lastCacheableSlot returns the start of the last slot which lies entirely
+// before the mutable window.
+func (c *Cache) lastCacheableSlot(resolution int64) int64 {
+	window := c.config.MutableWindow
+	if resolutionWindow := c.config.ResolutionWindows[time.Duration(resolution)*time.Millisecond]; resolutionWindow > window {
+		window = resolutionWindow
+	}
+	cutoff := c.config.Clock.Now().Add(-window).UnixNano() / 1e6
+	last := cutoff - resolution
+	remainder := last % resolution
+	if remainder < 0 {
+		remainder += resolution
+	}
+	return last - remainder
+}
+
+// touches returns whether the entry overlaps or is adjacent to the timerange.
+// The cache only holds contiguous ranges, so other entries are replaced.
+func touches(cached *entry, timerange api.Timerange) bool {
+	if cached == nil {
+		return false
+	}
+	resolution := timerange.ResolutionMillis()
+	return cached.end() >= timerange.StartMillis()-resolution && cached.start <= timerange.EndMillis()+resolution
+}
+
+// missingSpans returns the ranges of the timerange which the entry lacks.
+func missingSpans(cached *entry, timerange api.Timerange) []span {
+	start, end, resolution := timerange.StartMillis(), timerange.EndMillis(), timerange.ResolutionMillis()
+	if !touches(cached, timerange) {
+		return []span{{start, end}}
+	}
+	spans := []span{}
+	if start < cached.start {
+		spans = append(spans, span{start, cached.start - resolution})
+	}
+	if end > cached.end() {
+		spans = append(spans, span{cached.end() + resolution, end})
+	}
+	return spans
+}
+
+// copyInto copies the source slots which overlap the destination.
+func copyInto(destination []float64, start int64, resolution int64, sourceStart int64, source []float64) {
+	for i, value := range source {
+		index := (sourceStart-start)/resolution + int64(i)
+		if index < 0 || index >= int64(len(destination)) {
+			continue
+		}
+		destination[index] = value
+	}
+}
+
+// invalidate drops the cache entries of each metric (at every tenant and
+// resolution) which hold the slot containing the given timestamp or any
+// later slot.
+func (c *Cache) invalidate(earliest map[string]int64) {
+	if len(earliest) == 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, element := range c.entries {
+		timestamp, ok := earliest[key.metric]
+		if !ok || element.Value.(*entry).end()+key.resolution <= timestamp {
+			continue
+		}
+		c.recent.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// store merges the freshly assembled values with the previous entry and
+// saves every slot up to (and including) lastCacheable.
+func (c *Cache) store(previous *entry, key cacheKey, timerange api.Timerange, values []float64, lastCacheable int64) {
+	resolution := timerange.ResolutionMillis()
+	start, end := timerange.StartMillis(), timerange.EndMillis()
+	if !touches(previous, timerange) {
+		previous = nil
+	}
+	if previous != nil {
+		if previous.start < start {
+			start = previous.start
+		}
+		if previous.end() > end {
+			end = previous.end()
+		}
+	}
+	if end > lastCacheable {
+		end = lastCacheable
+	}
+	if maxStart := end - int64(c.config.MaxSlots-1)*resolution; start < maxStart {
+		start = maxStart
+	}
+	if end < start {
+		return
+	}
+	mergedValues := make([]float64, (end-start)/resolution+1)
+	for i := range mergedValues {
+		mergedValues[i] = math.NaN()
+	}
+	if previous != nil {
+		copyInto(mergedValues, start, resolution, previous.start, previous.values())
+	}
+	copyInto(mergedValues, start, resolution, timerange.StartMillis(), values)
+	merged := newEntry(key, start, mergedValues)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value = merged
+		c.recent.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.recent.PushFront(merged)
+	for c.recent.Len() > c.config.MaxEntries {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/timeseries/memory"
+)
+
+// recordingStorage records the timeranges of the fetches it passes through.
+type recordingStorage struct {
+	timeseries.StorageAPI
+
+	mutex   sync.Mutex
+	fetched []api.Timerange
+}
+
+func (r *recordingStorage) FetchMultipleTimeseries(request timeseries.FetchMultipleRequest) (api.SeriesList, error) {
+	r.mutex.Lock()
+	r.fetched = append(r.fetched, request.Timerange)
+	r.mutex.Unlock()
+	return r.StorageAPI.FetchMultipleTimeseries(request)
+}
+
+func (r *recordingStorage) WritePoints(request timeseries.WriteRequest) error {
+	return r.StorageAPI.(timeseries.StorageUpdateAPI).WritePoints(request)
+}
+
+func (r *recordingStorage) flush() []api.Timerange {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	result := r.fetched
+	r.fetched = nil
+	return result
+}
+
+func fetch(t *testing.T, cache *Cache, metric api.TaggedMetric, start, end int64) []float64 {
+	timerange, err := api.NewTimerange(start*1000, end*1000, 30000)
+	if err != nil {
+		t.Fatalf("Unexpected error creating timerange: %s", err.Error())
+	}
+	series, err := cache.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: metric,
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error fetching: %s", err.Error())
+	}
+	return series.Values
+}
+
+func TestReadThrough(t *testing.T) {
+	a := assert.New(t)
+	clock := mocks.NewTestClock(time.Unix(600, 0))
+	storage := memory.NewStorage(memory.Config{Resolutions: []time.Duration{30 * time.Second}, Clock: clock})
+	metric := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}}
+	for i := int64(0); i < 20; i++ {
+		storage.AddPoints(metric, memory.Point{Timestamp: time.Unix(i*30, 0), Value: float64(i)})
+	}
+	recorder := &recordingStorage{StorageAPI: storage}
+	cache := NewCache(recorder, Config{MutableWindow: time.Minute, Clock: clock})
+
+	// The first fetch is a complete miss.
+	a.EqFloatArray(fetch(t, cache, metric, 120, 240), []float64{4, 5, 6, 7, 8}, 1e-9)
+	a.EqInt(len(recorder.flush()), 1)
+
+	// A subrange is served entirely from the cache.
+	a.EqFloatArray(fetch(t, cache, metric, 150, 210), []float64{5, 6, 7}, 1e-9)
+	a.EqInt(len(recorder.flush()), 0)
+
+	// Only the missing edges are fetched.
+	a.EqFloatArray(fetch(t, cache, metric, 60, 300), []float64{2, 3, 4, 5, 6, 7, 8, 9, 10}, 1e-9)
+	fetched := recorder.flush()
+	a.MustEqInt(len(fetched), 2)
+	for _, timerange := range fetched {
+		if timerange.StartMillis() == 60000 {
+			a.Eq(timerange.EndMillis(), int64(90000))
+		} else {
+			a.Eq(timerange.StartMillis(), int64(270000))
+			a.Eq(timerange.EndMillis(), int64(300000))
+		}
+	}
+
+	// A disjoint range replaces the cached one.
+	a.EqFloatArray(fetch(t, cache, metric, 450, 480), []float64{15, 16}, 1e-9)
+	a.EqInt(len(recorder.flush()), 1)
+	a.EqFloatArray(fetch(t, cache, metric, 60, 90), []float64{2, 3}, 1e-9)
+	a.EqInt(len(recorder.flush()), 1)
+}
+
+func TestMutableWindowIsNotCached(t *testing.T) {
+	a := assert.New(t)
+	clock := mocks.NewTestClock(time.Unix(600, 0))
+	storage := memory.NewStorage(memory.Config{Resolutions: []time.Duration{30 * time.Second}, Clock: clock})
+	metric := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{}}
+	storage.AddPoints(metric, memory.Point{Timestamp: time.Unix(510, 0), Value: 1})
+	recorder := &recordingStorage{StorageAPI: storage}
+	cache := NewCache(recorder, Config{MutableWindow: time.Minute, Clock: clock})
+
+	// Slots at 540 and 570 end within the last minute, so they aren't cached.
+	a.EqFloatArray(fetch(t, cache, metric, 480, 570), []float64{math.NaN(), 1, math.NaN(), math.NaN()}, 1e-9)
+	a.EqInt(len(recorder.flush()), 1)
+
+	storage.AddPoints(metric, memory.Point{Timestamp: time.Unix(540, 0), Value: 2}, memory.Point{Timestamp: time.Unix(515, 0), Value: 100})
+	a.EqFloatArray(fetch(t, cache, metric, 480, 570), []float64{math.NaN(), 1, 2, math.NaN()}, 1e-9)
+	fetched := recorder.flush()
+	a.MustEqInt(len(fetched), 1)
+	a.Eq(fetched[0].StartMillis(), int64(540000))
+}
+
+func TestResolutionWindows(t *testing.T) {
+	a := assert.New(t)
+	clock := mocks.NewTestClock(time.Unix(600, 0))
+	storage := memory.NewStorage(memory.Config{Resolutions: []time.Duration{30 * time.Second}, Clock: clock})
+	metric := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{}}
+	recorder := &recordingStorage{StorageAPI: storage}
+	cache := NewCache(recorder, Config{
+		MutableWindow:     time.Minute,
+		ResolutionWindows: map[time.Duration]time.Duration{30 * time.Second: 5 * time.Minute},
+		Clock:             clock,
+	})
+
+	// Slots from 300 onwards end within the last five minutes, so they aren't cached.
+	fetch(t, cache, metric, 180, 330)
+	a.EqInt(len(recorder.flush()), 1)
+	storage.AddPoints(metric, memory.Point{Timestamp: time.Unix(300, 0), Value: 1})
+	a.EqFloatArray(fetch(t, cache, metric, 180, 330), []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), 1, math.NaN()}, 1e-9)
+	fetched := recorder.flush()
+	a.MustEqInt(len(fetched), 1)
+	a.Eq(fetched[0].StartMillis(), int64(300000))
+}
+
+// failingStorage fails every fetch.
+type failingStorage struct {
+	timeseries.StorageAPI
+}
+
+func (f failingStorage) FetchMultipleTimeseries(request timeseries.FetchMultipleRequest) (api.SeriesList, error) {
+	return api.SeriesList{}, timeseries.Error{Code: timeseries.FetchIOError, Message: "unavailable"}
+}
+
+func TestFailedFetchIsNotCached(t *testing.T) {
+	a := assert.New(t)
+	clock := mocks.NewTestClock(time.Unix(600, 0))
+	storage := memory.NewStorage(memory.Config{Resolutions: []time.Duration{30 * time.Second}, Clock: clock})
+	cache := NewCache(failingStorage{storage}, Config{Clock: clock})
+	timerange, err := api.NewTimerange(0, 60000, 30000)
+	a.CheckError(err)
+	_, err = cache.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{}},
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	if err == nil {
+		t.Fatalf("Expected the fetch to fail")
+	}
+	a.EqInt(len(cache.entries), 0)
+}
+
+func TestGroupedMisses(t *testing.T) {
+	a := assert.New(t)
+	clock := mocks.NewTestClock(time.Unix(600, 0))
+	storage := memory.NewStorage(memory.Config{Resolutions: []time.Duration{30 * time.Second}, Clock: clock})
+	recorder := &recordingStorage{StorageAPI: storage}
+	cache := NewCache(recorder, Config{Clock: clock, MaxEntries: 2})
+	metrics := []api.TaggedMetric{
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}},
+		{MetricKey: "cpu", TagSet: api.TagSet{"host": "c"}},
+	}
+	timerange, err := api.NewTimerange(0, 60000, 30000)
+	a.CheckError(err)
+	list, err := cache.FetchMultipleTimeseries(timeseries.FetchMultipleRequest{
+		Metrics: metrics,
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	a.CheckError(err)
+	a.EqInt(len(list.Series), 3)
+	a.EqInt(len(recorder.flush()), 1) // all three share the same missing range
+	a.EqInt(len(cache.entries), 2)    // bounded by MaxEntries
+}
+
+func TestCachedValuesRoundTrip(t *testing.T) {
+	a := assert.New(t)
+	clock := mocks.NewTestClock(time.Unix(600, 0))
+	storage := memory.NewStorage(memory.Config{Resolutions: []time.Duration{30 * time.Second}, Clock: clock})
+	metric := api.TaggedMetric{MetricKey: "delta", TagSet: api.TagSet{}}
+	expected := []float64{-1, math.NaN(), -1, 0.1, -1e300, math.NaN(), 7}
+	for i, value := range expected {
+		if !math.IsNaN(value) {
+			storage.AddPoints(metric, memory.Point{Timestamp: time.Unix(int64(i)*30, 0), Value: value})
+		}
+	}
+	recorder := &recordingStorage{StorageAPI: storage}
+	cache := NewCache(recorder, Config{Clock: clock})
+
+	a.EqFloatArray(fetch(t, cache, metric, 0, 180), expected, 1e-9)
+	a.EqFloatArray(fetch(t, cache, metric, 0, 180), expected, 1e-9)
+	a.EqInt(len(recorder.flush()), 1) // the second fetch is decompressed from the cache
+}
+
+func TestWritePointsInvalidates(t *testing.T) {
+	a := assert.New(t)
+	clock := mocks.NewTestClock(time.Unix(600, 0))
+	storage := memory.NewStorage(memory.Config{Resolutions: []time.Duration{30 * time.Second}, Clock: clock})
+	metric := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{}}
+	other := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}}
+	recorder := &recordingStorage{StorageAPI: storage}
+	cache := NewCache(recorder, Config{Clock: clock})
+	fetch(t, cache, metric, 0, 120)
+	fetch(t, cache, other, 0, 120)
+	recorder.flush()
+
+	// A point after the cached range leaves the entry alone.
+	a.CheckError(cache.WritePoints(timeseries.WriteRequest{
+		Datapoints: []timeseries.Datapoint{{Metric: metric, Timestamp: time.Unix(300, 0), Value: 5}},
+		Ctx:        context.Background(),
+	}))
+	a.EqInt(len(cache.entries), 2)
+
+	// A backfilled point is read from the backend again.
+	a.CheckError(cache.WritePoints(timeseries.WriteRequest{
+		Datapoints: []timeseries.Datapoint{{Metric: metric, Timestamp: time.Unix(60, 0), Value: 2}},
+		Ctx:        context.Background(),
+	}))
+	a.EqInt(len(cache.entries), 1)
+	a.EqFloatArray(fetch(t, cache, metric, 0, 120), []float64{math.NaN(), math.NaN(), 2, math.NaN(), math.NaN()}, 1e-9)
+	a.EqInt(len(recorder.flush()), 1)
+
+	// The underlying storage must accept points.
+	readOnly := NewCache(failingStorage{storage}, Config{Clock: clock})
+	err := readOnly.WritePoints(timeseries.WriteRequest{
+		Datapoints: []timeseries.Datapoint{{Metric: metric, Timestamp: time.Unix(60, 0), Value: 2}},
+		Ctx:        context.Background(),
+	})
+	if err == nil {
+		t.Errorf("expected an error writing through to a read-only backend")
+	}
+}
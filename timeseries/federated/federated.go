@@ -0,0 +1,250 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package federated holds a timeseries.StorageAPI which routes each metric to
+// one of several named backends.
+package federated
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/tasks"
+	"github.com/square/metrics/timeseries"
+)
+
+// maxNegotiationRounds bounds how many times ChooseResolution will ask the
+// backends to agree on a resolution.
+const maxNegotiationRounds = 8
+
+// Federated is a timeseries storage API which delegates to other backends.
+type Federated struct {
+	backends map[string]timeseries.StorageAPI
+	config   Config
+}
+
+// Federated implements StorageAPI and StorageUpdateAPI
+var _ timeseries.StorageAPI = (*Federated)(nil)
+var _ timeseries.StorageUpdateAPI = (*Federated)(nil)
+
+// A Rule routes the metrics it matches to the named backend.
+// An empty MetricPrefix matches every metric key, and every entry in Tags must
+// be present in the metric's TagSet for the rule to match.
+type Rule struct {
+	Backend      string            `yaml:"backend"`
+	MetricPrefix string            `yaml:"metric_prefix"`
+	Tags         map[string]string `yaml:"tags"`
+}
+
+// Matches returns whether the rule applies to the given metric.
+func (r Rule) Matches(metric api.TaggedMetric) bool {
+	if !strings.HasPrefix(string(metric.MetricKey), r.MetricPrefix) {
+		return false
+	}
+	for key, value := range r.Tags {
+		if actual, ok := metric.TagSet[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Config describes how metrics are routed between backends.
+type Config struct {
+	Rules          []Rule `yaml:"rules"`           // Rules are checked in order; the first match wins.
+	DefaultBackend string `yaml:"default_backend"` // DefaultBackend is used when no rule matches (optional).
+}
+
+// NewFederated creates a Federated storage API routing between the given backends.
+func NewFederated(backends map[string]timeseries.StorageAPI, config Config) (*Federated, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("a federated storage API requires at least one backend")
+	}
+	for _, rule := range config.Rules {
+		if _, ok := backends[rule.Backend]; !ok {
+			return nil, fmt.Errorf("rule for prefix %q refers to unknown backend %q", rule.MetricPrefix, rule.Backend)
+		}
+	}
+	if _, ok := backends[config.DefaultBackend]; config.DefaultBackend != "" && !ok {
+		return nil, fmt.Errorf("default backend %q is unknown", config.DefaultBackend)
+	}
+	return &Federated{
+		backends: backends,
+		config:   config,
+	}, nil
+}
+
+// Route returns the name of the backend responsible for the given metric.
+func (f *Federated) Route(metric api.TaggedMetric) (string, error) {
+	for _, rule := range f.config.Rules {
+		if rule.Matches(metric) {
+			return rule.Backend, nil
+		}
+	}
+	if f.config.DefaultBackend != "" {
+		return f.config.DefaultBackend, nil
+	}
+	return "", timeseries.Error{Metric: metric, Code: timeseries.InvalidSeriesError, Message: "no storage backend is configured for this metric"}
+}
+
+// backendNames returns the names of the backends in a deterministic order.
+func (f *Federated) backendNames() []string {
+	names := make([]string, 0, len(f.backends))
+	for name := range f.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckHealthy checks that every backend is healthy.
+func (f *Federated) CheckHealthy() error {
+	for _, name := range f.backendNames() {
+		if err := f.backends[name].CheckHealthy(); err != nil {
+			return fmt.Errorf("storage backend %q is unhealthy: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// ChooseResolution negotiates a resolution which every capable backend accepts.
+// Each round raises the lower bound to the coarsest resolution chosen by any
+// backend, until they all agree. Backends which cannot serve the timerange at
+// all are left out of the negotiation; fetches routed to them will fail.
+func (f *Federated) ChooseResolution(requested api.Timerange, lowerBound time.Duration) (time.Duration, error) {
+	candidate := lowerBound
+	errors := []string{}
+	for round := 0; round < maxNegotiationRounds; round++ {
+		errors = errors[:0]
+		agreed := true
+		coarsest := candidate
+		for _, name := range f.backendNames() {
+			resolution, err := f.backends[name].ChooseResolution(requested, candidate)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("%s: %s", name, err.Error()))
+				continue
+			}
+			if resolution != candidate {
+				agreed = false
+			}
+			if resolution > coarsest {
+				coarsest = resolution
+			}
+		}
+		if len(errors) == len(f.backends) {
+			return 0, fmt.Errorf("no storage backend can serve timerange %+v: %s", requested, strings.Join(errors, "; "))
+		}
+		if agreed {
+			return candidate, nil
+		}
+		if coarsest == candidate {
+			// Some backend chose a finer resolution than the lower bound, which
+			// leaves nothing to raise; the candidate is the best available.
+			return coarsest, nil
+		}
+		candidate = coarsest
+	}
+	return 0, fmt.Errorf("storage backends could not agree on a resolution for timerange %+v", requested)
+}
+
+// FetchSingleTimeseries fetches the metric from the backend it is routed to.
+func (f *Federated) FetchSingleTimeseries(request timeseries.FetchRequest) (api.Timeseries, error) {
+	defer request.Profiler.RecordWithDescription("Federated FetchSingleTimeseries", request.Metric.String())()
+	name, err := f.Route(request.Metric)
+	if err != nil {
+		return api.Timeseries{}, err
+	}
+	return f.backends[name].FetchSingleTimeseries(request)
+}
+
+// FetchMultipleTimeseries groups the metrics by backend, fetches each group
+// concurrently and merges the results in the order they were requested.
+func (f *Federated) FetchMultipleTimeseries(request timeseries.FetchMultipleRequest) (api.SeriesList, error) {
+	defer request.Profiler.Record("Federated FetchMultipleTimeseries")()
+	groups := map[string][]int{} // backend name => indices into request.Metrics
+	for i, metric := range request.Metrics {
+		name, err := f.Route(metric)
+		if err != nil {
+			return api.SeriesList{}, err
+		}
+		groups[name] = append(groups[name], i)
+	}
+
+	results := make([]api.Timeseries, len(request.Metrics))
+	queue := tasks.NewParallelQueue(len(groups), request.Ctx)
+	for name, indices := range groups {
+		name, indices := name, indices
+		queue.Do(func() error {
+			defer request.Profiler.RecordWithDescription("Federated FetchMultipleTimeseries Backend", name)()
+			metrics := make([]api.TaggedMetric, len(indices))
+			for i, index := range indices {
+				metrics[i] = request.Metrics[index]
+			}
+			list, err := f.backends[name].FetchMultipleTimeseries(timeseries.FetchMultipleRequest{
+				Metrics:        metrics,
+				RequestDetails: request.RequestDetails,
+			})
+			if err != nil {
+				return err
+			}
+			if len(list.Series) != len(indices) {
+				return fmt.Errorf("storage backend %q returned %d series for %d metrics", name, len(list.Series), len(indices))
+			}
+			for i, index := range indices {
+				results[index] = list.Series[i]
+			}
+			return nil
+		})
+	}
+	if err := queue.Wait(); err != nil {
+		return api.SeriesList{}, err
+	}
+	return api.SeriesList{
+		Series: results,
+	}, nil
+}
+
+// WritePoints groups the datapoints by the backend their metric is routed to
+// and writes each group concurrently. Every point must be routed to a backend
+// which accepts points.
+func (f *Federated) WritePoints(request timeseries.WriteRequest) error {
+	defer request.Profiler.RecordWithDescription("Federated WritePoints", fmt.Sprintf("%d datapoints", len(request.Datapoints)))()
+	groups := map[string][]timeseries.Datapoint{} // backend name => datapoints routed to it
+	for _, datapoint := range request.Datapoints {
+		name, err := f.Route(datapoint.Metric)
+		if err != nil {
+			return err
+		}
+		if _, ok := f.backends[name].(timeseries.StorageUpdateAPI); !ok {
+			return timeseries.Error{Metric: datapoint.Metric, Code: timeseries.InvalidSeriesError, Message: fmt.Sprintf("storage backend %q does not accept points", name)}
+		}
+		groups[name] = append(groups[name], datapoint)
+	}
+
+	queue := tasks.NewParallelQueue(len(groups), request.Ctx)
+	for name, datapoints := range groups {
+		name, datapoints := name, datapoints
+		queue.Do(func() error {
+			return f.backends[name].(timeseries.StorageUpdateAPI).WritePoints(timeseries.WriteRequest{
+				Datapoints: datapoints,
+				Ctx:        request.Ctx,
+				Profiler:   request.Profiler,
+			})
+		})
+	}
+	return queue.Wait()
+}
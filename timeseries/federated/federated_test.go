@@ -0,0 +1,198 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federated
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/timeseries/memory"
+)
+
+func newTestFederated(t *testing.T) (*Federated, *memory.Storage, *memory.Storage) {
+	clock := mocks.NewTestClock(time.Unix(3600, 0))
+	legacy := memory.NewStorage(memory.Config{
+		Resolutions: []time.Duration{30 * time.Second, 5 * time.Minute},
+		Clock:       clock,
+	})
+	modern := memory.NewStorage(memory.Config{
+		Resolutions: []time.Duration{time.Minute, 10 * time.Minute},
+		Clock:       clock,
+	})
+	federated, err := NewFederated(map[string]timeseries.StorageAPI{
+		"legacy": legacy,
+		"modern": modern,
+	}, Config{
+		Rules: []Rule{
+			{Backend: "modern", MetricPrefix: "app."},
+			{Backend: "modern", Tags: map[string]string{"dc": "new"}},
+		},
+		DefaultBackend: "legacy",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating federated API: %s", err.Error())
+	}
+	return federated, legacy, modern
+}
+
+func TestNewFederatedValidation(t *testing.T) {
+	backends := map[string]timeseries.StorageAPI{"only": memory.NewStorage(memory.Config{})}
+	if _, err := NewFederated(backends, Config{Rules: []Rule{{Backend: "missing"}}}); err == nil {
+		t.Errorf("expected an error for a rule with an unknown backend")
+	}
+	if _, err := NewFederated(backends, Config{DefaultBackend: "missing"}); err == nil {
+		t.Errorf("expected an error for an unknown default backend")
+	}
+	if _, err := NewFederated(nil, Config{}); err == nil {
+		t.Errorf("expected an error with no backends")
+	}
+}
+
+func TestRoute(t *testing.T) {
+	a := assert.New(t)
+	federated, _, _ := newTestFederated(t)
+	tests := []struct {
+		metric   api.TaggedMetric
+		expected string
+	}{
+		{api.TaggedMetric{MetricKey: "app.latency", TagSet: api.TagSet{}}, "modern"},
+		{api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"dc": "new"}}, "modern"},
+		{api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"dc": "old"}}, "legacy"},
+		{api.TaggedMetric{MetricKey: "application", TagSet: api.TagSet{}}, "legacy"},
+	}
+	for _, test := range tests {
+		name, err := federated.Route(test.metric)
+		a.CheckError(err)
+		a.Contextf("%+v", test.metric).EqString(name, test.expected)
+	}
+
+	noDefault, err := NewFederated(federated.backends, Config{Rules: federated.config.Rules})
+	a.CheckError(err)
+	if _, err := noDefault.Route(api.TaggedMetric{MetricKey: "cpu"}); err == nil {
+		t.Errorf("expected an error routing a metric without a default backend")
+	}
+}
+
+func TestChooseResolution(t *testing.T) {
+	a := assert.New(t)
+	federated, _, _ := newTestFederated(t)
+	timerange, err := api.NewTimerange(0, 3600000, 30000)
+	a.CheckError(err)
+
+	// Each round raises the bound: 0 => 1m (modern) => 5m (legacy) => 10m (modern).
+	// Legacy has no resolution that coarse, so it stops constraining the result.
+	resolution, err := federated.ChooseResolution(timerange, 0)
+	a.CheckError(err)
+	a.Eq(resolution, 10*time.Minute)
+
+	resolution, err = federated.ChooseResolution(timerange, 5*time.Minute)
+	a.CheckError(err)
+	a.Eq(resolution, 10*time.Minute)
+
+	// A resolution which only one backend can serve is still chosen.
+	resolution, err = federated.ChooseResolution(timerange, 6*time.Minute)
+	a.CheckError(err)
+	a.Eq(resolution, 10*time.Minute)
+
+	if _, err := federated.ChooseResolution(timerange, time.Hour); err == nil {
+		t.Errorf("expected an error when no backend can serve the resolution")
+	}
+}
+
+func TestFetchMultipleTimeseries(t *testing.T) {
+	a := assert.New(t)
+	federated, legacy, modern := newTestFederated(t)
+	legacyMetric := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"dc": "old"}}
+	modernMetric := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"dc": "new"}}
+	appMetric := api.TaggedMetric{MetricKey: "app.latency", TagSet: api.TagSet{"dc": "old"}}
+	legacy.AddPoints(legacyMetric, memory.Point{Timestamp: time.Unix(0, 0), Value: 1})
+	modern.AddPoints(modernMetric, memory.Point{Timestamp: time.Unix(0, 0), Value: 2})
+	modern.AddPoints(appMetric, memory.Point{Timestamp: time.Unix(0, 0), Value: 3})
+	// Points in the wrong backend are never read.
+	legacy.AddPoints(appMetric, memory.Point{Timestamp: time.Unix(0, 0), Value: 100})
+
+	timerange, err := api.NewTimerange(0, 0, 300000)
+	a.CheckError(err)
+	list, err := federated.FetchMultipleTimeseries(timeseries.FetchMultipleRequest{
+		Metrics: []api.TaggedMetric{legacyMetric, modernMetric, appMetric},
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	a.CheckError(err)
+	a.MustEqInt(len(list.Series), 3)
+	a.EqFloatArray(list.Series[0].Values, []float64{1}, 1e-9)
+	a.EqFloatArray(list.Series[1].Values, []float64{2}, 1e-9)
+	a.EqFloatArray(list.Series[2].Values, []float64{3}, 1e-9)
+	a.Eq(list.Series[1].TagSet, modernMetric.TagSet)
+}
+
+// readOnlyStorage hides the memory storage's WritePoints.
+type readOnlyStorage struct {
+	timeseries.StorageAPI
+}
+
+func TestWritePoints(t *testing.T) {
+	a := assert.New(t)
+	federated, legacy, modern := newTestFederated(t)
+	legacyMetric := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"dc": "old"}}
+	appMetric := api.TaggedMetric{MetricKey: "app.latency", TagSet: api.TagSet{"dc": "old"}}
+	a.CheckError(federated.WritePoints(timeseries.WriteRequest{
+		Datapoints: []timeseries.Datapoint{
+			{Metric: legacyMetric, Timestamp: time.Unix(0, 0), Value: 1},
+			{Metric: appMetric, Timestamp: time.Unix(0, 0), Value: 2},
+		},
+		Ctx: context.Background(),
+	}))
+
+	timerange, err := api.NewTimerange(0, 0, 300000)
+	a.CheckError(err)
+	fetch := func(storage timeseries.StorageAPI, metric api.TaggedMetric) []float64 {
+		series, err := storage.FetchSingleTimeseries(timeseries.FetchRequest{
+			Metric: metric,
+			RequestDetails: timeseries.RequestDetails{
+				SampleMethod: timeseries.SampleMean,
+				Timerange:    timerange,
+				Ctx:          context.Background(),
+			},
+		})
+		a.CheckError(err)
+		return series.Values
+	}
+	a.EqFloatArray(fetch(legacy, legacyMetric), []float64{1}, 1e-9)
+	a.EqFloatArray(fetch(modern, appMetric), []float64{2}, 1e-9)
+	a.EqFloatArray(fetch(legacy, appMetric), []float64{math.NaN()}, 1e-9)
+
+	// Points routed to a backend which doesn't accept them are rejected.
+	readOnly, err := NewFederated(map[string]timeseries.StorageAPI{
+		"legacy": readOnlyStorage{legacy},
+	}, Config{DefaultBackend: "legacy"})
+	a.CheckError(err)
+	err = readOnly.WritePoints(timeseries.WriteRequest{
+		Datapoints: []timeseries.Datapoint{{Metric: legacyMetric, Timestamp: time.Unix(0, 0), Value: 1}},
+		Ctx:        context.Background(),
+	})
+	if err == nil {
+		t.Errorf("expected an error writing to a read-only backend")
+	}
+}
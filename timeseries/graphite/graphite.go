@@ -0,0 +1,317 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package graphite holds a timeseries.StorageAPI implementation which reads
+// from graphite-web's render API.
+package graphite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/tasks"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/util"
+)
+
+// Graphite is a timeseries storage API instance.
+type Graphite struct {
+	config Config
+}
+
+// Graphite implements StorageAPI
+var _ timeseries.StorageAPI = (*Graphite)(nil)
+
+// A Resolution describes one archive of the Graphite storage schema.
+type Resolution struct {
+	Resolution time.Duration `yaml:"resolution"`
+	TimeToLive time.Duration `yaml:"ttl"`
+}
+
+// Config stores data needed to instantiate a Graphite storage API.
+type Config struct {
+	BaseURL                 string       `yaml:"base_url"`
+	Resolutions             []Resolution `yaml:"resolutions"`           // Resolutions are ordered by priority: finest first.
+	MaxSimultaneousRequests int          `yaml:"simultaneous_requests"` // simultaneous requests limits the number of concurrent single-fetches for each multi-fetch
+
+	GraphiteMetricConverter util.GraphiteConverter
+
+	HTTPClient httpClient
+	Clock      util.Clock
+}
+
+type httpClient interface {
+	// our own client to mock out the standard golang HTTP Client.
+	Get(string) (*http.Response, error)
+	Do(*http.Request) (*http.Response, error)
+}
+
+// NewGraphite uses the Config to create an instance of Graphite.
+func NewGraphite(c Config) timeseries.StorageAPI {
+	if c.HTTPClient == nil {
+		c.HTTPClient = http.DefaultClient
+	}
+	if c.Clock == nil {
+		c.Clock = util.RealClock{}
+	}
+	if c.MaxSimultaneousRequests == 0 {
+		c.MaxSimultaneousRequests = 5
+	}
+	return &Graphite{
+		config: c,
+	}
+}
+
+// CheckHealthy checks if the graphite-web server is available by querying /version
+func (g *Graphite) CheckHealthy() error {
+	resp, err := g.config.HTTPClient.Get(fmt.Sprintf("%s/version", g.config.BaseURL))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("the Graphite instance returned an unhealthy status of %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// ChooseResolution will choose the finest-grained archive which still holds
+// the start of the requested range and is at least as coarse as the lower bound.
+func (g *Graphite) ChooseResolution(requested api.Timerange, lowerBound time.Duration) (time.Duration, error) {
+	now := g.config.Clock.Now()
+	for _, current := range g.config.Resolutions {
+		if current.Resolution < lowerBound || current.Resolution < requested.Resolution() {
+			continue
+		}
+		if current.TimeToLive != 0 && requested.Start().Before(now.Add(-current.TimeToLive)) {
+			continue
+		}
+		return current.Resolution, nil
+	}
+	return 0, fmt.Errorf("cannot choose resolution for timerange %+v; available resolutions do not live long enough", requested)
+}
+
+// FetchSingleTimeseries fetches a timeseries with the given tagged metric.
+func (g *Graphite) FetchSingleTimeseries(request timeseries.FetchRequest) (api.Timeseries, error) {
+	defer request.Profiler.RecordWithDescription("Graphite FetchSingleTimeseries", request.Metric.String())()
+	sampler, ok := samplerMap[request.SampleMethod]
+	if !ok {
+		return api.Timeseries{}, fmt.Errorf("unsupported SampleMethod %s", request.SampleMethod.String())
+	}
+	return g.fetchTimeseries(request.Metric, request.Timerange, sampler, request.Ctx)
+}
+
+// FetchMultipleTimeseries fetches multiple timeseries, one render call each.
+func (g *Graphite) FetchMultipleTimeseries(request timeseries.FetchMultipleRequest) (api.SeriesList, error) {
+	defer request.Profiler.Record("Graphite FetchMultipleTimeseries")()
+	sampler, ok := samplerMap[request.SampleMethod]
+	if !ok {
+		return api.SeriesList{}, fmt.Errorf("unsupported SampleMethod %s", request.SampleMethod.String())
+	}
+
+	results := make([]api.Timeseries, len(request.Metrics))
+	queue := tasks.NewParallelQueue(g.config.MaxSimultaneousRequests, request.Ctx)
+	for i := range request.Metrics {
+		i := i // Captures it in a new local for the closure.
+		queue.Do(func() error {
+			defer request.Profiler.RecordWithDescription("Graphite FetchSingleTimeseries", request.Metrics[i].String())()
+			result, err := g.fetchTimeseries(request.Metrics[i], request.Timerange, sampler, request.Ctx)
+			if err != nil {
+				return err
+			}
+			results[i] = result
+			return nil
+		})
+	}
+
+	if err := queue.Wait(); err != nil {
+		return api.SeriesList{}, err
+	}
+
+	return api.SeriesList{
+		Series: results,
+	}, nil
+}
+
+func (g *Graphite) fetchTimeseries(metric api.TaggedMetric, timerange api.Timerange, sampler func([]float64) float64, ctx context.Context) (api.Timeseries, error) {
+	queryURL, err := g.constructURL(metric, timerange)
+	if err != nil {
+		return api.Timeseries{}, err
+	}
+	targets, err := g.fetchRenderHTTP(metric, queryURL, ctx)
+	if err != nil {
+		return api.Timeseries{}, err
+	}
+	return api.Timeseries{
+		Values: samplePoints(targets, timerange, sampler),
+		TagSet: metric.TagSet,
+	}, nil
+}
+
+// Helper functions
+// ----------------
+
+// constructURL creates the render URL to fetch the metric's data from.
+// The range is extended by one resolution, since the last slot of the timerange
+// summarizes the interval following it.
+func (g *Graphite) constructURL(metric api.TaggedMetric, timerange api.Timerange) (*url.URL, error) {
+	graphiteName, err := g.config.GraphiteMetricConverter.ToGraphiteName(metric)
+	if err != nil {
+		return nil, timeseries.Error{Metric: metric, Code: timeseries.InvalidSeriesError, Message: "cannot convert to graphite name"}
+	}
+
+	result, err := url.Parse(fmt.Sprintf("%s/render", g.config.BaseURL))
+	if err != nil {
+		return nil, timeseries.Error{Metric: metric, Code: timeseries.InvalidSeriesError, Message: fmt.Sprintf("cannot generate URL for tagged metric with graphite name %s", graphiteName)}
+	}
+
+	until := timerange.End().Add(timerange.Resolution())
+	result.RawQuery = url.Values{
+		"target": {string(graphiteName)},
+		"from":   {strconv.FormatInt(timerange.Start().Unix(), 10)},
+		"until":  {strconv.FormatInt(until.Unix()-1, 10)},
+		"format": {"json"},
+	}.Encode()
+
+	return result, nil
+}
+
+// fetchRenderHTTP performs the render request for the metric and decodes the
+// JSON response.
+func (g *Graphite) fetchRenderHTTP(metric api.TaggedMetric, queryURL *url.URL, ctx context.Context) ([]renderTarget, error) {
+	request, err := http.NewRequest("GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if ctx != nil {
+		request.Cancel = ctx.Done()
+	}
+	response, err := g.config.HTTPClient.Do(request)
+	if err != nil {
+		return nil, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error fetching from Graphite at URL %q: %s", queryURL.String(), err.Error())}
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error reading from Graphite response body at URL %q: %s", queryURL.String(), err.Error())}
+	}
+	err = response.Body.Close()
+	if err != nil {
+		return nil, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error finishing response from Graphite at URL %q: %s", queryURL.String(), err.Error())}
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, timeseries.Error{Metric: metric, Code: timeseries.FetchIOError, Message: fmt.Sprintf("Graphite at URL %q returned status %d: %s", queryURL.String(), response.StatusCode, body)}
+	}
+	var parsedJSON []renderTarget
+	err = json.Unmarshal(body, &parsedJSON)
+	if err != nil {
+		return nil, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error unmarshaling JSON from Graphite at URL %q: %s;\nBody:%s", queryURL.String(), err.Error(), body)}
+	}
+	return parsedJSON, nil
+}
+
+type renderTarget struct {
+	Target     string      `json:"target"`
+	Datapoints []datapoint `json:"datapoints"`
+}
+
+// datapoint is a [value, timestamp] pair, where the value may be null.
+type datapoint struct {
+	Value     *float64
+	Timestamp int64 // seconds since the epoch
+}
+
+func (d *datapoint) UnmarshalJSON(data []byte) error {
+	var pair []*float64
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 || pair[1] == nil {
+		return fmt.Errorf("expected [value, timestamp] but got %s", data)
+	}
+	d.Value = pair[0]
+	d.Timestamp = int64(*pair[1])
+	return nil
+}
+
+// samplePoints samples the datapoints into a uniform slice of float64s.
+func samplePoints(targets []renderTarget, timerange api.Timerange, sampler func([]float64) float64) []float64 {
+	// A bucket holds a set of points corresponding to one interval in the result.
+	buckets := make([][]float64, timerange.Slots())
+	for _, target := range targets {
+		for _, point := range target.Datapoints {
+			if point.Value == nil {
+				continue
+			}
+			millis := point.Timestamp * 1000
+			if millis < timerange.StartMillis() {
+				continue
+			}
+			index := (millis - timerange.StartMillis()) / timerange.ResolutionMillis()
+			if int(index) >= len(buckets) {
+				continue
+			}
+			buckets[index] = append(buckets[index], *point.Value)
+		}
+	}
+
+	// values will hold the final values to be returned as the series.
+	values := make([]float64, timerange.Slots())
+	for i, bucket := range buckets {
+		if len(bucket) == 0 {
+			values[i] = math.NaN()
+			continue
+		}
+		values[i] = sampler(bucket)
+	}
+	return values
+}
+
+// samplerMap holds the bucket samplers for each SampleMethod, matching the
+// semantics of the Blueflood sampler.
+var samplerMap = map[timeseries.SampleMethod]func([]float64) float64{
+	timeseries.SampleMean: func(bucket []float64) float64 {
+		value := 0.0
+		for _, v := range bucket {
+			value += v
+		}
+		return value / float64(len(bucket))
+	},
+	timeseries.SampleMin: func(bucket []float64) float64 {
+		smallest := bucket[0]
+		for _, v := range bucket[1:] {
+			smallest = math.Min(smallest, v)
+		}
+		return smallest
+	},
+	timeseries.SampleMax: func(bucket []float64) float64 {
+		largest := bucket[0]
+		for _, v := range bucket[1:] {
+			largest = math.Max(largest, v)
+		}
+		return largest
+	},
+}
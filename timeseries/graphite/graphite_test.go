@@ -0,0 +1,191 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/util"
+)
+
+var testResolutions = []Resolution{
+	{Resolution: 30 * time.Second, TimeToLive: 24 * time.Hour},
+	{Resolution: 5 * time.Minute, TimeToLive: 30 * 24 * time.Hour},
+}
+
+func newTestGraphite(client *mocks.FakeHTTPClient, now time.Time) timeseries.StorageAPI {
+	return NewGraphite(Config{
+		BaseURL:     "https://graphite.url",
+		Resolutions: testResolutions,
+		GraphiteMetricConverter: &mocks.FakeGraphiteConverter{
+			MetricMap: map[util.GraphiteMetric]api.TaggedMetric{
+				"servers.a.cpu": {MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+				"servers.b.cpu": {MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}},
+			},
+		},
+		HTTPClient: client,
+		Clock:      mocks.NewTestClock(now),
+	})
+}
+
+func TestChooseResolution(t *testing.T) {
+	a := assert.New(t)
+	now := time.Unix(100*24*60*60, 0)
+	graphite := newTestGraphite(mocks.NewFakeHTTPClient(), now)
+
+	recent, err := api.NewTimerange(now.Add(-time.Hour).Unix()*1000, now.Unix()*1000, 30000)
+	a.CheckError(err)
+	resolution, err := graphite.ChooseResolution(recent, 0)
+	a.CheckError(err)
+	a.Eq(resolution, 30*time.Second)
+
+	older, err := api.NewTimerange(now.Add(-48*time.Hour).Unix()*1000, now.Unix()*1000, 30000)
+	a.CheckError(err)
+	resolution, err = graphite.ChooseResolution(older, 0)
+	a.CheckError(err)
+	a.Eq(resolution, 5*time.Minute)
+
+	ancient, err := api.NewTimerange(0, now.Unix()*1000, 30000)
+	a.CheckError(err)
+	if _, err := graphite.ChooseResolution(ancient, 0); err == nil {
+		t.Errorf("expected an error for a timerange older than every archive")
+	}
+}
+
+func TestFetchMultipleTimeseries(t *testing.T) {
+	a := assert.New(t)
+	client := mocks.NewFakeHTTPClient()
+	client.SetResponse("https://graphite.url/render?format=json&from=0&target=servers.a.cpu&until=119", mocks.Response{
+		Body:       `[{"target": "servers.a.cpu", "datapoints": [[1, 0], [3, 10], [null, 20], [4, 30], [null, 60], [9, 90], [11, 100]]}]`,
+		StatusCode: 200,
+	})
+	client.SetResponse("https://graphite.url/render?format=json&from=0&target=servers.b.cpu&until=119", mocks.Response{
+		Body:       `[]`,
+		StatusCode: 200,
+	})
+	graphite := newTestGraphite(client, time.Unix(3600, 0))
+	timerange, err := api.NewTimerange(0, 90000, 30000)
+	a.CheckError(err)
+
+	tests := []struct {
+		method   timeseries.SampleMethod
+		expected []float64
+	}{
+		{timeseries.SampleMean, []float64{2, 4, math.NaN(), 10}},
+		{timeseries.SampleMin, []float64{1, 4, math.NaN(), 9}},
+		{timeseries.SampleMax, []float64{3, 4, math.NaN(), 11}},
+	}
+	for _, test := range tests {
+		list, err := graphite.FetchMultipleTimeseries(timeseries.FetchMultipleRequest{
+			Metrics: []api.TaggedMetric{
+				{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+				{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}},
+			},
+			RequestDetails: timeseries.RequestDetails{
+				SampleMethod: test.method,
+				Timerange:    timerange,
+				Ctx:          context.Background(),
+			},
+		})
+		a.CheckError(err)
+		a.MustEqInt(len(list.Series), 2)
+		a.Contextf("%s", test.method).EqFloatArray(list.Series[0].Values, test.expected, 1e-9)
+		a.Contextf("%s", test.method).EqFloatArray(list.Series[1].Values, []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN()}, 1e-9)
+		a.Eq(list.Series[0].TagSet, api.TagSet{"host": "a"})
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	a := assert.New(t)
+	client := mocks.NewFakeHTTPClient()
+	client.SetResponse("https://graphite.url/render?format=json&from=0&target=servers.a.cpu&until=59", mocks.Response{
+		Body:       `not json`,
+		StatusCode: 200,
+	})
+	graphite := newTestGraphite(client, time.Unix(3600, 0))
+	timerange, err := api.NewTimerange(0, 30000, 30000)
+	a.CheckError(err)
+
+	_, err = graphite.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}},
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	if _, ok := err.(timeseries.FetchError); !ok {
+		t.Errorf("expected a FetchError for a malformed response, but got %#v", err)
+	}
+
+	_, err = graphite.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "unknown"}},
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	if seriesErr, ok := err.(timeseries.Error); !ok || seriesErr.Code != timeseries.InvalidSeriesError {
+		t.Errorf("expected an InvalidSeriesError for an unconvertible metric, but got %#v", err)
+	}
+}
+
+func TestFetchErrorStatus(t *testing.T) {
+	a := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Error(writer, "graphite is down", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	metric := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}}
+	graphite := NewGraphite(Config{
+		BaseURL:     server.URL,
+		Resolutions: testResolutions,
+		GraphiteMetricConverter: &mocks.FakeGraphiteConverter{
+			MetricMap: map[util.GraphiteMetric]api.TaggedMetric{"servers.a.cpu": metric},
+		},
+		HTTPClient: http.DefaultClient,
+		Clock:      mocks.NewTestClock(time.Unix(3600, 0)),
+	})
+	timerange, err := api.NewTimerange(0, 30000, 30000)
+	a.CheckError(err)
+
+	_, err = graphite.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: metric,
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	seriesErr, ok := err.(timeseries.Error)
+	if !ok || seriesErr.Code != timeseries.FetchIOError {
+		t.Fatalf("expected a FetchIOError for a 500 response, but got %#v", err)
+	}
+	a.Eq(seriesErr.Metric, metric)
+	if !strings.Contains(seriesErr.Message, "500") || !strings.Contains(seriesErr.Message, "graphite is down") {
+		t.Errorf("expected the status and body in the error, but got %q", seriesErr.Message)
+	}
+}
@@ -37,6 +37,7 @@ type RequestDetails struct {
 	Timerange    api.Timerange   // time range to fetch data from.
 	Ctx          context.Context // context includes timeout details
 	Profiler     *inspect.Profiler
+	Tenant       string // optional. The tenant to fetch data for, for backends which have them.
 }
 
 type FetchRequest struct {
@@ -0,0 +1,334 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory holds an in-process timeseries.StorageAPI implementation,
+// intended for local development and tests.
+package memory
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/util"
+)
+
+// Storage is a timeseries storage API instance which keeps every point in memory.
+type Storage struct {
+	config Config
+
+	mutex  sync.RWMutex
+	series map[string]*series // keyed by metric key and serialized tagset
+}
+
+// Storage implements StorageAPI and StorageUpdateAPI
+var _ timeseries.StorageAPI = (*Storage)(nil)
+var _ timeseries.StorageUpdateAPI = (*Storage)(nil)
+
+// Config stores the data needed to instantiate an in-memory Storage.
+type Config struct {
+	Resolutions []time.Duration `yaml:"resolutions"` // Resolutions are ordered by priority: finest first.
+	TimeToLive  time.Duration   `yaml:"ttl"`         // TimeToLive is how long raw points are retained (0 keeps them forever).
+
+	Clock util.Clock `yaml:"-"`
+}
+
+// Point is a single raw value recorded for a metric.
+type Point struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// series holds the raw points of a single tagged metric, sorted by timestamp.
+type series struct {
+	points []Point
+}
+
+// rollup summarizes all the raw points which fall into one resolution bucket.
+type rollup struct {
+	count   int
+	average float64
+	squares float64 // the sum of the squared deviations from the average
+	min     float64
+	max     float64
+}
+
+// NewStorage uses the Config to create an instance of Storage.
+func NewStorage(config Config) *Storage {
+	if len(config.Resolutions) == 0 {
+		config.Resolutions = []time.Duration{30 * time.Second}
+	}
+	if config.Clock == nil {
+		config.Clock = util.RealClock{}
+	}
+	return &Storage{
+		config: config,
+		series: map[string]*series{},
+	}
+}
+
+func seriesKey(metric api.TaggedMetric) string {
+	return fmt.Sprintf("%s\x00%s", metric.MetricKey, metric.TagSet.Serialize())
+}
+
+// AddPoints records the given points for the metric. Points older than the
+// configured TimeToLive are discarded.
+func (s *Storage) AddPoints(metric api.TaggedMetric, points ...Point) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := seriesKey(metric)
+	current, ok := s.series[key]
+	if !ok {
+		current = &series{}
+		s.series[key] = current
+	}
+	current.points = append(current.points, points...)
+	sort.SliceStable(current.points, func(i, j int) bool {
+		return current.points[i].Timestamp.Before(current.points[j].Timestamp)
+	})
+	if s.config.TimeToLive != 0 {
+		cutoff := s.config.Clock.Now().Add(-s.config.TimeToLive)
+		expired := sort.Search(len(current.points), func(i int) bool {
+			return !current.points[i].Timestamp.Before(cutoff)
+		})
+		current.points = current.points[expired:]
+	}
+}
+
+// WritePoints records each datapoint, as AddPoints does.
+func (s *Storage) WritePoints(request timeseries.WriteRequest) error {
+	for _, datapoint := range request.Datapoints {
+		s.AddPoints(datapoint.Metric, Point{Timestamp: datapoint.Timestamp, Value: datapoint.Value})
+	}
+	return nil
+}
+
+// CheckHealthy always succeeds, since the storage lives in-process.
+func (s *Storage) CheckHealthy() error {
+	return nil
+}
+
+// ChooseResolution will choose the finest-grained configured resolution that
+// is at least as coarse as both the lower bound and the requested resolution.
+func (s *Storage) ChooseResolution(requested api.Timerange, lowerBound time.Duration) (time.Duration, error) {
+	if s.config.TimeToLive != 0 && requested.Start().Before(s.config.Clock.Now().Add(-s.config.TimeToLive)) {
+		return 0, fmt.Errorf("cannot choose resolution for timerange %+v; points are only kept for %+v", requested, s.config.TimeToLive)
+	}
+	for _, resolution := range s.config.Resolutions {
+		if resolution < lowerBound || resolution < requested.Resolution() {
+			continue
+		}
+		return resolution, nil
+	}
+	return 0, fmt.Errorf("cannot choose resolution for timerange %+v; available resolutions are too fine", requested)
+}
+
+// FetchSingleTimeseries rolls up and samples the stored points of the given metric.
+func (s *Storage) FetchSingleTimeseries(request timeseries.FetchRequest) (api.Timeseries, error) {
+	defer request.Profiler.RecordWithDescription("Memory FetchSingleTimeseries", request.Metric.String())()
+	resolution, err := s.rollupResolution(request.Timerange)
+	if err != nil {
+		return api.Timeseries{}, err
+	}
+	sampleBucket, ok := bucketSamplers[request.SampleMethod]
+	if !ok {
+		return api.Timeseries{}, unsupportedSampleMethod(request.Metric, request.SampleMethod)
+	}
+	return s.fetchTimeseries(request.Metric, request.Timerange, resolution, sampleBucket), nil
+}
+
+// FetchMultipleTimeseries fetches each of the requested metrics in turn.
+func (s *Storage) FetchMultipleTimeseries(request timeseries.FetchMultipleRequest) (api.SeriesList, error) {
+	defer request.Profiler.Record("Memory FetchMultipleTimeseries")()
+	resolution, err := s.rollupResolution(request.Timerange)
+	if err != nil {
+		return api.SeriesList{}, err
+	}
+	sampleBucket, ok := bucketSamplers[request.SampleMethod]
+	if !ok {
+		metric := api.TaggedMetric{}
+		if len(request.Metrics) > 0 {
+			metric = request.Metrics[0]
+		}
+		return api.SeriesList{}, unsupportedSampleMethod(metric, request.SampleMethod)
+	}
+	results := make([]api.Timeseries, len(request.Metrics))
+	for i, metric := range request.Metrics {
+		if request.Ctx != nil {
+			if err := request.Ctx.Err(); err != nil {
+				return api.SeriesList{}, err
+			}
+		}
+		results[i] = s.fetchTimeseries(metric, request.Timerange, resolution, sampleBucket)
+	}
+	return api.SeriesList{
+		Series: results,
+	}, nil
+}
+
+// unsupportedSampleMethod is the error for sample methods (such as
+// percentiles) which can't be computed from the rollups.
+func unsupportedSampleMethod(metric api.TaggedMetric, method timeseries.SampleMethod) error {
+	return timeseries.Error{
+		Metric:  metric,
+		Code:    timeseries.Unsupported,
+		Message: fmt.Sprintf("the in-memory storage cannot sample by %s", method.String()),
+	}
+}
+
+// rollupResolution picks the coarsest configured resolution that is no coarser
+// than the requested timerange, mirroring Blueflood's "only finer" planning.
+func (s *Storage) rollupResolution(timerange api.Timerange) (time.Duration, error) {
+	chosen := time.Duration(0)
+	for _, resolution := range s.config.Resolutions {
+		if resolution <= timerange.Resolution() && resolution > chosen {
+			chosen = resolution
+		}
+	}
+	if chosen == 0 {
+		return 0, fmt.Errorf("no resolutions are available at least as fine as the chosen %+v", timerange.Resolution())
+	}
+	return chosen, nil
+}
+
+// fetchTimeseries rolls the raw points up to the given resolution and then
+// samples the rollups into the slots of the timerange.
+func (s *Storage) fetchTimeseries(metric api.TaggedMetric, timerange api.Timerange, resolution time.Duration, sampleBucket func([]rollup) float64) api.Timeseries {
+	rollups := s.rollup(metric, timerange, resolution)
+
+	buckets := make([][]rollup, timerange.Slots())
+	for bucketStart, summary := range rollups {
+		index := (bucketStart - timerange.StartMillis()) / timerange.ResolutionMillis()
+		if bucketStart < timerange.StartMillis() || int(index) >= len(buckets) {
+			continue
+		}
+		buckets[index] = append(buckets[index], summary)
+	}
+
+	values := make([]float64, timerange.Slots())
+	for i, bucket := range buckets {
+		if len(bucket) == 0 {
+			values[i] = math.NaN()
+			continue
+		}
+		values[i] = sampleBucket(bucket)
+	}
+	return api.Timeseries{
+		Values: values,
+		TagSet: metric.TagSet,
+	}
+}
+
+// rollup summarizes the raw points of the metric within the timerange into
+// buckets of the given resolution, keyed by bucket start in milliseconds.
+func (s *Storage) rollup(metric api.TaggedMetric, timerange api.Timerange, resolution time.Duration) map[int64]rollup {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := map[int64]rollup{}
+	current, ok := s.series[seriesKey(metric)]
+	if !ok {
+		return result
+	}
+	resolutionMillis := int64(resolution / time.Millisecond)
+	start := timerange.Start()
+	end := timerange.End().Add(timerange.Resolution())
+	first := sort.Search(len(current.points), func(i int) bool {
+		return !current.points[i].Timestamp.Before(start)
+	})
+	for _, point := range current.points[first:] {
+		if !point.Timestamp.Before(end) {
+			break
+		}
+		if math.IsNaN(point.Value) {
+			continue
+		}
+		millis := point.Timestamp.UnixNano() / 1e6
+		bucketStart := millis - millis%resolutionMillis
+		summary, ok := result[bucketStart]
+		if !ok {
+			result[bucketStart] = rollup{count: 1, average: point.Value, min: point.Value, max: point.Value}
+			continue
+		}
+		summary.count++
+		deviation := point.Value - summary.average
+		summary.average += deviation / float64(summary.count)
+		summary.squares += deviation * (point.Value - summary.average)
+		summary.min = math.Min(summary.min, point.Value)
+		summary.max = math.Max(summary.max, point.Value)
+		result[bucketStart] = summary
+	}
+	return result
+}
+
+// bucketSamplers combine the rollups in one slot the same way the Blueflood
+// sampler combines the rolled-up points it receives.
+var bucketSamplers = map[timeseries.SampleMethod]func([]rollup) float64{
+	timeseries.SampleMean: func(bucket []rollup) float64 {
+		value := 0.0
+		for _, summary := range bucket {
+			value += summary.average
+		}
+		return value / float64(len(bucket))
+	},
+	timeseries.SampleMin: func(bucket []rollup) float64 {
+		smallest := bucket[0].min
+		for _, summary := range bucket[1:] {
+			smallest = math.Min(smallest, summary.min)
+		}
+		return smallest
+	},
+	timeseries.SampleMax: func(bucket []rollup) float64 {
+		largest := bucket[0].max
+		for _, summary := range bucket[1:] {
+			largest = math.Max(largest, summary.max)
+		}
+		return largest
+	},
+	timeseries.SampleCount: func(bucket []rollup) float64 {
+		count := 0
+		for _, summary := range bucket {
+			count += summary.count
+		}
+		return float64(count)
+	},
+	timeseries.SampleSum: func(bucket []rollup) float64 {
+		sum := 0.0
+		for _, summary := range bucket {
+			sum += summary.average * float64(summary.count)
+		}
+		return sum
+	},
+	timeseries.SampleStddev: func(bucket []rollup) float64 {
+		// As in Blueflood, the pooled variance is the weighted mean of the
+		// rollups' variances plus the variance of their averages.
+		count := 0.0
+		mean := 0.0
+		for _, summary := range bucket {
+			count += float64(summary.count)
+			mean += summary.average * float64(summary.count)
+		}
+		mean /= count
+		variance := 0.0
+		for _, summary := range bucket {
+			deviation := summary.average - mean
+			variance += summary.squares + float64(summary.count)*deviation*deviation
+		}
+		return math.Sqrt(variance / count)
+	},
+}
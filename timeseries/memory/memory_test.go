@@ -0,0 +1,176 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/testing_support/mocks"
+	"github.com/square/metrics/timeseries"
+)
+
+func newTestStorage(now time.Time) *Storage {
+	return NewStorage(Config{
+		Resolutions: []time.Duration{30 * time.Second, 5 * time.Minute},
+		Clock:       mocks.NewTestClock(now),
+	})
+}
+
+func TestChooseResolution(t *testing.T) {
+	a := assert.New(t)
+	now := time.Unix(3600, 0)
+	storage := newTestStorage(now)
+	timerange, err := api.NewTimerange(0, 3600000, 30000)
+	a.CheckError(err)
+
+	chosen, err := storage.ChooseResolution(timerange, 0)
+	a.CheckError(err)
+	a.Eq(chosen, 30*time.Second)
+
+	chosen, err = storage.ChooseResolution(timerange, time.Minute)
+	a.CheckError(err)
+	a.Eq(chosen, 5*time.Minute)
+
+	if _, err := storage.ChooseResolution(timerange, time.Hour); err == nil {
+		t.Errorf("expected an error when no resolution is coarse enough")
+	}
+}
+
+func TestFetchSampleMethods(t *testing.T) {
+	a := assert.New(t)
+	now := time.Unix(3600, 0)
+	storage := newTestStorage(now)
+	metric := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}}
+	storage.AddPoints(metric,
+		Point{Timestamp: time.Unix(0, 0), Value: 1},
+		Point{Timestamp: time.Unix(10, 0), Value: 3},
+		Point{Timestamp: time.Unix(40, 0), Value: 4},
+		Point{Timestamp: time.Unix(90, 0), Value: 8},
+		Point{Timestamp: time.Unix(100, 0), Value: 6},
+	)
+
+	tests := []struct {
+		method     timeseries.SampleMethod
+		resolution int64
+		expected   []float64
+	}{
+		{timeseries.SampleMean, 30000, []float64{2, 4, math.NaN(), 7, math.NaN()}},
+		{timeseries.SampleMin, 30000, []float64{1, 4, math.NaN(), 6, math.NaN()}},
+		{timeseries.SampleMax, 30000, []float64{3, 4, math.NaN(), 8, math.NaN()}},
+		{timeseries.SampleCount, 30000, []float64{2, 1, math.NaN(), 2, math.NaN()}},
+		{timeseries.SampleSum, 30000, []float64{4, 4, math.NaN(), 14, math.NaN()}},
+		{timeseries.SampleStddev, 30000, []float64{1, 0, math.NaN(), 1, math.NaN()}},
+		// Mean is the mean of the 30s rollups, as in Blueflood: (2 + 4) / 2 and 7.
+		{timeseries.SampleMean, 60000, []float64{3, 7, math.NaN()}},
+		{timeseries.SampleMax, 60000, []float64{4, 8, math.NaN()}},
+		// Count, sum and stddev are of the raw values: 1, 3 and 4, then 8 and 6.
+		{timeseries.SampleCount, 60000, []float64{3, 2, math.NaN()}},
+		{timeseries.SampleSum, 60000, []float64{8, 14, math.NaN()}},
+		{timeseries.SampleStddev, 60000, []float64{math.Sqrt(14.0 / 9), 1, math.NaN()}},
+	}
+	for _, test := range tests {
+		timerange, err := api.NewTimerange(0, 120000, test.resolution)
+		a.CheckError(err)
+		result, err := storage.FetchSingleTimeseries(timeseries.FetchRequest{
+			Metric: metric,
+			RequestDetails: timeseries.RequestDetails{
+				SampleMethod: test.method,
+				Timerange:    timerange,
+				Ctx:          context.Background(),
+			},
+		})
+		a.CheckError(err)
+		a.Contextf("%s at %d", test.method, test.resolution).EqFloatArray(result.Values, test.expected, 1e-9)
+		a.Eq(result.TagSet, metric.TagSet)
+	}
+
+	// Percentiles can't be computed from the rollups.
+	timerange, err := api.NewTimerange(0, 120000, 30000)
+	a.CheckError(err)
+	_, err = storage.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: metric,
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleP99,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	if seriesErr, ok := err.(timeseries.Error); !ok || seriesErr.Code != timeseries.Unsupported {
+		t.Errorf("expected an Unsupported error for a percentile, but got %#v", err)
+	}
+}
+
+func TestFetchMultiple(t *testing.T) {
+	a := assert.New(t)
+	now := time.Unix(3600, 0)
+	storage := newTestStorage(now)
+	first := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "a"}}
+	second := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "b"}}
+	missing := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{"host": "c"}}
+	storage.AddPoints(first, Point{Timestamp: time.Unix(30, 0), Value: 5})
+	storage.AddPoints(second, Point{Timestamp: time.Unix(0, 0), Value: 7})
+
+	timerange, err := api.NewTimerange(0, 30000, 30000)
+	a.CheckError(err)
+	result, err := storage.FetchMultipleTimeseries(timeseries.FetchMultipleRequest{
+		Metrics: []api.TaggedMetric{first, second, missing},
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	a.CheckError(err)
+	a.MustEqInt(len(result.Series), 3)
+	a.EqFloatArray(result.Series[0].Values, []float64{math.NaN(), 5}, 1e-9)
+	a.EqFloatArray(result.Series[1].Values, []float64{7, math.NaN()}, 1e-9)
+	a.EqFloatArray(result.Series[2].Values, []float64{math.NaN(), math.NaN()}, 1e-9)
+}
+
+func TestTimeToLive(t *testing.T) {
+	a := assert.New(t)
+	now := time.Unix(3600, 0)
+	storage := NewStorage(Config{
+		Resolutions: []time.Duration{30 * time.Second},
+		TimeToLive:  time.Hour - time.Minute,
+		Clock:       mocks.NewTestClock(now),
+	})
+	metric := api.TaggedMetric{MetricKey: "cpu", TagSet: api.TagSet{}}
+	storage.AddPoints(metric, Point{Timestamp: time.Unix(0, 0), Value: 1}, Point{Timestamp: time.Unix(3570, 0), Value: 2})
+
+	timerange, err := api.NewTimerange(0, 30000, 30000)
+	a.CheckError(err)
+	if _, err := storage.ChooseResolution(timerange, 0); err == nil {
+		t.Errorf("expected an error for a timerange older than the TTL")
+	}
+
+	timerange, err = api.NewTimerange(3540000, 3570000, 30000)
+	a.CheckError(err)
+	result, err := storage.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: metric,
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	a.CheckError(err)
+	a.EqFloatArray(result.Values, []float64{math.NaN(), 2}, 1e-9)
+}
@@ -0,0 +1,340 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prometheus holds a timeseries.StorageAPI implementation which reads
+// from Prometheus through its remote-read endpoint.
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/tasks"
+	"github.com/square/metrics/timeseries"
+	"github.com/square/metrics/util"
+)
+
+// MetricNameLabel is the label Prometheus uses to hold a series' metric name.
+const MetricNameLabel = "__name__"
+
+// Prometheus is a timeseries storage API instance.
+type Prometheus struct {
+	config Config
+}
+
+// Prometheus implements StorageAPI
+var _ timeseries.StorageAPI = (*Prometheus)(nil)
+
+// Config stores data needed to instantiate a Prometheus storage API.
+type Config struct {
+	ReadURL                 string        `yaml:"read_url"`              // ReadURL is the remote-read endpoint, e.g. http://prometheus:9090/api/v1/read
+	HealthURL               string        `yaml:"health_url"`            // HealthURL is optional; when empty, health is checked with an empty read.
+	ScrapeInterval          time.Duration `yaml:"scrape_interval"`       // ScrapeInterval is the finest resolution offered (default 15s).
+	QueriesPerRequest       int           `yaml:"queries_per_request"`   // QueriesPerRequest bounds how many series are read in one HTTP call.
+	MaxSimultaneousRequests int           `yaml:"simultaneous_requests"` // MaxSimultaneousRequests limits the number of concurrent HTTP calls for each multi-fetch.
+
+	HTTPClient httpClient `yaml:"-"`
+	Clock      util.Clock `yaml:"-"`
+}
+
+type httpClient interface {
+	// our own client to mock out the standard golang HTTP Client.
+	Do(*http.Request) (*http.Response, error)
+}
+
+// NewPrometheus uses the Config to create an instance of Prometheus.
+func NewPrometheus(config Config) timeseries.StorageAPI {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.Clock == nil {
+		config.Clock = util.RealClock{}
+	}
+	if config.ScrapeInterval == 0 {
+		config.ScrapeInterval = 15 * time.Second
+	}
+	if config.QueriesPerRequest == 0 {
+		config.QueriesPerRequest = 50
+	}
+	if config.MaxSimultaneousRequests == 0 {
+		config.MaxSimultaneousRequests = 5
+	}
+	return &Prometheus{
+		config: config,
+	}
+}
+
+// CheckHealthy checks whether the Prometheus server responds successfully.
+func (p *Prometheus) CheckHealthy() error {
+	if p.config.HealthURL != "" {
+		request, err := http.NewRequest("GET", p.config.HealthURL, nil)
+		if err != nil {
+			return err
+		}
+		response, err := p.config.HTTPClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(response.Body)
+			return fmt.Errorf("the Prometheus instance returned an unhealthy status of %d: %s", response.StatusCode, string(body))
+		}
+		return nil
+	}
+	_, err := p.read(ReadRequest{}, context.Background())
+	return err
+}
+
+// ChooseResolution rounds the coarsest of the requested resolution and the lower
+// bound up to a multiple of the scrape interval. Prometheus keeps raw samples,
+// so any such multiple is available.
+func (p *Prometheus) ChooseResolution(requested api.Timerange, lowerBound time.Duration) (time.Duration, error) {
+	resolution := requested.Resolution()
+	if lowerBound > resolution {
+		resolution = lowerBound
+	}
+	scrape := p.config.ScrapeInterval
+	if remainder := resolution % scrape; remainder != 0 || resolution == 0 {
+		resolution += scrape - remainder
+	}
+	return resolution, nil
+}
+
+// FetchSingleTimeseries fetches a timeseries with the given tagged metric.
+func (p *Prometheus) FetchSingleTimeseries(request timeseries.FetchRequest) (api.Timeseries, error) {
+	defer request.Profiler.RecordWithDescription("Prometheus FetchSingleTimeseries", request.Metric.String())()
+	list, err := p.FetchMultipleTimeseries(timeseries.FetchMultipleRequest{
+		Metrics:        []api.TaggedMetric{request.Metric},
+		RequestDetails: request.RequestDetails,
+	})
+	if err != nil {
+		return api.Timeseries{}, err
+	}
+	return list.Series[0], nil
+}
+
+// FetchMultipleTimeseries fetches the metrics in batches of remote-read queries.
+func (p *Prometheus) FetchMultipleTimeseries(request timeseries.FetchMultipleRequest) (api.SeriesList, error) {
+	defer request.Profiler.Record("Prometheus FetchMultipleTimeseries")()
+	sampleBucket, ok := bucketSamplers[request.SampleMethod]
+	if !ok {
+		return api.SeriesList{}, fmt.Errorf("unsupported SampleMethod %s", request.SampleMethod.String())
+	}
+	ctx := request.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	results := make([]api.Timeseries, len(request.Metrics))
+	queue := tasks.NewParallelQueue(p.config.MaxSimultaneousRequests, ctx)
+	for start := 0; start < len(request.Metrics); start += p.config.QueriesPerRequest {
+		end := start + p.config.QueriesPerRequest
+		if end > len(request.Metrics) {
+			end = len(request.Metrics)
+		}
+		start, end := start, end
+		queue.Do(func() error {
+			defer request.Profiler.RecordWithDescription("Prometheus remote read", fmt.Sprintf("%d series", end-start))()
+			readRequest := ReadRequest{Queries: make([]Query, end-start)}
+			for i, metric := range request.Metrics[start:end] {
+				readRequest.Queries[i] = makeQuery(metric, request.Timerange)
+			}
+			response, err := p.read(readRequest, ctx)
+			if err != nil {
+				return err
+			}
+			if len(response.Results) != len(readRequest.Queries) {
+				return timeseries.FetchError{Code: 500, Message: fmt.Sprintf("Prometheus returned %d results for %d queries", len(response.Results), len(readRequest.Queries))}
+			}
+			for i, result := range response.Results {
+				metric := request.Metrics[start+i]
+				results[start+i] = api.Timeseries{
+					Values: samplePoints(exactSeries(result.Timeseries, metric), request.Timerange, sampleBucket),
+					TagSet: metric.TagSet,
+				}
+			}
+			return nil
+		})
+	}
+	if err := queue.Wait(); err != nil {
+		return api.SeriesList{}, err
+	}
+	return api.SeriesList{
+		Series: results,
+	}, nil
+}
+
+// Helper functions
+// ----------------
+
+var invalidNameCharacters = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// metricName converts the MetricKey into a legal Prometheus metric name by
+// replacing illegal characters (such as '.') with underscores.
+func metricName(metricKey api.MetricKey) string {
+	return invalidNameCharacters.ReplaceAllString(string(metricKey), "_")
+}
+
+// makeQuery creates a query selecting the given metric's series. Equality
+// matchers also select series with further labels, which exactSeries drops.
+// Points are fetched until one resolution past the end of the timerange, since
+// the last slot summarizes the interval that follows it.
+func makeQuery(metric api.TaggedMetric, timerange api.Timerange) Query {
+	matchers := []LabelMatcher{{Type: MatchEqual, Name: MetricNameLabel, Value: metricName(metric.MetricKey)}}
+	keys := make([]string, 0, len(metric.TagSet))
+	for key := range metric.TagSet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		matchers = append(matchers, LabelMatcher{Type: MatchEqual, Name: key, Value: metric.TagSet[key]})
+	}
+	return Query{
+		StartTimestampMs: timerange.StartMillis(),
+		EndTimestampMs:   timerange.EndMillis() + timerange.ResolutionMillis() - 1,
+		Matchers:         matchers,
+	}
+}
+
+// read performs a single remote-read call.
+func (p *Prometheus) read(readRequest ReadRequest, ctx context.Context) (ReadResponse, error) {
+	body := snappy.Encode(nil, readRequest.Marshal())
+	request, err := http.NewRequest("POST", p.config.ReadURL, bytes.NewReader(body))
+	if err != nil {
+		return ReadResponse{}, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+
+	response, err := p.config.HTTPClient.Do(request)
+	if err != nil {
+		return ReadResponse{}, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error reading from Prometheus at URL %q: %s", p.config.ReadURL, err.Error())}
+	}
+	defer response.Body.Close()
+	compressed, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return ReadResponse{}, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error reading from Prometheus response body at URL %q: %s", p.config.ReadURL, err.Error())}
+	}
+	if response.StatusCode != http.StatusOK {
+		return ReadResponse{}, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("Prometheus at URL %q returned status %d: %s", p.config.ReadURL, response.StatusCode, compressed)}
+	}
+	decompressed, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return ReadResponse{}, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error decompressing Prometheus response at URL %q: %s", p.config.ReadURL, err.Error())}
+	}
+	readResponse := ReadResponse{}
+	if err := readResponse.Unmarshal(decompressed); err != nil {
+		return ReadResponse{}, timeseries.FetchError{Code: 500, Message: fmt.Sprintf("error decoding Prometheus response at URL %q: %s", p.config.ReadURL, err.Error())}
+	}
+	return readResponse, nil
+}
+
+// exactSeries returns the series whose labels are exactly the metric's name
+// and tags.
+func exactSeries(series []TimeSeries, metric api.TaggedMetric) []TimeSeries {
+	name := metricName(metric.MetricKey)
+	result := []TimeSeries{}
+SeriesLoop:
+	for _, s := range series {
+		if len(s.Labels) != len(metric.TagSet)+1 {
+			continue
+		}
+		for _, label := range s.Labels {
+			if label.Name == MetricNameLabel {
+				if label.Value != name {
+					continue SeriesLoop
+				}
+				continue
+			}
+			if value, ok := metric.TagSet[label.Name]; !ok || value != label.Value {
+				continue SeriesLoop
+			}
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// samplePoints samples the raw samples of the given series into a uniform
+// slice of float64s.
+func samplePoints(series []TimeSeries, timerange api.Timerange, sampleBucket func([]float64) float64) []float64 {
+	buckets := make([][]float64, timerange.Slots())
+	for _, s := range series {
+		for _, sample := range s.Samples {
+			if sample.Timestamp < timerange.StartMillis() {
+				continue
+			}
+			index := (sample.Timestamp - timerange.StartMillis()) / timerange.ResolutionMillis()
+			if int(index) >= len(buckets) {
+				continue
+			}
+			buckets[index] = append(buckets[index], sample.Value)
+		}
+	}
+	values := make([]float64, timerange.Slots())
+	for i, bucket := range buckets {
+		if len(bucket) == 0 {
+			values[i] = math.NaN()
+			continue
+		}
+		values[i] = sampleBucket(bucket)
+	}
+	return values
+}
+
+// bucketSamplers combine the raw samples in one slot, ignoring NaNs (which
+// Prometheus uses as staleness markers).
+var bucketSamplers = map[timeseries.SampleMethod]func([]float64) float64{
+	timeseries.SampleMean: func(bucket []float64) float64 {
+		value := 0.0
+		count := 0
+		for _, v := range bucket {
+			if !math.IsNaN(v) {
+				value += v
+				count++
+			}
+		}
+		return value / float64(count)
+	},
+	timeseries.SampleMin: func(bucket []float64) float64 {
+		smallest := math.NaN()
+		for _, v := range bucket {
+			if math.IsNaN(smallest) || v < smallest {
+				smallest = v
+			}
+		}
+		return smallest
+	},
+	timeseries.SampleMax: func(bucket []float64) float64 {
+		largest := math.NaN()
+		for _, v := range bucket {
+			if math.IsNaN(largest) || v > largest {
+				largest = v
+			}
+		}
+		return largest
+	},
+}
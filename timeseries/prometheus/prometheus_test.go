@@ -0,0 +1,232 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/testing_support/assert"
+	"github.com/square/metrics/timeseries"
+)
+
+// fakeRemoteRead is a stand-in for Prometheus' remote-read endpoint. It serves
+// the canned series whose labels are matched by each query.
+type fakeRemoteRead struct {
+	series []TimeSeries
+
+	mutex    sync.Mutex
+	requests []ReadRequest
+}
+
+func (f *fakeRemoteRead) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Header.Get("Content-Encoding") != "snappy" {
+		http.Error(writer, "expected snappy encoding", http.StatusBadRequest)
+		return
+	}
+	compressed, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	decompressed, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	readRequest := ReadRequest{}
+	if err := readRequest.Unmarshal(decompressed); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mutex.Lock()
+	f.requests = append(f.requests, readRequest)
+	f.mutex.Unlock()
+
+	response := ReadResponse{}
+	for _, query := range readRequest.Queries {
+		result := QueryResult{}
+	SeriesLoop:
+		for _, series := range f.series {
+			labels := map[string]string{}
+			for _, label := range series.Labels {
+				labels[label.Name] = label.Value
+			}
+			for _, matcher := range query.Matchers {
+				if matcher.Type != MatchEqual || labels[matcher.Name] != matcher.Value {
+					continue SeriesLoop
+				}
+			}
+			selected := TimeSeries{Labels: series.Labels}
+			for _, sample := range series.Samples {
+				if query.StartTimestampMs <= sample.Timestamp && sample.Timestamp <= query.EndTimestampMs {
+					selected.Samples = append(selected.Samples, sample)
+				}
+			}
+			result.Timeseries = append(result.Timeseries, selected)
+		}
+		response.Results = append(response.Results, result)
+	}
+	writer.Header().Set("Content-Type", "application/x-protobuf")
+	writer.Header().Set("Content-Encoding", "snappy")
+	writer.Write(snappy.Encode(nil, response.Marshal()))
+}
+
+func TestProtobufRoundtrip(t *testing.T) {
+	a := assert.New(t)
+	response := ReadResponse{
+		Results: []QueryResult{
+			{
+				Timeseries: []TimeSeries{
+					{
+						Labels:  []Label{{Name: MetricNameLabel, Value: "up"}, {Name: "job", Value: "mqe"}},
+						Samples: []Sample{{Value: 1.5, Timestamp: 1000}, {Value: -2, Timestamp: 2000}},
+					},
+				},
+			},
+			{}, // an empty result must keep its position
+		},
+	}
+	decoded := ReadResponse{}
+	a.CheckError(decoded.Unmarshal(response.Marshal()))
+	a.MustEqInt(len(decoded.Results), 2)
+	a.Eq(decoded.Results[0], response.Results[0])
+	a.EqInt(len(decoded.Results[1].Timeseries), 0)
+
+	if err := decoded.Unmarshal(response.Marshal()[:10]); err == nil {
+		t.Errorf("expected an error decoding a truncated message")
+	}
+}
+
+func TestFetchMultipleTimeseries(t *testing.T) {
+	a := assert.New(t)
+	fake := &fakeRemoteRead{
+		series: []TimeSeries{
+			{
+				Labels: []Label{{Name: MetricNameLabel, Value: "http_requests"}, {Name: "host", Value: "a"}},
+				Samples: []Sample{
+					{Value: 1, Timestamp: 0},
+					{Value: 3, Timestamp: 15000},
+					{Value: 4, Timestamp: 30000},
+					{Value: math.NaN(), Timestamp: 45000},
+					{Value: 9, Timestamp: 90000},
+					{Value: 100, Timestamp: 120000}, // past the end of the request
+				},
+			},
+			{
+				Labels:  []Label{{Name: MetricNameLabel, Value: "http_requests"}, {Name: "host", Value: "b"}},
+				Samples: []Sample{{Value: 7, Timestamp: 60000}},
+			},
+			{
+				// The queries for host=a also match this series, but its labels differ.
+				Labels:  []Label{{Name: MetricNameLabel, Value: "http_requests"}, {Name: "host", Value: "a"}, {Name: "job", Value: "batch"}},
+				Samples: []Sample{{Value: 1000, Timestamp: 0}, {Value: 1000, Timestamp: 60000}},
+			},
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	storage := NewPrometheus(Config{
+		ReadURL:           server.URL,
+		QueriesPerRequest: 2,
+	})
+	timerange, err := api.NewTimerange(0, 90000, 30000)
+	a.CheckError(err)
+
+	metrics := []api.TaggedMetric{
+		{MetricKey: "http.requests", TagSet: api.TagSet{"host": "a"}},
+		{MetricKey: "http.requests", TagSet: api.TagSet{"host": "b"}},
+		{MetricKey: "http.requests", TagSet: api.TagSet{"host": "c"}},
+	}
+	tests := []struct {
+		method   timeseries.SampleMethod
+		expected [][]float64
+	}{
+		{timeseries.SampleMean, [][]float64{{2, 4, math.NaN(), 9}, {math.NaN(), math.NaN(), 7, math.NaN()}, {math.NaN(), math.NaN(), math.NaN(), math.NaN()}}},
+		{timeseries.SampleMax, [][]float64{{3, 4, math.NaN(), 9}, {math.NaN(), math.NaN(), 7, math.NaN()}, {math.NaN(), math.NaN(), math.NaN(), math.NaN()}}},
+		{timeseries.SampleMin, [][]float64{{1, 4, math.NaN(), 9}, {math.NaN(), math.NaN(), 7, math.NaN()}, {math.NaN(), math.NaN(), math.NaN(), math.NaN()}}},
+	}
+	for _, test := range tests {
+		list, err := storage.FetchMultipleTimeseries(timeseries.FetchMultipleRequest{
+			Metrics: metrics,
+			RequestDetails: timeseries.RequestDetails{
+				SampleMethod: test.method,
+				Timerange:    timerange,
+				Ctx:          context.Background(),
+			},
+		})
+		a.CheckError(err)
+		a.MustEqInt(len(list.Series), len(metrics))
+		for i := range metrics {
+			a.Contextf("%s series %d", test.method, i).EqFloatArray(list.Series[i].Values, test.expected[i], 1e-9)
+			a.Eq(list.Series[i].TagSet, metrics[i].TagSet)
+		}
+	}
+
+	// Three metrics in batches of two means two requests per fetch.
+	a.EqInt(len(fake.requests), 2*len(tests))
+	query := fake.requests[0].Queries[0]
+	a.Eq(query.StartTimestampMs, int64(0))
+	a.Eq(query.EndTimestampMs, int64(119999))
+}
+
+func TestChooseResolution(t *testing.T) {
+	a := assert.New(t)
+	storage := NewPrometheus(Config{ScrapeInterval: 15 * time.Second})
+	timerange, err := api.NewTimerange(0, 3600000, 10000)
+	a.CheckError(err)
+
+	resolution, err := storage.ChooseResolution(timerange, 0)
+	a.CheckError(err)
+	a.Eq(resolution, 15*time.Second)
+
+	resolution, err = storage.ChooseResolution(timerange, 61*time.Second)
+	a.CheckError(err)
+	a.Eq(resolution, 75*time.Second)
+}
+
+func TestFetchError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Error(writer, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	storage := NewPrometheus(Config{ReadURL: server.URL})
+	timerange, err := api.NewTimerange(0, 30000, 30000)
+	assert.New(t).CheckError(err)
+	_, err = storage.FetchSingleTimeseries(timeseries.FetchRequest{
+		Metric: api.TaggedMetric{MetricKey: "up", TagSet: api.TagSet{}},
+		RequestDetails: timeseries.RequestDetails{
+			SampleMethod: timeseries.SampleMean,
+			Timerange:    timerange,
+			Ctx:          context.Background(),
+		},
+	})
+	if _, ok := err.(timeseries.FetchError); !ok {
+		t.Errorf("expected a timeseries.FetchError but got %#v", err)
+	}
+	if storage.CheckHealthy() == nil {
+		t.Errorf("expected an unhealthy status")
+	}
+}
@@ -0,0 +1,420 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+// This file holds a minimal hand-written encoding of the messages in
+// Prometheus's remote-read protocol (prompb/remote.proto and prompb/types.proto).
+// Only the fields that MQE uses are encoded; unknown fields are skipped.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MatchType is the kind of comparison performed by a LabelMatcher.
+type MatchType int
+
+const (
+	MatchEqual     MatchType = 0 // MatchEqual selects labels equal to the value.
+	MatchNotEqual  MatchType = 1 // MatchNotEqual selects labels not equal to the value.
+	MatchRegexp    MatchType = 2 // MatchRegexp selects labels matching the regex.
+	MatchNotRegexp MatchType = 3 // MatchNotRegexp selects labels not matching the regex.
+)
+
+// LabelMatcher restricts the series selected by a Query.
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+}
+
+// Query selects the samples of every series matching all of its matchers.
+type Query struct {
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	Matchers         []LabelMatcher
+}
+
+// ReadRequest is the body of a remote-read request.
+type ReadRequest struct {
+	Queries []Query
+}
+
+// Label is a single name/value pair identifying a series.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single point of a series.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries is a labelled list of samples.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// QueryResult holds the series selected by the Query at the same index.
+type QueryResult struct {
+	Timeseries []TimeSeries
+}
+
+// ReadResponse is the body of a remote-read response.
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated protobuf message")
+
+func appendVarint(buffer []byte, value uint64) []byte {
+	for value >= 0x80 {
+		buffer = append(buffer, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(buffer, byte(value))
+}
+
+func appendKey(buffer []byte, field int, wireType int) []byte {
+	return appendVarint(buffer, uint64(field)<<3|uint64(wireType))
+}
+
+func appendVarintField(buffer []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return buffer
+	}
+	return appendVarint(appendKey(buffer, field, wireVarint), value)
+}
+
+func appendBytesField(buffer []byte, field int, value []byte) []byte {
+	buffer = appendKey(buffer, field, wireBytes)
+	buffer = appendVarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+func appendStringField(buffer []byte, field int, value string) []byte {
+	if value == "" {
+		return buffer
+	}
+	return appendBytesField(buffer, field, []byte(value))
+}
+
+func appendDoubleField(buffer []byte, field int, value float64) []byte {
+	buffer = appendKey(buffer, field, wireFixed64)
+	var encoded [8]byte
+	binary.LittleEndian.PutUint64(encoded[:], math.Float64bits(value))
+	return append(buffer, encoded[:]...)
+}
+
+// fieldReader iterates over the fields of an encoded message.
+type fieldReader struct {
+	data []byte
+
+	field    int
+	wireType int
+	varint   uint64 // holds the value of varint and fixed-width fields
+	bytes    []byte // holds the value of length-delimited fields
+}
+
+func readVarint(data []byte) (uint64, int, error) {
+	value := uint64(0)
+	for i := 0; i < len(data) && i < 10; i++ {
+		value |= uint64(data[i]&0x7f) << (7 * uint(i))
+		if data[i] < 0x80 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, errTruncated
+}
+
+// next advances to the next field, returning false when the message is exhausted.
+func (r *fieldReader) next() (bool, error) {
+	if len(r.data) == 0 {
+		return false, nil
+	}
+	key, n, err := readVarint(r.data)
+	if err != nil {
+		return false, err
+	}
+	r.data = r.data[n:]
+	r.field = int(key >> 3)
+	r.wireType = int(key & 7)
+	switch r.wireType {
+	case wireVarint:
+		r.varint, n, err = readVarint(r.data)
+		if err != nil {
+			return false, err
+		}
+	case wireFixed64:
+		if len(r.data) < 8 {
+			return false, errTruncated
+		}
+		r.varint, n = binary.LittleEndian.Uint64(r.data), 8
+	case wireFixed32:
+		if len(r.data) < 4 {
+			return false, errTruncated
+		}
+		r.varint, n = uint64(binary.LittleEndian.Uint32(r.data)), 4
+	case wireBytes:
+		length, m, err := readVarint(r.data)
+		if err != nil {
+			return false, err
+		}
+		if uint64(len(r.data)-m) < length {
+			return false, errTruncated
+		}
+		r.bytes = r.data[m : m+int(length)]
+		n = m + int(length)
+	default:
+		return false, fmt.Errorf("unsupported protobuf wire type %d", r.wireType)
+	}
+	r.data = r.data[n:]
+	return true, nil
+}
+
+// Marshal encodes the LabelMatcher.
+func (m LabelMatcher) Marshal() []byte {
+	buffer := appendVarintField(nil, 1, uint64(m.Type))
+	buffer = appendStringField(buffer, 2, m.Name)
+	return appendStringField(buffer, 3, m.Value)
+}
+
+// Unmarshal decodes the LabelMatcher.
+func (m *LabelMatcher) Unmarshal(data []byte) error {
+	reader := fieldReader{data: data}
+	for {
+		ok, err := reader.next()
+		if err != nil || !ok {
+			return err
+		}
+		switch reader.field {
+		case 1:
+			m.Type = MatchType(reader.varint)
+		case 2:
+			m.Name = string(reader.bytes)
+		case 3:
+			m.Value = string(reader.bytes)
+		}
+	}
+}
+
+// Marshal encodes the Query.
+func (q Query) Marshal() []byte {
+	buffer := appendVarintField(nil, 1, uint64(q.StartTimestampMs))
+	buffer = appendVarintField(buffer, 2, uint64(q.EndTimestampMs))
+	for _, matcher := range q.Matchers {
+		buffer = appendBytesField(buffer, 3, matcher.Marshal())
+	}
+	return buffer
+}
+
+// Unmarshal decodes the Query.
+func (q *Query) Unmarshal(data []byte) error {
+	reader := fieldReader{data: data}
+	for {
+		ok, err := reader.next()
+		if err != nil || !ok {
+			return err
+		}
+		switch reader.field {
+		case 1:
+			q.StartTimestampMs = int64(reader.varint)
+		case 2:
+			q.EndTimestampMs = int64(reader.varint)
+		case 3:
+			matcher := LabelMatcher{}
+			if err := matcher.Unmarshal(reader.bytes); err != nil {
+				return err
+			}
+			q.Matchers = append(q.Matchers, matcher)
+		}
+	}
+}
+
+// Marshal encodes the ReadRequest.
+func (r ReadRequest) Marshal() []byte {
+	buffer := []byte{}
+	for _, query := range r.Queries {
+		buffer = appendBytesField(buffer, 1, query.Marshal())
+	}
+	return buffer
+}
+
+// Unmarshal decodes the ReadRequest.
+func (r *ReadRequest) Unmarshal(data []byte) error {
+	reader := fieldReader{data: data}
+	for {
+		ok, err := reader.next()
+		if err != nil || !ok {
+			return err
+		}
+		if reader.field == 1 {
+			query := Query{}
+			if err := query.Unmarshal(reader.bytes); err != nil {
+				return err
+			}
+			r.Queries = append(r.Queries, query)
+		}
+	}
+}
+
+// Marshal encodes the Label.
+func (l Label) Marshal() []byte {
+	buffer := appendStringField(nil, 1, l.Name)
+	return appendStringField(buffer, 2, l.Value)
+}
+
+// Unmarshal decodes the Label.
+func (l *Label) Unmarshal(data []byte) error {
+	reader := fieldReader{data: data}
+	for {
+		ok, err := reader.next()
+		if err != nil || !ok {
+			return err
+		}
+		switch reader.field {
+		case 1:
+			l.Name = string(reader.bytes)
+		case 2:
+			l.Value = string(reader.bytes)
+		}
+	}
+}
+
+// Marshal encodes the Sample.
+func (s Sample) Marshal() []byte {
+	buffer := appendDoubleField(nil, 1, s.Value)
+	return appendVarintField(buffer, 2, uint64(s.Timestamp))
+}
+
+// Unmarshal decodes the Sample.
+func (s *Sample) Unmarshal(data []byte) error {
+	reader := fieldReader{data: data}
+	for {
+		ok, err := reader.next()
+		if err != nil || !ok {
+			return err
+		}
+		switch reader.field {
+		case 1:
+			s.Value = math.Float64frombits(reader.varint)
+		case 2:
+			s.Timestamp = int64(reader.varint)
+		}
+	}
+}
+
+// Marshal encodes the TimeSeries.
+func (t TimeSeries) Marshal() []byte {
+	buffer := []byte{}
+	for _, label := range t.Labels {
+		buffer = appendBytesField(buffer, 1, label.Marshal())
+	}
+	for _, sample := range t.Samples {
+		buffer = appendBytesField(buffer, 2, sample.Marshal())
+	}
+	return buffer
+}
+
+// Unmarshal decodes the TimeSeries.
+func (t *TimeSeries) Unmarshal(data []byte) error {
+	reader := fieldReader{data: data}
+	for {
+		ok, err := reader.next()
+		if err != nil || !ok {
+			return err
+		}
+		switch reader.field {
+		case 1:
+			label := Label{}
+			if err := label.Unmarshal(reader.bytes); err != nil {
+				return err
+			}
+			t.Labels = append(t.Labels, label)
+		case 2:
+			sample := Sample{}
+			if err := sample.Unmarshal(reader.bytes); err != nil {
+				return err
+			}
+			t.Samples = append(t.Samples, sample)
+		}
+	}
+}
+
+// Marshal encodes the QueryResult.
+func (q QueryResult) Marshal() []byte {
+	buffer := []byte{}
+	for _, series := range q.Timeseries {
+		buffer = appendBytesField(buffer, 1, series.Marshal())
+	}
+	return buffer
+}
+
+// Unmarshal decodes the QueryResult.
+func (q *QueryResult) Unmarshal(data []byte) error {
+	reader := fieldReader{data: data}
+	for {
+		ok, err := reader.next()
+		if err != nil || !ok {
+			return err
+		}
+		if reader.field == 1 {
+			series := TimeSeries{}
+			if err := series.Unmarshal(reader.bytes); err != nil {
+				return err
+			}
+			q.Timeseries = append(q.Timeseries, series)
+		}
+	}
+}
+
+// Marshal encodes the ReadResponse.
+func (r ReadResponse) Marshal() []byte {
+	buffer := []byte{}
+	for _, result := range r.Results {
+		buffer = appendBytesField(buffer, 1, result.Marshal())
+	}
+	return buffer
+}
+
+// Unmarshal decodes the ReadResponse.
+func (r *ReadResponse) Unmarshal(data []byte) error {
+	reader := fieldReader{data: data}
+	for {
+		ok, err := reader.next()
+		if err != nil || !ok {
+			return err
+		}
+		if reader.field == 1 {
+			result := QueryResult{}
+			if err := result.Unmarshal(reader.bytes); err != nil {
+				return err
+			}
+			r.Results = append(r.Results, result)
+		}
+	}
+}
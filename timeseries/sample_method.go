@@ -29,8 +29,54 @@ const (
 	SampleMin
 	// SampleMean chooses the average value.
 	SampleMean
+	// SampleCount counts the number of raw values.
+	SampleCount
+	// SampleSum adds up the raw values.
+	SampleSum
+	// SampleStddev chooses the (population) standard deviation of the raw values.
+	SampleStddev
+	// SampleP50 through SampleP999 choose a percentile of the raw values, for
+	// metrics (such as timers) whose backend keeps percentiles.
+	SampleP50
+	SampleP75
+	SampleP90
+	SampleP95
+	SampleP98
+	SampleP99
+	SampleP999
 )
 
+// percentiles maps the names of the percentile sample methods (as written in
+// queries) to their constants.
+var percentiles = map[string]SampleMethod{
+	"p50":  SampleP50,
+	"p75":  SampleP75,
+	"p90":  SampleP90,
+	"p95":  SampleP95,
+	"p98":  SampleP98,
+	"p99":  SampleP99,
+	"p999": SampleP999,
+}
+
+// PercentileSampleMethod returns the percentile sample method with the given
+// name (such as "p99"), if there is one.
+func PercentileSampleMethod(name string) (SampleMethod, bool) {
+	method, ok := percentiles[name]
+	return method, ok
+}
+
+// Percentile returns the name of the percentile chosen by the sample method
+// without its "p" prefix (such as "99" or "999"), or "" if it doesn't choose a
+// percentile.
+func (sm SampleMethod) Percentile() string {
+	for name, method := range percentiles {
+		if method == sm {
+			return name[1:]
+		}
+	}
+	return ""
+}
+
 func (sm SampleMethod) String() string {
 	switch sm {
 	case SampleMax:
@@ -39,6 +85,15 @@ func (sm SampleMethod) String() string {
 		return "SampleMin"
 	case SampleMean:
 		return "SampleMean"
+	case SampleCount:
+		return "SampleCount"
+	case SampleSum:
+		return "SampleSum"
+	case SampleStddev:
+		return "SampleStddev"
+	}
+	if percentile := sm.Percentile(); percentile != "" {
+		return "SampleP" + percentile
 	}
 
 	return "unknown"
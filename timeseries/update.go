@@ -0,0 +1,44 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package timeseries
+
+import (
+	"context"
+	"time"
+
+	"github.com/square/metrics/api"
+	"github.com/square/metrics/inspect"
+)
+
+// StorageUpdateAPI is an interface for writing datapoints into timeseries storage.
+type StorageUpdateAPI interface {
+	// WritePoints writes the datapoints to the storage.
+	WritePoints(request WriteRequest) error
+	// CheckHealthy checks if this StorageUpdateAPI is healthy, returning a possible error
+	CheckHealthy() error
+}
+
+// Datapoint is the value of a metric at one instant.
+type Datapoint struct {
+	Metric    api.TaggedMetric
+	Timestamp time.Time
+	Value     float64
+}
+
+type WriteRequest struct {
+	Datapoints []Datapoint
+	Ctx        context.Context // context includes timeout details
+	Profiler   *inspect.Profiler
+}
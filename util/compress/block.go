@@ -0,0 +1,385 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compress
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// A block holds a sequence of timestamped points, compressed as described in
+// "Gorilla: A Fast, Scalable, In-Memory Time Series Database" (Pelkonen et al.).
+//
+// The block starts with a header:
+//
+//   bytes 0-3    the magic string "MQEB"
+//   byte  4      the format version (currently 1)
+//   bytes 5-8    the number of points (big-endian uint32)
+//   bytes 9-16   the first timestamp (big-endian int64)
+//   bytes 17-20  the CRC-32 (IEEE) of the remaining bytes
+//
+// The remaining bytes are a bit stream holding the first value verbatim, then
+// for each later point the delta-of-delta of its timestamp followed by the XOR
+// of its value with the previous one. Timestamps are arbitrary int64 units
+// (e.g. milliseconds) and must strictly increase.
+
+const (
+	blockMagic      = "MQEB"
+	blockVersion    = 1
+	blockHeaderSize = 21
+)
+
+// timestampBuckets lists the bit widths used for delta-of-deltas.
+// A delta-of-delta of zero is written as a single '0' bit. Otherwise, the
+// width of the i'th bucket is prefixed by i+1 '1' bits and a terminating '0'
+// (which the final bucket omits).
+var timestampBuckets = []uint{7, 9, 12, 32, 64}
+
+// CorruptBlockError is returned when a block cannot be decoded.
+type CorruptBlockError struct {
+	Reason string
+}
+
+func (e CorruptBlockError) Error() string {
+	return fmt.Sprintf("corrupt compressed block: %s", e.Reason)
+}
+
+// BlockWriter compresses timestamped points into a block.
+type BlockWriter struct {
+	stream bitWriter
+	count  uint32
+
+	firstTimestamp    int64
+	previousTimestamp int64
+	previousDelta     int64
+
+	previousValue uint64
+	leadingZeros  uint32 // leading zeros of the current XOR window
+	windowLength  uint32 // length of the current XOR window (0 if there is none)
+}
+
+// NewBlockWriter creates an empty BlockWriter.
+func NewBlockWriter() *BlockWriter {
+	return &BlockWriter{}
+}
+
+// Count returns the number of points written so far.
+func (w *BlockWriter) Count() int {
+	return int(w.count)
+}
+
+// Append adds a point to the block. Its timestamp must be greater than that of
+// the previous point.
+func (w *BlockWriter) Append(timestamp int64, value float64) error {
+	bits := math.Float64bits(value)
+	if w.count == 0 {
+		w.firstTimestamp = timestamp
+		w.previousTimestamp = timestamp
+		w.previousValue = bits
+		w.stream.writeBits(bits, 64)
+		w.count++
+		return nil
+	}
+	if timestamp <= w.previousTimestamp {
+		return fmt.Errorf("timestamp %d does not follow previous timestamp %d", timestamp, w.previousTimestamp)
+	}
+	if w.count == math.MaxUint32 {
+		return fmt.Errorf("block is full")
+	}
+	delta := timestamp - w.previousTimestamp
+	w.writeDeltaOfDelta(delta - w.previousDelta)
+	w.writeXOR(bits ^ w.previousValue)
+	w.previousTimestamp = timestamp
+	w.previousDelta = delta
+	w.previousValue = bits
+	w.count++
+	return nil
+}
+
+func (w *BlockWriter) writeDeltaOfDelta(dod int64) {
+	if dod == 0 {
+		w.stream.writeBit(false)
+		return
+	}
+	for i, width := range timestampBuckets {
+		w.stream.writeBit(true)
+		last := i == len(timestampBuckets)-1
+		if !last && !fitsSigned(dod, width) {
+			continue
+		}
+		if !last {
+			w.stream.writeBit(false)
+		}
+		w.stream.writeBits(uint64(dod), width)
+		return
+	}
+}
+
+func (w *BlockWriter) writeXOR(xor uint64) {
+	if xor == 0 {
+		w.stream.writeBit(false)
+		return
+	}
+	w.stream.writeBit(true)
+	leading := leadingZeros64(xor)
+	if leading > 31 {
+		leading = 31
+	}
+	trailing := trailingZeros64(xor)
+	if w.windowLength != 0 && leading >= w.leadingZeros && trailing >= 64-w.leadingZeros-w.windowLength {
+		// The meaningful bits fit inside the previous window.
+		w.stream.writeBit(false)
+		w.stream.writeBits(xor>>(64-w.leadingZeros-w.windowLength), uint(w.windowLength))
+		return
+	}
+	length := 64 - leading - trailing
+	w.stream.writeBit(true)
+	w.stream.writeBits(uint64(leading), 5)
+	w.stream.writeBits(uint64(length), 6) // a length of 64 is written as 0
+	w.stream.writeBits(xor>>trailing, uint(length))
+	w.leadingZeros = leading
+	w.windowLength = length
+}
+
+// Bytes returns the encoded block holding every point appended so far.
+// The writer may continue to be used afterwards.
+func (w *BlockWriter) Bytes() []byte {
+	block := make([]byte, blockHeaderSize, blockHeaderSize+len(w.stream.data))
+	copy(block, blockMagic)
+	block[4] = blockVersion
+	binary.BigEndian.PutUint32(block[5:9], w.count)
+	binary.BigEndian.PutUint64(block[9:17], uint64(w.firstTimestamp))
+	binary.BigEndian.PutUint32(block[17:21], crc32.ChecksumIEEE(w.stream.data))
+	return append(block, w.stream.data...)
+}
+
+// BlockIterator lazily decodes the points of a block.
+type BlockIterator struct {
+	stream    bitReader
+	remaining uint32
+	started   bool
+	err       error
+
+	timestamp int64
+	delta     int64
+
+	value        uint64
+	leadingZeros uint32
+	windowLength uint32
+}
+
+// NewBlockIterator checks the header and checksum of the block and returns an
+// iterator over its points. The block must not be modified while it is in use.
+func NewBlockIterator(block []byte) (*BlockIterator, error) {
+	if len(block) < blockHeaderSize {
+		return nil, CorruptBlockError{fmt.Sprintf("block has %d bytes, shorter than its header", len(block))}
+	}
+	if string(block[0:4]) != blockMagic {
+		return nil, CorruptBlockError{"bad magic string"}
+	}
+	if block[4] != blockVersion {
+		return nil, CorruptBlockError{fmt.Sprintf("unknown version %d", block[4])}
+	}
+	payload := block[blockHeaderSize:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(block[17:21]) {
+		return nil, CorruptBlockError{"checksum mismatch"}
+	}
+	return &BlockIterator{
+		stream:    bitReader{data: payload},
+		remaining: binary.BigEndian.Uint32(block[5:9]),
+		timestamp: int64(binary.BigEndian.Uint64(block[9:17])),
+	}, nil
+}
+
+// Len returns the number of points which haven't been read yet.
+func (it *BlockIterator) Len() int {
+	return int(it.remaining)
+}
+
+// Next advances to the next point, returning false once the block is exhausted
+// or an error has occurred (see Err).
+func (it *BlockIterator) Next() bool {
+	if it.err != nil || it.remaining == 0 {
+		return false
+	}
+	if err := it.advance(); err != nil {
+		it.err = err
+		return false
+	}
+	it.remaining--
+	return true
+}
+
+// At returns the timestamp and value of the current point.
+func (it *BlockIterator) At() (int64, float64) {
+	return it.timestamp, math.Float64frombits(it.value)
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *BlockIterator) Err() error {
+	return it.err
+}
+
+func (it *BlockIterator) advance() error {
+	if !it.started {
+		it.started = true
+		value, err := it.stream.readBits(64)
+		it.value = value
+		return err
+	}
+	dod, err := it.readDeltaOfDelta()
+	if err != nil {
+		return err
+	}
+	it.delta += dod
+	if it.delta <= 0 {
+		return CorruptBlockError{"timestamps do not increase"}
+	}
+	it.timestamp += it.delta
+	xor, err := it.readXOR()
+	if err != nil {
+		return err
+	}
+	it.value ^= xor
+	return nil
+}
+
+func (it *BlockIterator) readDeltaOfDelta() (int64, error) {
+	nonzero, err := it.stream.readBit()
+	if err != nil || !nonzero {
+		return 0, err
+	}
+	for i, width := range timestampBuckets {
+		if i != len(timestampBuckets)-1 {
+			larger, err := it.stream.readBit()
+			if err != nil {
+				return 0, err
+			}
+			if larger {
+				continue
+			}
+		}
+		value, err := it.stream.readBits(width)
+		if err != nil {
+			return 0, err
+		}
+		return signExtend(value, width), nil
+	}
+	panic("unreachable")
+}
+
+func (it *BlockIterator) readXOR() (uint64, error) {
+	changed, err := it.stream.readBit()
+	if err != nil || !changed {
+		return 0, err
+	}
+	newWindow, err := it.stream.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if newWindow {
+		leading, err := it.stream.readBits(5)
+		if err != nil {
+			return 0, err
+		}
+		length, err := it.stream.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		if length == 0 {
+			length = 64
+		}
+		if leading+length > 64 {
+			return 0, CorruptBlockError{"XOR window is wider than 64 bits"}
+		}
+		it.leadingZeros = uint32(leading)
+		it.windowLength = uint32(length)
+	} else if it.windowLength == 0 {
+		return 0, CorruptBlockError{"XOR refers to a missing window"}
+	}
+	meaningful, err := it.stream.readBits(uint(it.windowLength))
+	if err != nil {
+		return 0, err
+	}
+	return meaningful << (64 - it.leadingZeros - it.windowLength), nil
+}
+
+// fitsSigned returns whether the value can be stored as a two's complement
+// integer with the given number of bits.
+func fitsSigned(value int64, width uint) bool {
+	limit := int64(1) << (width - 1)
+	return -limit <= value && value < limit
+}
+
+// signExtend interprets the lowest bits of the value as a two's complement integer.
+func signExtend(value uint64, width uint) int64 {
+	shift := 64 - width
+	return int64(value<<shift) >> shift
+}
+
+// bitWriter appends bits to a byte slice, most significant bit first.
+type bitWriter struct {
+	data  []byte
+	count uint // number of bits written
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.count%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	if bit {
+		w.data[len(w.data)-1] |= 1 << (7 - w.count%8)
+	}
+	w.count++
+}
+
+// writeBits writes the lowest n bits of the value.
+func (w *bitWriter) writeBits(value uint64, n uint) {
+	for i := n; i > 0; i-- {
+		w.writeBit((value>>(i-1))&1 == 1)
+	}
+}
+
+// bitReader reads the bits written by a bitWriter.
+type bitReader struct {
+	data     []byte
+	position uint // number of bits read
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.position >= uint(len(r.data))*8 {
+		return false, CorruptBlockError{"unexpected end of data"}
+	}
+	bit := (r.data[r.position/8]>>(7-r.position%8))&1 == 1
+	r.position++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	value := uint64(0)
+	for i := uint(0); i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value <<= 1
+		if bit {
+			value |= 1
+		}
+	}
+	return value, nil
+}
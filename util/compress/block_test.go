@@ -0,0 +1,219 @@
+// Copyright 2015 - 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compress
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+type point struct {
+	timestamp int64
+	value     float64
+}
+
+func writeBlock(t *testing.T, points []point) []byte {
+	w := NewBlockWriter()
+	for _, p := range points {
+		if err := w.Append(p.timestamp, p.value); err != nil {
+			t.Fatalf("Unexpected error appending %+v: %s", p, err.Error())
+		}
+	}
+	return w.Bytes()
+}
+
+func readBlock(block []byte) ([]point, error) {
+	it, err := NewBlockIterator(block)
+	if err != nil {
+		return nil, err
+	}
+	points := []point{}
+	for it.Next() {
+		timestamp, value := it.At()
+		points = append(points, point{timestamp, value})
+	}
+	return points, it.Err()
+}
+
+func checkPoints(t *testing.T, expected []point, actual []point) {
+	if len(expected) != len(actual) {
+		t.Errorf("Expected %d points but got %d", len(expected), len(actual))
+		return
+	}
+	for i := range expected {
+		// Compare the bits of the values so that NaNs are handled.
+		if expected[i].timestamp != actual[i].timestamp || math.Float64bits(expected[i].value) != math.Float64bits(actual[i].value) {
+			t.Errorf("\tpoint %d: expected %+v but got %+v", i, expected[i], actual[i])
+		}
+	}
+}
+
+func TestBlockRoundtrip(t *testing.T) {
+	points := []point{
+		{1000, 1.0},
+		{31000, 1.3},
+		{61000, 1.3},
+		{91001, -1.3},        // small jitter
+		{121000, math.NaN()}, // every bit of the XOR is meaningful
+		{151000, -1.0},
+		{151001, 6.000659e+06},                // tiny delta
+		{3751001, 1.79e+308},                  // large delta
+		{3751002, 1.79e-308},                  // huge delta-of-delta
+		{1 << 62, 0},                          // delta-of-delta needing every bit
+		{1<<62 + 30000, math.Copysign(0, -1)}, // negative zero
+		{1<<62 + 60000, 2.0000},               // a large, negative delta-of-delta
+	}
+	block := writeBlock(t, points)
+	decoded, err := readBlock(block)
+	if err != nil {
+		t.Fatalf("Unexpected error reading block: %s", err.Error())
+	}
+	checkPoints(t, points, decoded)
+}
+
+func TestBlockRoundtripLarge(t *testing.T) {
+	r := rand.New(rand.NewSource(800))
+	points := make([]point, 100000)
+	timestamp := int64(1455000000000)
+	for i := range points {
+		timestamp += 30000 + r.Int63n(5) - 2
+		points[i] = point{timestamp, r.ExpFloat64()}
+	}
+	decoded, err := readBlock(writeBlock(t, points))
+	if err != nil {
+		t.Fatalf("Unexpected error reading block: %s", err.Error())
+	}
+	checkPoints(t, points, decoded)
+}
+
+func TestBlockEmpty(t *testing.T) {
+	decoded, err := readBlock(NewBlockWriter().Bytes())
+	if err != nil {
+		t.Fatalf("Unexpected error reading block: %s", err.Error())
+	}
+	if len(decoded) != 0 {
+		t.Errorf("Expected no points but got %+v", decoded)
+	}
+}
+
+func TestBlockBytesWhileWriting(t *testing.T) {
+	points := []point{{0, 1}, {10, 2}, {20, 3}, {30, 4}}
+	w := NewBlockWriter()
+	for i, p := range points {
+		if err := w.Append(p.timestamp, p.value); err != nil {
+			t.Fatalf("Unexpected error appending %+v: %s", p, err.Error())
+		}
+		decoded, err := readBlock(w.Bytes())
+		if err != nil {
+			t.Fatalf("Unexpected error reading block: %s", err.Error())
+		}
+		checkPoints(t, points[:i+1], decoded)
+	}
+	if w.Count() != len(points) {
+		t.Errorf("Expected a count of %d but got %d", len(points), w.Count())
+	}
+}
+
+func TestBlockRejectsUnorderedTimestamps(t *testing.T) {
+	w := NewBlockWriter()
+	if err := w.Append(100, 1); err != nil {
+		t.Fatalf("Unexpected error appending: %s", err.Error())
+	}
+	if err := w.Append(100, 2); err == nil {
+		t.Errorf("Expected an error appending a repeated timestamp")
+	}
+	if err := w.Append(50, 2); err == nil {
+		t.Errorf("Expected an error appending an earlier timestamp")
+	}
+	if w.Count() != 1 {
+		t.Errorf("Expected rejected points to be dropped, but the count is %d", w.Count())
+	}
+}
+
+func TestBlockCorruption(t *testing.T) {
+	block := writeBlock(t, []point{{0, 1}, {30, 2.5}, {60, -7}, {95, 1e9}})
+	corruptions := map[string]func([]byte) []byte{
+		"truncated header": func(b []byte) []byte { return b[:blockHeaderSize-1] },
+		"truncated data":   func(b []byte) []byte { return b[:len(b)-1] },
+		"bad magic":        func(b []byte) []byte { b[0] = 'X'; return b },
+		"bad version":      func(b []byte) []byte { b[4] = 99; return b },
+		"flipped bit":      func(b []byte) []byte { b[blockHeaderSize+3] ^= 0x10; return b },
+		"bad checksum":     func(b []byte) []byte { b[20]++; return b },
+		"inflated count": func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[5:9], 1000)
+			return b
+		},
+	}
+	for name, corrupt := range corruptions {
+		copied := append([]byte{}, block...)
+		_, err := readBlock(corrupt(copied))
+		if err == nil {
+			t.Errorf("%s: expected an error reading the block", name)
+			continue
+		}
+		if _, ok := err.(CorruptBlockError); !ok {
+			t.Errorf("%s: expected a CorruptBlockError but got %#v", name, err)
+		}
+	}
+	// The original block is still readable.
+	if _, err := readBlock(block); err != nil {
+		t.Errorf("Unexpected error reading block: %s", err.Error())
+	}
+}
+
+func TestBlockIteratorIsLazy(t *testing.T) {
+	points := []point{{0, 1}, {30, 2}, {60, 3}}
+	it, err := NewBlockIterator(writeBlock(t, points))
+	if err != nil {
+		t.Fatalf("Unexpected error reading block: %s", err.Error())
+	}
+	if it.Len() != 3 {
+		t.Errorf("Expected 3 remaining points but got %d", it.Len())
+	}
+	if !it.Next() {
+		t.Fatalf("Expected a first point: %v", it.Err())
+	}
+	if timestamp, value := it.At(); !reflect.DeepEqual(point{timestamp, value}, points[0]) {
+		t.Errorf("Expected %+v but got %+v", points[0], point{timestamp, value})
+	}
+	if it.Len() != 2 {
+		t.Errorf("Expected 2 remaining points but got %d", it.Len())
+	}
+}
+
+func TestBlockCompressionRatio(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	w := NewBlockWriter()
+	timestamp := int64(1455000000000)
+	value := 100.0
+	count := 10000
+	for i := 0; i < count; i++ {
+		timestamp += 30000
+		if r.Intn(10) == 0 {
+			value += float64(r.Intn(10))
+		}
+		if err := w.Append(timestamp, value); err != nil {
+			t.Fatalf("Unexpected error appending: %s", err.Error())
+		}
+	}
+	ratio := float64(count*16) / float64(len(w.Bytes()))
+	if ratio < 8 {
+		t.Errorf("Expected regular points to compress well, but the compression ratio is %f", ratio)
+	}
+	t.Logf("compression ratio: %f", ratio)
+}
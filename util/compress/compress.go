@@ -124,7 +124,7 @@ func (c *CompressionBuffer) encodeMeaningfulXOR(x uint64) {
 		// Describe the number of leading and trailing zeroes.
 		c.writeOne()
 		c.writeLowerBits(4, uint64(leadingZeros))
-		c.writeLowerBits(5, uint64(length))
+		c.writeLowerBits(5, uint64(length)) // a length of 64 is written as 0
 	}
 
 	// Describe the "meaningful region" of the integer.
@@ -168,3 +168,11 @@ func (c *CompressionBuffer) Compress(data []float64) {
 		c.previousXOR = current
 	}
 }
+
+// CompressFloats compresses the values into a finalized buffer and returns its bytes.
+func CompressFloats(values []float64) []byte {
+	c := NewCompressionBuffer()
+	c.Compress(values)
+	c.Finalize()
+	return c.Bytes()
+}
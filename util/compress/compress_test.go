@@ -16,6 +16,7 @@ package compress
 
 import (
 	_ "fmt"
+	"math"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -118,3 +119,23 @@ func TestCompressionRatio(t *testing.T) {
 	mean = mean / float64(count)
 	t.Logf("mean compression ratio: %f", mean)
 }
+
+func TestFullWidthXOR(t *testing.T) {
+	// Each XOR below has neither leading nor trailing zeros.
+	data := []float64{-1.0, math.Float64frombits(0x7FF8000000000001), -1.0, math.Float64frombits(0x7FF8000000000001), 2.5}
+	decompressed := DecompressFloats(CompressFloats(data), len(data))
+	if len(decompressed) != len(data) {
+		t.Fatalf("Expected %d values but got %d", len(data), len(decompressed))
+	}
+	for i := range data {
+		if math.Float64bits(data[i]) != math.Float64bits(decompressed[i]) {
+			t.Errorf("data[%d] = %x != decompressed[%d] = %x", i, math.Float64bits(data[i]), i, math.Float64bits(decompressed[i]))
+		}
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	if decompressed := DecompressFloats(CompressFloats(nil), 0); len(decompressed) != 0 {
+		t.Errorf("Expected no values but got %v", decompressed)
+	}
+}
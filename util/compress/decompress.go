@@ -122,6 +122,11 @@ func (d *DecompressionBuffer) readPartialXOR(previous float64) float64 {
 func (d *DecompressionBuffer) readFullXOR(previous float64) float64 {
 	leadingZeros := uint32(d.ReadBits(4))
 	xorLength := uint32(d.ReadBits(5))
+	if xorLength == 0 {
+		// A length of 64 doesn't fit in the field, so it's stored as 0
+		// (which otherwise never occurs, since the XOR is nonzero).
+		xorLength = 64
+	}
 
 	xor := d.ReadBits(xorLength) << (64 - leadingZeros - xorLength)
 
@@ -155,3 +160,13 @@ func (d *DecompressionBuffer) Decompress() []float64 {
 	}
 	return result
 }
+
+// DecompressFloats returns the values stored by CompressFloats.
+// The length must be the number of values which were compressed.
+func DecompressFloats(data []byte, length int) []float64 {
+	if length == 0 {
+		return []float64{}
+	}
+	d := NewDecompressionBuffer(data, length)
+	return d.Decompress()
+}